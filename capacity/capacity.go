@@ -0,0 +1,80 @@
+// Package capacity checks and publishes the free space of targetd pools.
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+)
+
+// DefaultOvercommitRatio does not allow allocating more than the free space
+// of a pool.
+const DefaultOvercommitRatio = 1.0
+
+// ErrInsufficient is returned when a pool does not have enough space left.
+var ErrInsufficient = errors.New("insufficient capacity")
+
+// GetOvercommitRatio returns the overcommitRatio storage class parameter, or
+// the overcommit-ratio flag when it is not set. Only thin pools should be
+// overcommitted.
+func GetOvercommitRatio(parameters map[string]string) (float64, error) {
+	value := parameters["overcommitRatio"]
+	if value == "" {
+		ratio := viper.GetFloat64("overcommit-ratio")
+		if ratio == 0 {
+			return DefaultOvercommitRatio, nil
+		}
+		return ratio, nil
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 1 || math.IsInf(ratio, 0) {
+		return 0, fmt.Errorf("invalid overcommitRatio %q: must be a number of at least 1", value)
+	}
+	return ratio, nil
+}
+
+// GetPool returns the pool name from pool_list.
+func GetPool(ctx context.Context, client *targetd.Client, name string) (targetd.Pool, error) {
+	pools, err := client.PoolList(ctx)
+	if err != nil {
+		return targetd.Pool{}, err
+	}
+	for _, pool := range pools {
+		if pool.Name == name {
+			return pool, nil
+		}
+	}
+	return targetd.Pool{}, fmt.Errorf("pool %s does not exist", name)
+}
+
+// Available returns the bytes that can still be allocated in pool, which is
+// its free space multiplied by ratio.
+func Available(pool targetd.Pool, ratio float64) int64 {
+	available := float64(pool.FreeSize) * ratio
+	if available >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(available)
+}
+
+// Check returns an error wrapping ErrInsufficient when size bytes cannot be
+// allocated in the pool name.
+func Check(ctx context.Context, client *targetd.Client, name string, size int64, ratio float64) error {
+	pool, err := GetPool(ctx, client, name)
+	if err != nil {
+		return err
+	}
+	available := Available(pool, ratio)
+	if size > available {
+		if ratio != DefaultOvercommitRatio {
+			return fmt.Errorf("%w: pool %s has %d bytes available with overcommit ratio %g (%d bytes free), %d bytes requested", ErrInsufficient, name, available, ratio, pool.FreeSize, size)
+		}
+		return fmt.Errorf("%w: pool %s has %d bytes free, %d bytes requested", ErrInsufficient, name, pool.FreeSize, size)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+)
+
+const gib = 1 << 30
+
+func TestGetOvercommitRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		flag     float64
+		value    string
+		expected float64
+		err      bool
+	}{
+		{name: "default", expected: DefaultOvercommitRatio},
+		{name: "flag", flag: 2, expected: 2},
+		{name: "parameter", flag: 2, value: "1.5", expected: 1.5},
+		{name: "below 1", value: "0.5", err: true},
+		{name: "infinite", value: "Inf", err: true},
+		{name: "not a number", value: "lots", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("overcommit-ratio", test.flag)
+			defer viper.Reset()
+
+			ratio, err := GetOvercommitRatio(map[string]string{"overcommitRatio": test.value})
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %g", ratio)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ratio != test.expected {
+				t.Errorf("expected %g, got %g", test.expected, ratio)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := fake.NewServer()
+	defer s.Close()
+	s.AddBlockPool("vg-targetd", 10*gib)
+	client, err := targetd.NewClient(s.URL, zap.NewNop(), targetd.Retry(targetd.RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseIdleConnections()
+	ctx := context.Background()
+
+	if err := Check(ctx, client, "vg-targetd", 10*gib, DefaultOvercommitRatio); err != nil {
+		t.Errorf("expected the free space to fit, got %v", err)
+	}
+	if err := Check(ctx, client, "vg-targetd", 20*gib, DefaultOvercommitRatio); !errors.Is(err, ErrInsufficient) {
+		t.Errorf("expected ErrInsufficient, got %v", err)
+	}
+	if err := Check(ctx, client, "vg-targetd", 20*gib, 2); err != nil {
+		t.Errorf("expected the overcommitted space to fit, got %v", err)
+	}
+	if err := Check(ctx, client, "vg-other", gib, DefaultOvercommitRatio); err == nil || errors.Is(err, ErrInsufficient) {
+		t.Errorf("expected an unknown pool error, got %v", err)
+	}
+}
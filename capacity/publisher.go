@@ -0,0 +1,368 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// StorageGroup is the api group of the CSIStorageCapacity resource
+	StorageGroup = "storage.k8s.io"
+
+	// DefaultNamespace is the namespace capacity objects are published in.
+	DefaultNamespace = "kube-system"
+	// DefaultPublishInterval is how often the pools are polled.
+	DefaultPublishInterval = time.Minute
+
+	// storageClassLabel marks the capacity objects of this provisioner with
+	// the name of their storage class
+	storageClassLabel = "targetd.sonck.nl/storage-class"
+	// the CSIStorageCapacity resource has no fields for the pool, these
+	// annotations describe it for dashboards
+	backendAnnotation   = "targetd.sonck.nl/backend"
+	poolAnnotation      = "targetd.sonck.nl/pool"
+	totalSizeAnnotation = "targetd.sonck.nl/total-size"
+	freeSizeAnnotation  = "targetd.sonck.nl/free-size"
+)
+
+// storageVersions are the versions of CSIStorageCapacity in order of
+// preference.
+var storageVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+// errNoResource is returned when the cluster does not serve
+// CSIStorageCapacity.
+var errNoResource = errors.New("the cluster serves no CSIStorageCapacity")
+
+// Publisher publishes the capacity of the targetd pools used by the storage
+// classes of the provisioners as CSIStorageCapacity objects. There is an object for every storage class, or for
+// every allowed topology of storage classes limited to some nodes. Its
+// capacity is the space that can be allocated with the overcommit ratio of
+// the storage class, the total and free size of the pool are annotated.
+//
+// The scheduler only uses CSIStorageCapacity for a storage class when a
+// CSIDriver object named after its provisioner has storageCapacity set. The
+// provisioners are not CSI drivers and no such object is shipped, so the
+// published objects only feed dashboards and monitoring.
+type Publisher struct {
+	client           kubernetes.Interface
+	dynamic          dynamic.Interface
+	backends         *targetd.Backends
+	provisionerNames map[string]bool
+	namespace        string
+	interval         time.Duration
+	log              *zap.Logger
+
+	storageClasses storagelisters.StorageClassLister
+	synced         []cache.InformerSynced
+}
+
+// NewPublisher creates a publisher polling the pools of the storage classes
+// of provisionerNames every interval, and publishing their capacity in
+// namespace. The caller starts the informers of factory.
+func NewPublisher(client kubernetes.Interface, dynamicClient dynamic.Interface, backends *targetd.Backends, provisionerNames []string, namespace string, interval time.Duration, factory informers.SharedInformerFactory, logger *zap.Logger) *Publisher {
+	storageClasses := factory.Storage().V1().StorageClasses()
+	names := make(map[string]bool)
+	for _, name := range provisionerNames {
+		names[name] = true
+	}
+	return &Publisher{
+		client:           client,
+		dynamic:          dynamicClient,
+		backends:         backends,
+		provisionerNames: names,
+		namespace:        namespace,
+		interval:         interval,
+		log:              logger.With(zap.String("system", "capacity")),
+		storageClasses:   storageClasses.Lister(),
+		synced:           []cache.InformerSynced{storageClasses.Informer().HasSynced},
+	}
+}
+
+// Run publishes the capacity every interval until ctx is done.
+func (p *Publisher) Run(ctx context.Context) {
+	if !cache.WaitForCacheSync(ctx.Done(), p.synced...) {
+		p.log.Warn("failed to sync caches")
+		return
+	}
+	p.log.Debug("capacity publisher started")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		err := p.Publish(ctx)
+		if err != nil {
+			p.log.Warn("failed to publish capacity", zap.Error(err))
+		}
+	}, p.interval)
+	p.log.Debug("capacity publisher stopped")
+}
+
+// resource returns the version of CSIStorageCapacity capacity objects are
+// published as.
+func (p *Publisher) resource() (schema.GroupVersionResource, error) {
+	groups, err := p.client.Discovery().ServerGroups()
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	served := make(map[string]bool)
+	for _, group := range groups.Groups {
+		for _, version := range group.Versions {
+			served[version.GroupVersion] = true
+		}
+	}
+	for _, version := range storageVersions {
+		gvr := schema.GroupVersionResource{Group: StorageGroup, Version: version, Resource: "csistoragecapacities"}
+		ok, err := p.serves(served, gvr)
+		if err != nil {
+			return schema.GroupVersionResource{}, err
+		}
+		if ok {
+			return gvr, nil
+		}
+	}
+	return schema.GroupVersionResource{}, errNoResource
+}
+
+// serves returns whether the cluster serves gvr, served are the group
+// versions it serves.
+func (p *Publisher) serves(served map[string]bool, gvr schema.GroupVersionResource) (bool, error) {
+	if !served[gvr.GroupVersion().String()] {
+		return false, nil
+	}
+	resources, err := p.client.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// poolKey identifies a pool of a backend.
+type poolKey struct {
+	backend string
+	pool    string
+}
+
+// Publish polls the pools of the storage classes once and creates, updates
+// or deletes their capacity objects. The objects of storage classes whose
+// pool could not be polled are left as they are.
+func (p *Publisher) Publish(ctx context.Context) error {
+	gvr, err := p.resource()
+	if err != nil {
+		return err
+	}
+	classes, err := p.storageClasses.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	pools := make(map[string][]targetd.Pool)
+	polled := make(map[poolKey]*targetd.Pool)
+	desired := make(map[string]*unstructured.Unstructured)
+	keep := make(map[string]bool)
+	for _, class := range classes {
+		if !p.provisionerNames[class.Provisioner] {
+			continue
+		}
+		log := p.log.With(zap.String("storageclass", class.Name))
+		pool, err := p.getPool(ctx, class, pools, polled)
+		if err != nil {
+			log.Warn("failed to get pool capacity", zap.Error(err))
+			keep[class.Name] = true
+			continue
+		}
+		ratio, err := GetOvercommitRatio(class.Parameters)
+		if err != nil {
+			log.Warn("failed to get overcommit ratio", zap.Error(err))
+			keep[class.Name] = true
+			continue
+		}
+		backend, _, _ := p.backends.Get(class.Parameters["backend"])
+		for i, topology := range nodeTopologies(class) {
+			name := "targetd-" + class.Name
+			if len(class.AllowedTopologies) > 1 {
+				name = fmt.Sprintf("%s-%d", name, i)
+			}
+			desired[name] = p.capacityObject(gvr, name, class, backend, pool, ratio, topology)
+		}
+	}
+
+	existing, err := p.dynamic.Resource(gvr).Namespace(p.namespace).List(ctx, metav1.ListOptions{LabelSelector: storageClassLabel})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range existing.Items {
+		current := &existing.Items[i]
+		object, ok := desired[current.GetName()]
+		if !ok {
+			if keep[current.GetLabels()[storageClassLabel]] {
+				continue
+			}
+			p.log.Debug("deleting capacity", zap.String("name", current.GetName()))
+			err := p.dynamic.Resource(gvr).Namespace(p.namespace).Delete(ctx, current.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("failed to delete CSIStorageCapacity %s: %w", current.GetName(), err))
+			}
+			continue
+		}
+		delete(desired, current.GetName())
+		err := p.update(ctx, gvr, current, object)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update CSIStorageCapacity %s: %w", current.GetName(), err))
+		}
+	}
+	for name, object := range desired {
+		p.log.Debug("creating capacity", zap.String("name", name))
+		_, err := p.dynamic.Resource(gvr).Namespace(p.namespace).Create(ctx, object, metav1.CreateOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to create CSIStorageCapacity %s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d capacity objects failed, first error: %w", len(errs), errs[0])
+	}
+	return nil
+}
+
+// getPool returns the pool of class, calling pool_list once per backend.
+func (p *Publisher) getPool(ctx context.Context, class *storagev1.StorageClass, pools map[string][]targetd.Pool, polled map[poolKey]*targetd.Pool) (*targetd.Pool, error) {
+	backend, client, err := p.backends.Get(class.Parameters["backend"])
+	if err != nil {
+		return nil, err
+	}
+	key := poolKey{backend: backend, pool: getVolumeGroup(class.Parameters)}
+	if pool, ok := polled[key]; ok {
+		return pool, nil
+	}
+	list, ok := pools[backend]
+	if !ok {
+		list, err = client.PoolList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pools[backend] = list
+	}
+	for i := range list {
+		if list[i].Name == key.pool {
+			polled[key] = &list[i]
+			return &list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("pool %s does not exist on backend %s", key.pool, backend)
+}
+
+// getVolumeGroup returns the pool of a storage class, like the provisioners
+// do.
+func getVolumeGroup(parameters map[string]string) string {
+	if parameters["volumeGroup"] == "" {
+		return "vg-targetd"
+	}
+	return parameters["volumeGroup"]
+}
+
+// nodeTopologies returns the nodes that can use the volumes of class, a
+// selector for every allowed topology or one selecting all nodes.
+func nodeTopologies(class *storagev1.StorageClass) []*metav1.LabelSelector {
+	if len(class.AllowedTopologies) == 0 {
+		return []*metav1.LabelSelector{{}}
+	}
+	var selectors []*metav1.LabelSelector
+	for _, term := range class.AllowedTopologies {
+		selector := &metav1.LabelSelector{}
+		for _, expression := range term.MatchLabelExpressions {
+			selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+				Key:      expression.Key,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   expression.Values,
+			})
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors
+}
+
+// capacityObject returns the capacity object name of class on pool.
+func (p *Publisher) capacityObject(gvr schema.GroupVersionResource, name string, class *storagev1.StorageClass, backend string, pool *targetd.Pool, ratio float64, topology *metav1.LabelSelector) *unstructured.Unstructured {
+	available := resource.NewQuantity(Available(*pool, ratio), resource.BinarySI)
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"storageClassName":  class.Name,
+		"capacity":          available.String(),
+		"maximumVolumeSize": available.String(),
+	}}
+	nodeTopology, err := runtime.DefaultUnstructuredConverter.ToUnstructured(topology)
+	if err == nil {
+		object.Object["nodeTopology"] = nodeTopology
+	}
+	object.SetAPIVersion(gvr.GroupVersion().String())
+	object.SetKind("CSIStorageCapacity")
+	object.SetName(name)
+	object.SetNamespace(p.namespace)
+	object.SetLabels(map[string]string{storageClassLabel: class.Name})
+	object.SetAnnotations(map[string]string{
+		backendAnnotation:   backend,
+		poolAnnotation:      pool.Name,
+		totalSizeAnnotation: fmt.Sprint(pool.Size),
+		freeSizeAnnotation:  fmt.Sprint(pool.FreeSize),
+	})
+	// deleting the storage class deletes its capacity objects
+	object.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "storage.k8s.io/v1",
+		Kind:       "StorageClass",
+		Name:       class.Name,
+		UID:        class.UID,
+	}})
+	return object
+}
+
+// update updates current to object when they differ. The storage class and
+// node topology of a CSIStorageCapacity cannot change, it is replaced when
+// they do.
+func (p *Publisher) update(ctx context.Context, gvr schema.GroupVersionResource, current, object *unstructured.Unstructured) error {
+	changed := false
+	for key, value := range object.Object {
+		if key == "metadata" || key == "apiVersion" || key == "kind" {
+			continue
+		}
+		if reflect.DeepEqual(current.Object[key], value) {
+			continue
+		}
+		if key == "storageClassName" || key == "nodeTopology" {
+			p.log.Debug("replacing capacity", zap.String("name", current.GetName()))
+			err := p.dynamic.Resource(gvr).Namespace(p.namespace).Delete(ctx, current.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			_, err = p.dynamic.Resource(gvr).Namespace(p.namespace).Create(ctx, object, metav1.CreateOptions{})
+			return err
+		}
+		changed = true
+	}
+	if !changed && reflect.DeepEqual(current.GetAnnotations(), object.GetAnnotations()) && reflect.DeepEqual(current.GetOwnerReferences(), object.GetOwnerReferences()) {
+		return nil
+	}
+	object = object.DeepCopy()
+	object.SetResourceVersion(current.GetResourceVersion())
+	_, err := p.dynamic.Resource(gvr).Namespace(p.namespace).Update(ctx, object, metav1.UpdateOptions{})
+	return err
+}
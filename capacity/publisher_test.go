@@ -0,0 +1,235 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+var capacityResource = schema.GroupVersionResource{Group: StorageGroup, Version: "v1beta1", Resource: "csistoragecapacities"}
+
+// publisherTest is a publisher of the pools of the iscsi-targetd storage
+// classes on a fake targetd with a 10 GiB volume group vg-targetd, on a
+// cluster serving CSIStorageCapacity of storage.k8s.io/v1beta1.
+type publisherTest struct {
+	*Publisher
+	factory informers.SharedInformerFactory
+	server  *fake.Server
+	client  *targetd.Client
+	dynamic *dynamicfake.FakeDynamicClient
+}
+
+func newPublisherTest(t *testing.T) *publisherTest {
+	s := fake.NewServer()
+	t.Cleanup(s.Close)
+	s.AddBlockPool("vg-targetd", 10*gib)
+	client, err := targetd.NewClient(s.URL, zap.NewNop(), targetd.Retry(targetd.RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	backends, err := targetd.NewBackends("default", map[string]*targetd.Client{"default": client})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kube := kubefake.NewSimpleClientset()
+	kube.Resources = []*metav1.APIResourceList{{
+		GroupVersion: capacityResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: capacityResource.Resource, Namespaced: true, Kind: "CSIStorageCapacity"}},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	factory := informers.NewSharedInformerFactory(kube, 0)
+	p := NewPublisher(kube, dynamicClient, backends, []string{"iscsi-targetd"}, DefaultNamespace, time.Minute, factory, zap.NewNop())
+	return &publisherTest{Publisher: p, factory: factory, server: s, client: client, dynamic: dynamicClient}
+}
+
+// setClass adds or updates class in the informer cache.
+func (test *publisherTest) setClass(t *testing.T, class *storagev1.StorageClass) {
+	t.Helper()
+	if err := test.factory.Storage().V1().StorageClasses().Informer().GetIndexer().Update(class); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (test *publisherTest) publish(t *testing.T) {
+	t.Helper()
+	if err := test.Publish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// objects returns the published capacity objects by name.
+func (test *publisherTest) objects(t *testing.T) map[string]*unstructured.Unstructured {
+	t.Helper()
+	list, err := test.dynamic.Resource(capacityResource).Namespace(DefaultNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := make(map[string]*unstructured.Unstructured)
+	for i := range list.Items {
+		objects[list.Items[i].GetName()] = &list.Items[i]
+	}
+	return objects
+}
+
+// deletes returns the number of deleted capacity objects.
+func (test *publisherTest) deletes() int {
+	n := 0
+	for _, action := range test.dynamic.Actions() {
+		if action.GetVerb() == "delete" {
+			n++
+		}
+	}
+	return n
+}
+
+func storageClass(name string, topologies ...string) *storagev1.StorageClass {
+	class := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name, UID: types.UID("uid-" + name)},
+		Provisioner: "iscsi-targetd",
+	}
+	for _, zone := range topologies {
+		class.AllowedTopologies = append(class.AllowedTopologies, v1.TopologySelectorTerm{
+			MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{{Key: "zone", Values: []string{zone}}},
+		})
+	}
+	return class
+}
+
+func TestPublishCreatesCapacity(t *testing.T) {
+	test := newPublisherTest(t)
+	test.setClass(t, storageClass("iscsi"))
+	test.setClass(t, storageClass("zoned", "a", "b"))
+	other := storageClass("other")
+	other.Provisioner = "other"
+	test.setClass(t, other)
+
+	test.publish(t)
+
+	objects := test.objects(t)
+	if len(objects) != 3 {
+		t.Fatalf("expected three capacity objects, got %d", len(objects))
+	}
+	object, ok := objects["targetd-iscsi"]
+	if !ok {
+		t.Fatal("expected capacity targetd-iscsi")
+	}
+	if object.GetKind() != "CSIStorageCapacity" || object.Object["storageClassName"] != "iscsi" {
+		t.Errorf("unexpected capacity %v", object.Object)
+	}
+	if object.Object["capacity"] != "10Gi" || object.Object["maximumVolumeSize"] != "10Gi" {
+		t.Errorf("expected a capacity of 10Gi, got %v", object.Object["capacity"])
+	}
+	if object.GetLabels()[storageClassLabel] != "iscsi" || object.GetAnnotations()[poolAnnotation] != "vg-targetd" {
+		t.Errorf("unexpected labels %v and annotations %v", object.GetLabels(), object.GetAnnotations())
+	}
+	if owners := object.GetOwnerReferences(); len(owners) != 1 || owners[0].Kind != "StorageClass" || owners[0].UID != "uid-iscsi" {
+		t.Errorf("expected the storage class to own the capacity, got %+v", owners)
+	}
+	for _, name := range []string{"targetd-zoned-0", "targetd-zoned-1"} {
+		if _, ok := objects[name]; !ok {
+			t.Errorf("expected capacity %s", name)
+		}
+	}
+}
+
+func TestPublishUpdatesCapacity(t *testing.T) {
+	test := newPublisherTest(t)
+	test.setClass(t, storageClass("iscsi"))
+	test.publish(t)
+
+	err := test.client.VolCreate(context.Background(), targetd.VolCreateArgs{Pool: "vg-targetd", Name: "pvc-1", Size: 4 * gib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.publish(t)
+
+	object := test.objects(t)["targetd-iscsi"]
+	if object == nil || object.Object["capacity"] != "6Gi" {
+		t.Errorf("expected a capacity of 6Gi, got %v", object)
+	}
+	if test.deletes() != 0 {
+		t.Error("expected the capacity to be updated in place")
+	}
+}
+
+func TestPublishReplacesCapacityOnTopologyChange(t *testing.T) {
+	test := newPublisherTest(t)
+	test.setClass(t, storageClass("iscsi", "a"))
+	test.publish(t)
+	before := test.objects(t)["targetd-iscsi"]
+
+	test.setClass(t, storageClass("iscsi", "b"))
+	test.publish(t)
+
+	after := test.objects(t)["targetd-iscsi"]
+	if after == nil || reflect.DeepEqual(before.Object["nodeTopology"], after.Object["nodeTopology"]) {
+		t.Fatalf("expected the node topology to change, got %v", after)
+	}
+	if test.deletes() != 1 {
+		t.Errorf("expected the capacity to be replaced, got %d deletes", test.deletes())
+	}
+}
+
+func TestPublishDeletesCapacityOfRemovedClasses(t *testing.T) {
+	test := newPublisherTest(t)
+	class := storageClass("iscsi")
+	test.setClass(t, class)
+	test.publish(t)
+
+	if err := test.factory.Storage().V1().StorageClasses().Informer().GetIndexer().Delete(class); err != nil {
+		t.Fatal(err)
+	}
+	test.publish(t)
+
+	if objects := test.objects(t); len(objects) != 0 {
+		t.Errorf("expected the capacity to be deleted, got %d objects", len(objects))
+	}
+}
+
+func TestPublishKeepsCapacityWhenPoolPollFails(t *testing.T) {
+	test := newPublisherTest(t)
+	test.setClass(t, storageClass("iscsi"))
+	test.publish(t)
+
+	test.server.Inject("pool_list", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+	test.publish(t)
+
+	object := test.objects(t)["targetd-iscsi"]
+	if object == nil || object.Object["capacity"] != "10Gi" {
+		t.Errorf("expected the capacity to be kept, got %v", object)
+	}
+	if test.deletes() != 0 {
+		t.Error("expected no capacity to be deleted")
+	}
+}
+
+func TestPublishFailsWithoutCSIStorageCapacity(t *testing.T) {
+	test := newPublisherTest(t)
+	test.Publisher.client.(*kubefake.Clientset).Resources = nil
+	test.setClass(t, storageClass("iscsi"))
+
+	if err := test.Publish(context.Background()); !errors.Is(err, errNoResource) {
+		t.Fatalf("expected errNoResource, got %v", err)
+	}
+	if len(test.dynamic.Actions()) != 0 {
+		t.Error("expected no capacity objects to be published")
+	}
+}
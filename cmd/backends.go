@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultBackendName is the name of the backend configured by the targetd-*
+// flags when the config file does not list any backends.
+const defaultBackendName = "default"
+
+// backendConfig describes a targetd backend listed under targetd-backends in
+// the config file.
+type backendConfig struct {
+	Scheme            string    `mapstructure:"scheme"`
+	Address           string    `mapstructure:"address"`
+	Port              int       `mapstructure:"port"`
+	Username          string    `mapstructure:"username"`
+	Password          string    `mapstructure:"password"`
+	CredentialsDir    string    `mapstructure:"credentials-dir"`
+	CredentialsSecret string    `mapstructure:"credentials-secret"`
+	TLS               tlsConfig `mapstructure:"tls"`
+}
+
+type tlsConfig struct {
+	CAFile             string   `mapstructure:"ca-file"`
+	CertFile           string   `mapstructure:"cert-file"`
+	KeyFile            string   `mapstructure:"key-file"`
+	ServerName         string   `mapstructure:"server-name"`
+	MinVersion         string   `mapstructure:"min-version"`
+	InsecureSkipVerify bool     `mapstructure:"insecure-skip-verify"`
+	PinnedSHA256       []string `mapstructure:"pinned-sha256"`
+}
+
+// flagBackendConfig returns the backend configured by the targetd-* flags,
+// which also provide the defaults for backends from the config file.
+func flagBackendConfig() backendConfig {
+	return backendConfig{
+		Scheme:            viper.GetString("targetd-scheme"),
+		Address:           viper.GetString("targetd-address"),
+		Port:              viper.GetInt("targetd-port"),
+		Username:          viper.GetString("targetd-username"),
+		Password:          viper.GetString("targetd-password"),
+		CredentialsDir:    viper.GetString("targetd-credentials-dir"),
+		CredentialsSecret: viper.GetString("targetd-credentials-secret"),
+		TLS: tlsConfig{
+			CAFile:             viper.GetString("targetd-ca-file"),
+			CertFile:           viper.GetString("targetd-cert-file"),
+			KeyFile:            viper.GetString("targetd-key-file"),
+			ServerName:         viper.GetString("targetd-server-name"),
+			MinVersion:         viper.GetString("targetd-tls-min-version"),
+			InsecureSkipVerify: viper.GetBool("targetd-insecure-skip-verify"),
+			PinnedSHA256:       viper.GetStringSlice("targetd-pinned-sha256"),
+		},
+	}
+}
+
+// backendConfigs returns the configured backends and the name of the default
+// one, which is empty when several backends are configured without
+// targetd-default-backend.
+func backendConfigs() (map[string]backendConfig, string, error) {
+	if !viper.IsSet("targetd-backends") {
+		return map[string]backendConfig{defaultBackendName: flagBackendConfig()}, defaultBackendName, nil
+	}
+	names := viper.GetStringMap("targetd-backends")
+	configs := make(map[string]backendConfig, len(names))
+	for name := range names {
+		config := flagBackendConfig()
+		// slices would be decoded over the default element by element
+		pinned := config.TLS.PinnedSHA256
+		config.TLS.PinnedSHA256 = nil
+		if err := viper.UnmarshalKey("targetd-backends."+name, &config); err != nil {
+			return nil, "", fmt.Errorf("invalid targetd backend %s: %w", name, err)
+		}
+		if config.TLS.PinnedSHA256 == nil {
+			config.TLS.PinnedSHA256 = pinned
+		}
+		configs[name] = config
+	}
+	defaultName := viper.GetString("targetd-default-backend")
+	if defaultName == "" && len(configs) == 1 {
+		for name := range configs {
+			defaultName = name
+		}
+	}
+	return configs, defaultName, nil
+}
+
+// targetdOptions returns the options of the targetd clients configured by
+// the targetd-* flags.
+func targetdOptions() []targetd.Option {
+	return []targetd.Option{
+		targetd.ConnectTimeout(viper.GetDuration("targetd-connect-timeout")),
+		targetd.ListTimeout(viper.GetDuration("targetd-list-timeout")),
+		targetd.MutateTimeout(viper.GetDuration("targetd-mutate-timeout")),
+		targetd.MaxConnections(viper.GetInt("targetd-max-connections")),
+		targetd.IdleConnTimeout(viper.GetDuration("targetd-idle-timeout")),
+		targetd.Retry(targetd.RetryPolicy{
+			Attempts:       viper.GetInt("targetd-retry-attempts"),
+			InitialBackoff: viper.GetDuration("targetd-retry-initial-backoff"),
+			MaxBackoff:     viper.GetDuration("targetd-retry-max-backoff"),
+		}),
+		targetd.CircuitBreaker(targetd.BreakerPolicy{
+			Threshold:    viper.GetInt("targetd-breaker-threshold"),
+			OpenDuration: viper.GetDuration("targetd-breaker-open-duration"),
+		}),
+	}
+}
+
+// newBackends creates a targetd client for every configured backend.
+func newBackends(ctx context.Context, log *zap.Logger, kubernetesClientSet kubernetes.Interface, options []targetd.Option) (*targetd.Backends, error) {
+	configs, defaultName, err := backendConfigs()
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]*targetd.Client, len(configs))
+	for name, config := range configs {
+		client, err := newTargetdClient(ctx, log.With(zap.String("backend", name)), kubernetesClientSet, config, options)
+		if err != nil {
+			return nil, fmt.Errorf("targetd backend %s: %w", name, err)
+		}
+		clients[name] = client
+	}
+	return targetd.NewBackends(defaultName, clients)
+}
+
+func newTargetdClient(ctx context.Context, log *zap.Logger, kubernetesClientSet kubernetes.Interface, config backendConfig, options []targetd.Option) (*targetd.Client, error) {
+	url := fmt.Sprintf("%s://%s:%d/targetrpc", config.Scheme, config.Address, config.Port)
+	log.Debug("targetd URL", zap.String("url", url))
+
+	var credentials targetd.CredentialsProvider
+	var err error
+	switch {
+	case config.CredentialsSecret != "":
+		namespace, name, err := cache.SplitMetaNamespaceKey(config.CredentialsSecret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid targetd credentials secret: %w", err)
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+		credentials, err = targetd.NewSecretCredentials(ctx, kubernetesClientSet, namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load targetd credentials from secret: %w", err)
+		}
+	case config.CredentialsDir != "":
+		credentials, err = targetd.NewFileCredentials(config.CredentialsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load targetd credentials from file: %w", err)
+		}
+	default:
+		credentials = targetd.StaticCredentials{
+			Username: config.Username,
+			Password: config.Password,
+		}
+	}
+	options = append(options[:len(options):len(options)], targetd.Auth(credentials))
+
+	if config.Scheme == "https" {
+		minVersion, err := targetd.ParseTLSVersion(config.TLS.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid targetd tls configuration: %w", err)
+		}
+		options = append(options, targetd.TLS(targetd.TLSConfig{
+			CAFile:             config.TLS.CAFile,
+			CertFile:           config.TLS.CertFile,
+			KeyFile:            config.TLS.KeyFile,
+			ServerName:         config.TLS.ServerName,
+			MinVersion:         minVersion,
+			InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+			PinnedSHA256:       config.TLS.PinnedSHA256,
+		}))
+	}
+	return targetd.NewClient(url, log, options...)
+}
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeConfig returns the config of the cluster given by the master and
+// kubeconfig flags, or the in-cluster config when neither is set.
+func kubeConfig() (*rest.Config, error) {
+	master := viper.GetString("master")
+	kubeconfig := viper.GetString("kubeconfig")
+	if master != "" || kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags(master, kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
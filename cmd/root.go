@@ -19,17 +19,19 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"os"
 	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
 )
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "targetd-controller",
 	Short: "an iscsi/nfs dynamic provisioner for kubernetes",
-	Long: `an iscsi/nfs dynamic provisioner for kubernetes.	It requires targetd to be properly installed on the iscsi server`,
+	Long:  `an iscsi/nfs dynamic provisioner for kubernetes.	It requires targetd to be properly installed on the iscsi server`,
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
@@ -46,13 +48,82 @@ func init() {
 
 	RootCmd.PersistentFlags().String("log-level", "info", "log level")
 	_ = viper.BindPFlag("log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	RootCmd.PersistentFlags().String("config", "", "config file, which can list multiple targetd-backends")
+	_ = viper.BindPFlag("config", RootCmd.PersistentFlags().Lookup("config"))
 
+	// used by start and rotate-chap to reach the cluster and targetd
+	RootCmd.PersistentFlags().String("iscsi-provisioner-name", "iscsi-targetd", "name of this provisioner, must match what is passed in the storage class annotation")
+	_ = viper.BindPFlag("iscsi-provisioner-name", RootCmd.PersistentFlags().Lookup("iscsi-provisioner-name"))
+	RootCmd.PersistentFlags().String("session-chap-credential-file-path", "/var/run/secrets/iscsi-provisioner/session-chap-credential.properties", "path where the credential for session chap authentication can be found")
+	_ = viper.BindPFlag("session-chap-credential-file-path", RootCmd.PersistentFlags().Lookup("session-chap-credential-file-path"))
+	RootCmd.PersistentFlags().String("targetd-default-backend", "", "backend from targetd-backends in the config file used when a storage class or volume does not set the backend, required for those when several backends are configured")
+	_ = viper.BindPFlag("targetd-default-backend", RootCmd.PersistentFlags().Lookup("targetd-default-backend"))
+	RootCmd.PersistentFlags().String("targetd-scheme", "http", "scheme of the targetd connection, can be http or https")
+	_ = viper.BindPFlag("targetd-scheme", RootCmd.PersistentFlags().Lookup("targetd-scheme"))
+	RootCmd.PersistentFlags().String("targetd-ca-file", "", "PEM bundle used to verify the targetd certificate, the system roots are used when empty")
+	_ = viper.BindPFlag("targetd-ca-file", RootCmd.PersistentFlags().Lookup("targetd-ca-file"))
+	RootCmd.PersistentFlags().String("targetd-cert-file", "", "client certificate presented to targetd")
+	_ = viper.BindPFlag("targetd-cert-file", RootCmd.PersistentFlags().Lookup("targetd-cert-file"))
+	RootCmd.PersistentFlags().String("targetd-key-file", "", "key of the client certificate presented to targetd")
+	_ = viper.BindPFlag("targetd-key-file", RootCmd.PersistentFlags().Lookup("targetd-key-file"))
+	RootCmd.PersistentFlags().String("targetd-server-name", "", "server name used for SNI and verification of the targetd certificate, defaults to the targetd address")
+	_ = viper.BindPFlag("targetd-server-name", RootCmd.PersistentFlags().Lookup("targetd-server-name"))
+	RootCmd.PersistentFlags().String("targetd-tls-min-version", "1.2", "minimum TLS version accepted from targetd, can be 1.0, 1.1, 1.2 or 1.3")
+	_ = viper.BindPFlag("targetd-tls-min-version", RootCmd.PersistentFlags().Lookup("targetd-tls-min-version"))
+	RootCmd.PersistentFlags().Bool("targetd-insecure-skip-verify", false, "do not verify the targetd certificate, only use for testing")
+	_ = viper.BindPFlag("targetd-insecure-skip-verify", RootCmd.PersistentFlags().Lookup("targetd-insecure-skip-verify"))
+	RootCmd.PersistentFlags().StringSlice("targetd-pinned-sha256", nil, "SHA-256 fingerprints of which the targetd certificate must match one")
+	_ = viper.BindPFlag("targetd-pinned-sha256", RootCmd.PersistentFlags().Lookup("targetd-pinned-sha256"))
+	RootCmd.PersistentFlags().String("targetd-username", "admin", "username for the targetd connection")
+	_ = viper.BindPFlag("targetd-username", RootCmd.PersistentFlags().Lookup("targetd-username"))
+	RootCmd.PersistentFlags().String("targetd-password", "", "password for the targetd connection, prefer targetd-credentials-dir or targetd-credentials-secret")
+	_ = viper.BindPFlag("targetd-password", RootCmd.PersistentFlags().Lookup("targetd-password"))
+	RootCmd.PersistentFlags().String("targetd-credentials-dir", "", "directory containing username and password files for the targetd connection, reread when they change")
+	_ = viper.BindPFlag("targetd-credentials-dir", RootCmd.PersistentFlags().Lookup("targetd-credentials-dir"))
+	RootCmd.PersistentFlags().String("targetd-credentials-secret", "", "namespace/name of a secret with username and password keys for the targetd connection, watched for changes")
+	_ = viper.BindPFlag("targetd-credentials-secret", RootCmd.PersistentFlags().Lookup("targetd-credentials-secret"))
+	RootCmd.PersistentFlags().String("targetd-address", "localhost", "ip or dns of the targetd server")
+	_ = viper.BindPFlag("targetd-address", RootCmd.PersistentFlags().Lookup("targetd-address"))
+	RootCmd.PersistentFlags().Int("targetd-port", 18700, "port on which targetd is listening")
+	_ = viper.BindPFlag("targetd-port", RootCmd.PersistentFlags().Lookup("targetd-port"))
+	RootCmd.PersistentFlags().Duration("targetd-connect-timeout", targetd.DefaultConnectTimeout, "maximum time spent connecting to targetd")
+	_ = viper.BindPFlag("targetd-connect-timeout", RootCmd.PersistentFlags().Lookup("targetd-connect-timeout"))
+	RootCmd.PersistentFlags().Duration("targetd-list-timeout", targetd.DefaultListTimeout, "maximum duration of targetd calls that only list state, 0 disables the timeout")
+	_ = viper.BindPFlag("targetd-list-timeout", RootCmd.PersistentFlags().Lookup("targetd-list-timeout"))
+	RootCmd.PersistentFlags().Duration("targetd-mutate-timeout", targetd.DefaultMutateTimeout, "maximum duration of targetd calls that change state, 0 disables the timeout")
+	_ = viper.BindPFlag("targetd-mutate-timeout", RootCmd.PersistentFlags().Lookup("targetd-mutate-timeout"))
+	RootCmd.PersistentFlags().Int("targetd-max-connections", targetd.DefaultMaxConnections, "maximum number of connections kept open to targetd")
+	_ = viper.BindPFlag("targetd-max-connections", RootCmd.PersistentFlags().Lookup("targetd-max-connections"))
+	RootCmd.PersistentFlags().Duration("targetd-idle-timeout", targetd.DefaultIdleConnTimeout, "how long an idle connection to targetd is kept for reuse")
+	_ = viper.BindPFlag("targetd-idle-timeout", RootCmd.PersistentFlags().Lookup("targetd-idle-timeout"))
+	RootCmd.PersistentFlags().Int("targetd-retry-attempts", targetd.DefaultRetryAttempts, "number of attempts for targetd calls failing with a transient error, 1 disables retries")
+	_ = viper.BindPFlag("targetd-retry-attempts", RootCmd.PersistentFlags().Lookup("targetd-retry-attempts"))
+	RootCmd.PersistentFlags().Duration("targetd-retry-initial-backoff", targetd.DefaultRetryInitialBackoff, "wait before the first retry of a targetd call, doubled for every retry")
+	_ = viper.BindPFlag("targetd-retry-initial-backoff", RootCmd.PersistentFlags().Lookup("targetd-retry-initial-backoff"))
+	RootCmd.PersistentFlags().Duration("targetd-retry-max-backoff", targetd.DefaultRetryMaxBackoff, "maximum wait between retries of a targetd call")
+	_ = viper.BindPFlag("targetd-retry-max-backoff", RootCmd.PersistentFlags().Lookup("targetd-retry-max-backoff"))
+	RootCmd.PersistentFlags().Int("targetd-breaker-threshold", targetd.DefaultBreakerThreshold, "consecutive transient targetd failures after which calls are rejected for a while, 0 disables the circuit breaker")
+	_ = viper.BindPFlag("targetd-breaker-threshold", RootCmd.PersistentFlags().Lookup("targetd-breaker-threshold"))
+	RootCmd.PersistentFlags().Duration("targetd-breaker-open-duration", targetd.DefaultBreakerOpenDuration, "how long targetd calls are rejected once the circuit breaker opened")
+	_ = viper.BindPFlag("targetd-breaker-open-duration", RootCmd.PersistentFlags().Lookup("targetd-breaker-open-duration"))
+	RootCmd.PersistentFlags().String("master", "", "Master URL")
+	_ = viper.BindPFlag("master", RootCmd.PersistentFlags().Lookup("master"))
+	RootCmd.PersistentFlags().String("kubeconfig", "", "Absolute path to the kubeconfig")
+	_ = viper.BindPFlag("kubeconfig", RootCmd.PersistentFlags().Lookup("kubeconfig"))
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 
 	// read in environment variables that match
 	viper.AutomaticEnv()
+
+	if config := viper.GetString("config"); config != "" {
+		viper.SetConfigFile(config)
+		if err := viper.ReadInConfig(); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+	}
 }
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/iscsi"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rotateChapCmd represents the rotate-chap command
+var rotateChapCmd = &cobra.Command{
+	Use:   "rotate-chap",
+	Short: "Rotate the session chap credentials of iscsi volumes",
+	Long: `Rotate the session chap credentials of the iscsi volumes of this provisioner.
+
+New credentials are generated, or read from --from-file, and set for every
+initiator in the initiators annotation of the volumes. The secrets referenced
+by the volumes are updated once all their initiators have the new
+credentials. When an initiator or secret fails, the initiators and secrets
+sharing its credentials get their previous credentials again. Established
+sessions keep working, nodes need the new credentials when they log in again.
+
+Volumes with chapCredentials file share the credentials of the
+session-chap-credential-file-path, which volumes provisioned later get too.
+Their initiators and secrets are skipped unless that file already has the new
+credentials and is passed with --from-file, so write the new credentials to
+the file first.
+
+The cluster, targetd backends, iscsi-provisioner-name and
+session-chap-credential-file-path are configured with flags, --config or the
+environment, like for start.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log, err := zap.NewProduction()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v", err.Error())
+			os.Exit(1)
+		}
+		config, err := kubeConfig()
+		if err != nil {
+			log.Fatal("failed to get cluster config", zap.Error(err))
+		}
+		kubernetesClientSet, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Fatal("Failed to create kube client set", zap.Error(err))
+		}
+		ctx := context.Background()
+		backends, err := newBackends(ctx, log, kubernetesClientSet, targetdOptions())
+		if err != nil {
+			log.Fatal("failed to create targetd clients", zap.Error(err))
+		}
+		defer backends.CloseIdleConnections()
+
+		result, err := iscsi.RotateChap(ctx, kubernetesClientSet, backends, log, iscsi.RotateChapOptions{
+			ProvisionerName:        viper.GetString("iscsi-provisioner-name"),
+			CredentialsFile:        viper.GetString("rotate-chap.chap-from-file"),
+			SessionCredentialsFile: viper.GetString("session-chap-credential-file-path"),
+			Mutual:                 viper.GetBool("rotate-chap.chap-mutual"),
+			DryRun:                 viper.GetBool("rotate-chap.dry-run"),
+		})
+		if err != nil {
+			log.Fatal("failed to rotate chap credentials", zap.Error(err))
+		}
+		printRotation(result, viper.GetBool("rotate-chap.dry-run"))
+		if result.Failed() {
+			os.Exit(1)
+		}
+	},
+}
+
+// printRotation prints the outcome of every initiator and secret.
+func printRotation(result *iscsi.RotateChapResult, dryRun bool) {
+	status := func(err error) string {
+		switch {
+		case err != nil:
+			return "failed: " + err.Error()
+		case dryRun:
+			return "would rotate"
+		}
+		return "rotated"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "BACKEND\tINITIATOR\tSTATUS")
+	for _, i := range result.Initiators {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", i.Backend, i.Initiator, status(i.Err))
+	}
+	_, _ = fmt.Fprintln(w)
+	_, _ = fmt.Fprintln(w, "SECRET\tCREDENTIALS\tSTATUS")
+	for _, s := range result.Secrets {
+		credentials := "generated"
+		if !s.Generated {
+			credentials = "shared"
+		}
+		_, _ = fmt.Fprintf(w, "%s/%s\t%s\t%s\n", s.Namespace, s.Name, credentials, status(s.Err))
+	}
+	_ = w.Flush()
+}
+
+func init() {
+	RootCmd.AddCommand(rotateChapCmd)
+
+	rotateChapCmd.Flags().String("from-file", "", "properties file with the new credentials, in the format of the session-chap-credential-file-path, new credentials are generated when empty")
+	viper.BindPFlag("rotate-chap.chap-from-file", rotateChapCmd.Flags().Lookup("from-file"))
+	rotateChapCmd.Flags().Bool("mutual", false, "generate mutual credentials for volumes that have none yet")
+	viper.BindPFlag("rotate-chap.chap-mutual", rotateChapCmd.Flags().Lookup("mutual"))
+	rotateChapCmd.Flags().Bool("dry-run", false, "only report the initiators and secrets that would be rotated")
+	viper.BindPFlag("rotate-chap.dry-run", rotateChapCmd.Flags().Lookup("dry-run"))
+}
@@ -16,18 +16,26 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"go.sonck.nl/targetd-provisioner/capacity"
 	"go.sonck.nl/targetd-provisioner/iscsi"
 	"go.sonck.nl/targetd-provisioner/nfs"
 	"go.uber.org/zap"
 	"os"
+	"os/signal"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 	"sync"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // start-controllerCmd represents the start-controller command
@@ -38,20 +46,12 @@ var startcontrollerCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log, err := zap.NewProduction()
 		if err != nil {
-			_,_ = fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v", err.Error())
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v", err.Error())
 			os.Exit(1)
 		}
 		log.Debug("start called")
-		var config *rest.Config
-		master := viper.GetString("master")
-		kubeconfig := viper.GetString("kubeconfig")
-		// creates the in-cluster config
-		log.Debug("creating in cluster default kube client config")
-		if master != "" || kubeconfig != "" {
-			config, err = clientcmd.BuildConfigFromFlags(master, kubeconfig)
-		} else {
-			config, err = rest.InClusterConfig()
-		}
+		log.Debug("creating kube client config")
+		config, err := kubeConfig()
 		if err != nil {
 			log.Fatal("failed to get cluster config", zap.Error(err))
 		}
@@ -73,11 +73,38 @@ var startcontrollerCmd = &cobra.Command{
 			log.Fatal("Error getting server version", zap.Error(err))
 		}
 
-		url := fmt.Sprintf("%s://%s:%s@%s:%d/targetrpc", viper.GetString("targetd-scheme"), viper.GetString("targetd-username"), viper.GetString("targetd-password"), viper.GetString("targetd-address"), viper.GetInt("targetd-port"))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log.Info("received signal, shutting down", zap.String("signal", sig.String()))
+			cancel()
+		}()
 
-		log.Debug("targetd URL", zap.String("url", url))
+		backends, err := newBackends(ctx, log, kubernetesClientSet, targetdOptions())
+		if err != nil {
+			log.Fatal("failed to create targetd clients", zap.Error(err))
+		}
+		defer backends.CloseIdleConnections()
+
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			log.Fatal("Failed to create dynamic kube client", zap.Error(err))
+		}
 
-		iscsiProvisioner := iscsi.NewiscsiProvisioner(url, log)
+		// the controllers share the informers and the event broadcaster, the
+		// informers are started once all controllers requested theirs
+		factory := informers.NewSharedInformerFactory(kubernetesClientSet, viper.GetDuration("resync-period"))
+		dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, viper.GetDuration("resync-period"))
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubernetesClientSet.CoreV1().Events(v1.NamespaceAll)})
+		defer broadcaster.Shutdown()
+		iscsiRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: viper.GetString("iscsi-provisioner-name")})
+		nfsRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: viper.GetString("nfs-provisioner-name")})
+
+		iscsiProvisioner := iscsi.NewiscsiProvisioner(kubernetesClientSet, backends, factory, iscsiRecorder, log)
 		log.Debug("iscsi provisioner created")
 
 		var wg sync.WaitGroup
@@ -93,11 +120,35 @@ var startcontrollerCmd = &cobra.Command{
 		log.Debug("iscsi controller created, running forever...")
 		wg.Add(1)
 		go func() {
-		iscsiPc.Run(context.Background())
+			iscsiPc.Run(ctx)
+			wg.Done()
+		}()
+
+		iscsiResizer := iscsi.NewResizeController(kubernetesClientSet, backends, viper.GetString("iscsi-provisioner-name"), factory, iscsiRecorder, log)
+		log.Debug("iscsi resize controller created")
+		wg.Add(1)
+		go func() {
+			iscsiResizer.Run(ctx)
+			wg.Done()
+		}()
+
+		iscsiAccessGroups := iscsi.NewAccessGroupController(backends, viper.GetString("iscsi-provisioner-name"), factory, iscsiRecorder, log)
+		log.Debug("iscsi access group controller created")
+		wg.Add(1)
+		go func() {
+			iscsiAccessGroups.Run(ctx)
+			wg.Done()
+		}()
+
+		iscsiInitiators := iscsi.NewInitiatorController(kubernetesClientSet, backends, viper.GetString("iscsi-provisioner-name"), factory, iscsiRecorder, log)
+		log.Debug("iscsi initiator controller created")
+		wg.Add(1)
+		go func() {
+			iscsiInitiators.Run(ctx)
 			wg.Done()
 		}()
 
-		nfsProvisioner := nfs.NewnfsProvisioner(url, log)
+		nfsProvisioner := nfs.NewnfsProvisioner(kubernetesClientSet, dynamicClient, viper.GetString("snapshot-api-version"), backends, nfsRecorder, log)
 		log.Debug("iscsi provisioner created")
 
 		nfsPc := controller.NewProvisionController(kubernetesClientSet, viper.GetString("nfs-provisioner-name"), nfsProvisioner, serverVersion.GitVersion, controller.Threadiness(1),
@@ -111,20 +162,45 @@ var startcontrollerCmd = &cobra.Command{
 		log.Debug("iscsi controller created, running forever...")
 		wg.Add(1)
 		go func() {
-		nfsPc.Run(context.Background())
+			nfsPc.Run(ctx)
 			wg.Done()
 		}()
 
+		if viper.GetBool("nfs-snapshots") {
+			nfsSnapshotter := nfs.NewSnapshotController(kubernetesClientSet, dynamicClient, backends, viper.GetString("nfs-provisioner-name"), viper.GetString("snapshot-api-version"), factory, dynamicFactory, nfsRecorder, log)
+			log.Debug("nfs snapshot controller created")
+			wg.Add(1)
+			go func() {
+				nfsSnapshotter.Run(ctx)
+				wg.Done()
+			}()
+		}
+
+		if viper.GetBool("publish-capacity") {
+			publisher := capacity.NewPublisher(kubernetesClientSet, dynamicClient, backends, []string{viper.GetString("iscsi-provisioner-name"), viper.GetString("nfs-provisioner-name")}, viper.GetString("capacity-namespace"), viper.GetDuration("capacity-poll-period"), factory, log)
+			log.Debug("capacity publisher created")
+			wg.Add(1)
+			go func() {
+				publisher.Run(ctx)
+				wg.Done()
+			}()
+		}
+
+		factory.Start(ctx.Done())
+		dynamicFactory.Start(ctx.Done())
+
 		wg.Wait()
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(startcontrollerCmd)
-	startcontrollerCmd.Flags().String("iscsi-provisioner-name", "iscsi-targetd", "name of this provisioner, must match what is passed in the storage class annotation")
-	viper.BindPFlag("iscsi-provisioner-name", startcontrollerCmd.Flags().Lookup("iscsi-provisioner-name"))
 	startcontrollerCmd.Flags().String("nfs-provisioner-name", "nfs-targetd", "name of this provisioner, must match what is passed in the storage class annotation")
 	viper.BindPFlag("nfs-provisioner-name", startcontrollerCmd.Flags().Lookup("nfs-provisioner-name"))
+	startcontrollerCmd.Flags().Bool("nfs-snapshots", false, "handle VolumeSnapshots of nfs volumes, requires the snapshot.storage.k8s.io CRDs and replaces the snapshot-controller of external-snapshotter, which must not run")
+	viper.BindPFlag("nfs-snapshots", startcontrollerCmd.Flags().Lookup("nfs-snapshots"))
+	startcontrollerCmd.Flags().String("snapshot-api-version", nfs.DefaultSnapshotAPIVersion, "version of the snapshot.storage.k8s.io api to use")
+	viper.BindPFlag("snapshot-api-version", startcontrollerCmd.Flags().Lookup("snapshot-api-version"))
 	startcontrollerCmd.Flags().Duration("resync-period", controller.DefaultResyncPeriod, "how often to poll the master API for updates")
 	viper.BindPFlag("resync-period", startcontrollerCmd.Flags().Lookup("resync-period"))
 	startcontrollerCmd.Flags().Bool("exponential-backoff-on-error", controller.DefaultExponentialBackOffOnError, "exponential-backoff-on-error doubles the retry-period everytime there is an error")
@@ -137,24 +213,24 @@ func init() {
 	viper.BindPFlag("renew-deadline", startcontrollerCmd.Flags().Lookup("renew-deadline"))
 	startcontrollerCmd.Flags().Duration("retry-period", controller.DefaultRetryPeriod, "RetryPeriod is the duration the LeaderElector clients should wait between tries of actions")
 	viper.BindPFlag("retry-period", startcontrollerCmd.Flags().Lookup("retry-period"))
-	startcontrollerCmd.Flags().String("targetd-scheme", "http", "scheme of the targetd connection, can be http or https")
-	viper.BindPFlag("targetd-scheme", startcontrollerCmd.Flags().Lookup("targetd-scheme"))
-	startcontrollerCmd.Flags().String("targetd-username", "admin", "username for the targetd connection")
-	viper.BindPFlag("targetd-username", startcontrollerCmd.Flags().Lookup("targetd-username"))
-	startcontrollerCmd.Flags().String("targetd-password", "", "password for the targetd connection")
-	viper.BindPFlag("targetd-password", startcontrollerCmd.Flags().Lookup("targetd-password"))
-	startcontrollerCmd.Flags().String("targetd-address", "localhost", "ip or dns of the targetd server")
-	viper.BindPFlag("targetd-address", startcontrollerCmd.Flags().Lookup("targetd-address"))
-	startcontrollerCmd.Flags().Int("targetd-port", 18700, "port on which targetd is listening")
-	viper.BindPFlag("targetd-port", startcontrollerCmd.Flags().Lookup("targetd-port"))
+	startcontrollerCmd.Flags().Int32("iscsi-lun-min", 0, "lowest lun handed out to iscsi volumes")
+	viper.BindPFlag("iscsi-lun-min", startcontrollerCmd.Flags().Lookup("iscsi-lun-min"))
+	startcontrollerCmd.Flags().Int32("iscsi-lun-max", 255, "highest lun handed out to iscsi volumes, luns are allocated per initiator")
+	viper.BindPFlag("iscsi-lun-max", startcontrollerCmd.Flags().Lookup("iscsi-lun-max"))
+	startcontrollerCmd.Flags().String("iscsi-initiator-key", iscsi.DefaultInitiatorKey, "node annotation or label holding the initiator name of a node, used for storage classes with an initiatorNodeSelector")
+	viper.BindPFlag("iscsi-initiator-key", startcontrollerCmd.Flags().Lookup("iscsi-initiator-key"))
+	startcontrollerCmd.Flags().Float64("overcommit-ratio", capacity.DefaultOvercommitRatio, "how many times the free space of a pool may be allocated, only raise it for thin pools, storage classes can override it with overcommitRatio")
+	viper.BindPFlag("overcommit-ratio", startcontrollerCmd.Flags().Lookup("overcommit-ratio"))
+	startcontrollerCmd.Flags().Bool("publish-capacity", false, "publish the capacity of the pools of the storage classes as CSIStorageCapacity, for dashboards and monitoring, the scheduler ignores them without a CSIDriver object with storageCapacity for the provisioner")
+	viper.BindPFlag("publish-capacity", startcontrollerCmd.Flags().Lookup("publish-capacity"))
+	startcontrollerCmd.Flags().String("capacity-namespace", capacity.DefaultNamespace, "namespace the capacity of the pools is published in")
+	viper.BindPFlag("capacity-namespace", startcontrollerCmd.Flags().Lookup("capacity-namespace"))
+	startcontrollerCmd.Flags().Duration("capacity-poll-period", capacity.DefaultPublishInterval, "how often the capacity of the pools is polled and published")
+	viper.BindPFlag("capacity-poll-period", startcontrollerCmd.Flags().Lookup("capacity-poll-period"))
 	startcontrollerCmd.Flags().String("default-fs", "xfs", "filesystem to use when not specified")
 	viper.BindPFlag("default-fs", startcontrollerCmd.Flags().Lookup("default-fs"))
-	startcontrollerCmd.Flags().String("master", "", "Master URL")
-	viper.BindPFlag("master", startcontrollerCmd.Flags().Lookup("master"))
-	startcontrollerCmd.Flags().String("kubeconfig", "", "Absolute path to the kubeconfig")
-	viper.BindPFlag("kubeconfig", startcontrollerCmd.Flags().Lookup("kubeconfig"))
-	startcontrollerCmd.Flags().String("session-chap-credential-file-path", "/var/run/secrets/iscsi-provisioner/session-chap-credential.properties", "path where the credential for session chap authentication can be found")
-	viper.BindPFlag("session-chap-credential-file-path", startcontrollerCmd.Flags().Lookup("session-chap-credential-file-path"))
+	startcontrollerCmd.Flags().String("iscsi-chap-secret-namespace", iscsi.DefaultChapSecretNamespace, "namespace of the secrets with the generated chap credentials of storage classes with chapCredentials generated")
+	viper.BindPFlag("iscsi-chap-secret-namespace", startcontrollerCmd.Flags().Lookup("iscsi-chap-secret-namespace"))
 
 	// Here you will define your flags and configuration settings.
 
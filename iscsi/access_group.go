@@ -0,0 +1,421 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// exportModeInitiator exports every volume to every initiator
+	exportModeInitiator = "initiator"
+	// exportModeAccessGroup maps every volume once to an access group
+	// containing the initiators
+	exportModeAccessGroup = "accessGroup"
+
+	accessGroupInitType = "iscsi"
+)
+
+// getExportMode returns the exportMode storage class parameter.
+func getExportMode(parameters map[string]string) (string, error) {
+	switch parameters["exportMode"] {
+	case "", exportModeInitiator:
+		return exportModeInitiator, nil
+	case exportModeAccessGroup:
+		return exportModeAccessGroup, nil
+	}
+	return "", fmt.Errorf("invalid exportMode %q: only %s and %s are supported", parameters["exportMode"], exportModeInitiator, exportModeAccessGroup)
+}
+
+// getAccessGroup returns the access group of a storage class, which is named
+// after the storage class unless the accessGroup parameter is set.
+func getAccessGroup(storageClass *storagev1.StorageClass) string {
+	if storageClass.Parameters["accessGroup"] != "" {
+		return storageClass.Parameters["accessGroup"]
+	}
+	return storageClass.Name
+}
+
+// errNoInitiators is returned instead of removing every member of an access
+// group, which would cut off every volume mapped to it.
+var errNoInitiators = errors.New("an access group needs at least one initiator")
+
+// syncAccessGroup creates the access group name containing initiators, or
+// adds and removes initiators until it contains exactly initiators.
+func syncAccessGroup(ctx context.Context, client *targetd.Client, log *zap.Logger, name string, initiators []string) error {
+	return updateAccessGroup(ctx, client, log, name, initiators, true)
+}
+
+// addAccessGroupMembers creates the access group name containing initiators,
+// or adds the initiators it is missing. The other members are kept as they
+// can belong to other storage classes sharing the access group.
+func addAccessGroupMembers(ctx context.Context, client *targetd.Client, log *zap.Logger, name string, initiators []string) error {
+	return updateAccessGroup(ctx, client, log, name, initiators, false)
+}
+
+// updateAccessGroup creates the access group name or adds the initiators it
+// is missing, and removes the members that are not in initiators when
+// remove is set.
+func updateAccessGroup(ctx context.Context, client *targetd.Client, log *zap.Logger, name string, initiators []string, remove bool) error {
+	if len(initiators) == 0 {
+		return errNoInitiators
+	}
+	log = log.With(zap.String("access_group", name))
+	groups, err := client.AccessGroupList(ctx)
+	if err != nil {
+		return err
+	}
+	var group *targetd.AccessGroup
+	for i := range groups {
+		if groups[i].Name == name {
+			group = &groups[i]
+		}
+	}
+	if group == nil {
+		log.Debug("creating access group", zap.String("initiator", initiators[0]))
+		err = client.AccessGroupCreate(ctx, targetd.AccessGroupCreateArgs{
+			AgName:   name,
+			InitID:   initiators[0],
+			InitType: accessGroupInitType,
+		})
+		if err != nil {
+			return err
+		}
+		log.Info("access group created")
+		group = &targetd.AccessGroup{Name: name, InitIDs: initiators[:1]}
+	}
+
+	members := make(map[string]bool)
+	for _, initiator := range group.InitIDs {
+		members[initiator] = true
+	}
+	wanted := make(map[string]bool)
+	// initiators are added before the old ones are removed so the group
+	// never ends up empty
+	for _, initiator := range initiators {
+		wanted[initiator] = true
+		if members[initiator] {
+			continue
+		}
+		log.Info("adding initiator to access group", zap.String("initiator", initiator))
+		err = client.AccessGroupInitAdd(ctx, targetd.AccessGroupInitArgs{
+			AgName:   name,
+			InitID:   initiator,
+			InitType: accessGroupInitType,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !remove {
+		return nil
+	}
+	for _, initiator := range group.InitIDs {
+		if wanted[initiator] {
+			continue
+		}
+		log.Info("removing initiator from access group", zap.String("initiator", initiator))
+		err = client.AccessGroupInitDel(ctx, targetd.AccessGroupInitArgs{
+			AgName:   name,
+			InitID:   initiator,
+			InitType: accessGroupInitType,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapVolume maps a volume to an access group with the first free lun of the
+// group, retrying like exportVolume when the lun was taken in the meantime.
+func (p *iscsiProvisioner) mapVolume(ctx context.Context, client *targetd.Client, pool, vol, group string) (int32, error) {
+	min, max, err := getLunRange()
+	if err != nil {
+		return -1, err
+	}
+	p.lunLock.Lock()
+	defer p.lunLock.Unlock()
+
+	log := p.log.With(zap.String("vol", vol), zap.String("pool", pool), zap.String("access_group", group))
+	for attempt := 1; ; attempt++ {
+		maps, err := client.AccessGroupMapList(ctx)
+		if err != nil {
+			log.Warn("failed to get access_group_map_list", zap.Error(err))
+			return -1, err
+		}
+		used := make(map[int32]bool)
+		for _, m := range maps {
+			if m.AgName != group {
+				continue
+			}
+			if m.PoolName == pool && m.VolName == vol {
+				log.Debug("reusing mapping", zap.Int32("lun", m.HLunID))
+				return m.HLunID, nil
+			}
+			used[m.HLunID] = true
+		}
+		lun, err := firstFreeLun(used, min, max)
+		if err != nil {
+			return -1, fmt.Errorf("failed to map volume to access group %s: %w", group, err)
+		}
+		log.Debug("mapping volume", zap.Int32("lun", lun))
+		err = client.AccessGroupMapCreate(ctx, targetd.AccessGroupMapCreateArgs{
+			PoolName: pool,
+			VolName:  vol,
+			AgName:   group,
+			HLunID:   &lun,
+		})
+		if err == nil {
+			log.Debug("mapped volume", zap.Int32("lun", lun))
+			return lun, nil
+		}
+		if !errors.Is(err, targetd.NoFreeHostLunId) && !targetd.IsConflict(err) {
+			return -1, err
+		}
+		if attempt == lunAttempts {
+			return -1, fmt.Errorf("failed to allocate a lun after %d attempts: %w", lunAttempts, err)
+		}
+		log.Warn("lun was taken, allocating another", zap.Int32("lun", lun), zap.Int("attempt", attempt), zap.Error(err))
+	}
+}
+
+// AccessGroupController keeps the members of the access groups of storage
+// classes in access group mode equal to their initiators parameter and the
+// initiators of the nodes matching their initiatorNodeSelector, within their
+// allowed topologies. An access group shared by several storage classes on
+// the same backend contains the initiators of all of them.
+type AccessGroupController struct {
+	backends        *targetd.Backends
+	provisionerName string
+	log             *zap.Logger
+
+	storageClasses storagelisters.StorageClassLister
+	nodes          corelisters.NodeLister
+	synced         []cache.InformerSynced
+	queue          workqueue.RateLimitingInterface
+	recorder       record.EventRecorder
+}
+
+// NewAccessGroupController creates a controller for the access groups of the
+// storage classes of provisionerName, the caller starts the informers of
+// factory.
+func NewAccessGroupController(backends *targetd.Backends, provisionerName string, factory informers.SharedInformerFactory, recorder record.EventRecorder, logger *zap.Logger) *AccessGroupController {
+	storageClasses := factory.Storage().V1().StorageClasses()
+	nodes := factory.Core().V1().Nodes()
+
+	c := &AccessGroupController{
+		backends:        backends,
+		provisionerName: provisionerName,
+		log:             logger.With(zap.String("system", "iscsi-access-group")),
+		storageClasses:  storageClasses.Lister(),
+		nodes:           nodes.Lister(),
+		synced:          []cache.InformerSynced{storageClasses.Informer().HasSynced, nodes.Informer().HasSynced},
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "iscsi-access-group"),
+		recorder:        recorder,
+	}
+	storageClasses.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.enqueue(newObj)
+			// the access group the storage class left loses its initiators
+			c.enqueueSharing(oldObj)
+		},
+		DeleteFunc: c.enqueueSharing,
+	})
+	nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueueAll() },
+		UpdateFunc: c.nodeUpdated,
+		DeleteFunc: func(interface{}) { c.enqueueAll() },
+	})
+	return c
+}
+
+func (c *AccessGroupController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueSharing enqueues the storage classes sharing the access group of
+// the storage class obj.
+func (c *AccessGroupController) enqueueSharing(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	storageClass, ok := obj.(*storagev1.StorageClass)
+	if !ok {
+		return
+	}
+	backend, group, ok := c.getAccessGroup(storageClass)
+	if !ok {
+		return
+	}
+	storageClasses, err := c.storageClasses.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, other := range storageClasses {
+		if otherBackend, otherGroup, ok := c.getAccessGroup(other); ok && otherBackend == backend && otherGroup == group {
+			c.enqueue(other)
+		}
+	}
+}
+
+// enqueueAll enqueues every storage class whose initiators follow the nodes.
+func (c *AccessGroupController) enqueueAll() {
+	storageClasses, err := c.storageClasses.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, storageClass := range storageClasses {
+		if storageClass.Parameters["initiatorNodeSelector"] != "" {
+			c.enqueue(storageClass)
+		}
+	}
+}
+
+// nodeUpdated enqueues all storage classes when the labels or initiator of a
+// node changed.
+func (c *AccessGroupController) nodeUpdated(oldObj, newObj interface{}) {
+	oldNode, ok1 := oldObj.(*v1.Node)
+	newNode, ok2 := newObj.(*v1.Node)
+	if ok1 && ok2 && nodeChanged(oldNode, newNode) {
+		c.enqueueAll()
+	}
+}
+
+// Run syncs access groups until ctx is done.
+func (c *AccessGroupController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		c.log.Warn("failed to sync caches")
+		return
+	}
+	c.log.Debug("access group controller started")
+	go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	<-ctx.Done()
+	c.log.Debug("access group controller stopped")
+}
+
+func (c *AccessGroupController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *AccessGroupController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.sync(ctx, key.(string))
+	if err != nil {
+		c.log.Warn("failed to sync access group", zap.String("storage_class", key.(string)), zap.Error(err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// getAccessGroup returns the backend and access group of a storage class of
+// the provisioner in access group mode, ok is false for any other storage
+// class.
+func (c *AccessGroupController) getAccessGroup(storageClass *storagev1.StorageClass) (backend, group string, ok bool) {
+	if storageClass.Provisioner != c.provisionerName {
+		return "", "", false
+	}
+	mode, err := getExportMode(storageClass.Parameters)
+	if err != nil || mode != exportModeAccessGroup {
+		return "", "", false
+	}
+	backend, _, err = c.backends.Get(storageClass.Parameters["backend"])
+	if err != nil {
+		return "", "", false
+	}
+	return backend, getAccessGroup(storageClass), true
+}
+
+// getInitiators returns the initiators of all storage classes sharing the
+// access group group on backend.
+func (c *AccessGroupController) getInitiators(backend, group string) ([]string, error) {
+	storageClasses, err := c.storageClasses.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := c.nodes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	chosen := make(map[string]bool)
+	for _, storageClass := range storageClasses {
+		if b, g, ok := c.getAccessGroup(storageClass); !ok || b != backend || g != group {
+			continue
+		}
+		initiators, _, _, err := chooseInitiators(splitInitiators(storageClass.Parameters["initiators"]), storageClass.Parameters["initiatorNodeSelector"], nodes, topologySelector(storageClass.AllowedTopologies))
+		if err != nil {
+			return nil, fmt.Errorf("failed to choose the initiators of storage class %s: %w", storageClass.Name, err)
+		}
+		for _, initiator := range initiators {
+			chosen[initiator] = true
+		}
+	}
+	initiators := make([]string, 0, len(chosen))
+	for initiator := range chosen {
+		initiators = append(initiators, initiator)
+	}
+	sort.Strings(initiators)
+	return initiators, nil
+}
+
+// sync updates the access group of the storage class key.
+func (c *AccessGroupController) sync(ctx context.Context, key string) error {
+	storageClass, err := c.storageClasses.Get(key)
+	if err != nil {
+		// the storage class was deleted, its access group is kept for the
+		// volumes still mapped to it
+		return nil
+	}
+	backend, group, ok := c.getAccessGroup(storageClass)
+	if !ok {
+		return nil
+	}
+	_, client, err := c.backends.Get(backend)
+	if err != nil {
+		return err
+	}
+	initiators, err := c.getInitiators(backend, group)
+	if err != nil {
+		return err
+	}
+	if len(initiators) == 0 {
+		// the storage class is synced again when a matching node shows up
+		c.log.Warn("no initiators resolved, keeping the members of the access group", zap.String("storage_class", key), zap.String("access_group", group))
+		c.recorder.Eventf(storageClass, v1.EventTypeWarning, "NoInitiators", "no initiators match the storage classes sharing access group %s, keeping its members", group)
+		return nil
+	}
+	return syncAccessGroup(ctx, client, c.log, group, initiators)
+}
@@ -0,0 +1,263 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestProvisionAccessGroup(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"exportMode":  exportModeAccessGroup,
+		"accessGroup": "cluster",
+		"initiators":  "iqn.a,iqn.b",
+	})
+
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, ok := s.AccessGroup("cluster")
+	if !ok {
+		t.Fatal("expected access group cluster to be created")
+	}
+	if strings.Join(group.InitIDs, ",") != "iqn.a,iqn.b" {
+		t.Errorf("expected members iqn.a,iqn.b, got %v", group.InitIDs)
+	}
+	maps := s.AccessGroupMaps()
+	if len(maps) != 1 || maps[0].VolName != "pvc-1" || maps[0].HLunID != pv.Spec.ISCSI.Lun {
+		t.Errorf("expected pvc-1 mapped with lun %d, got %+v", pv.Spec.ISCSI.Lun, maps)
+	}
+	if exports := s.Exports(); len(exports) != 0 {
+		t.Errorf("expected no per initiator exports, got %v", exports)
+	}
+
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Fatal(err)
+	}
+	if maps := s.AccessGroupMaps(); len(maps) != 0 {
+		t.Errorf("expected mapping to be removed, got %+v", maps)
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); ok {
+		t.Error("expected volume pvc-1 to be removed")
+	}
+}
+
+func TestProvisionAccessGroupNamedAfterStorageClass(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"exportMode": exportModeAccessGroup,
+		"initiators": "iqn.a",
+	})
+
+	if _, _, err := p.Provision(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.AccessGroup("iscsi"); !ok {
+		t.Error("expected access group iscsi named after the storage class")
+	}
+}
+
+func TestSyncAccessGroup(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	members := func() string {
+		group, _ := s.AccessGroup("cluster")
+		return strings.Join(group.InitIDs, ",")
+	}
+
+	for _, test := range []struct {
+		initiators []string
+		expected   string
+	}{
+		{initiators: []string{"iqn.a", "iqn.b"}, expected: "iqn.a,iqn.b"},
+		{initiators: []string{"iqn.b", "iqn.c"}, expected: "iqn.b,iqn.c"},
+		{initiators: []string{"iqn.c"}, expected: "iqn.c"},
+	} {
+		if err := syncAccessGroup(ctx, client, zap.NewNop(), "cluster", test.initiators); err != nil {
+			t.Fatal(err)
+		}
+		if members() != test.expected {
+			t.Errorf("expected members %s, got %s", test.expected, members())
+		}
+	}
+
+	err = syncAccessGroup(ctx, client, zap.NewNop(), "cluster", nil)
+	if !errors.Is(err, errNoInitiators) {
+		t.Errorf("expected %v, got %v", errNoInitiators, err)
+	}
+	if members() != "iqn.c" {
+		t.Errorf("expected the members to be kept, got %s", members())
+	}
+}
+
+func TestAccessGroupControllerSyncsMembers(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "iscsi"},
+		Provisioner: "iscsi-targetd",
+		Parameters: map[string]string{
+			"exportMode":  exportModeAccessGroup,
+			"accessGroup": "cluster",
+			"initiators":  "iqn.a,iqn.b",
+		},
+	}
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	c := NewAccessGroupController(p.backends, "iscsi-targetd", factory, record.NewFakeRecorder(10), zap.NewNop())
+	if err := factory.Storage().V1().StorageClasses().Informer().GetIndexer().Add(storageClass); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.sync(context.Background(), "iscsi"); err != nil {
+		t.Fatal(err)
+	}
+	group, ok := s.AccessGroup("cluster")
+	if !ok {
+		t.Fatal("expected access group cluster to be created")
+	}
+	if members := strings.Join(group.InitIDs, ","); members != "iqn.a,iqn.b" {
+		t.Errorf("expected members iqn.a,iqn.b, got %s", members)
+	}
+}
+
+func TestAccessGroupControllerKeepsMembersWithoutInitiators(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := syncAccessGroup(ctx, client, zap.NewNop(), "cluster", []string{"iqn.a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// no node matches the selector
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "iscsi"},
+		Provisioner: "iscsi-targetd",
+		Parameters: map[string]string{
+			"exportMode":            exportModeAccessGroup,
+			"accessGroup":           "cluster",
+			"initiatorNodeSelector": "storage=iscsi",
+		},
+	}
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(storageClass), 0)
+	recorder := record.NewFakeRecorder(10)
+	c := NewAccessGroupController(p.backends, "iscsi-targetd", factory, recorder, zap.NewNop())
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+
+	if err := c.sync(ctx, "iscsi"); err != nil {
+		t.Fatal(err)
+	}
+	group, _ := s.AccessGroup("cluster")
+	if strings.Join(group.InitIDs, ",") != "iqn.a" {
+		t.Errorf("expected the members to be kept, got %v", group.InitIDs)
+	}
+	if calls := s.Calls("access_group_init_del"); calls != 0 {
+		t.Errorf("expected no access_group_init_del calls, got %d", calls)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, v1.EventTypeWarning+" NoInitiators") {
+			t.Errorf("expected a NoInitiators warning, got %q", event)
+		}
+	default:
+		t.Error("expected a NoInitiators warning")
+	}
+}
+
+func TestProvisionAccessGroupKeepsOtherMembers(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// iqn.x belongs to another storage class sharing the access group
+	if err := syncAccessGroup(ctx, client, zap.NewNop(), "cluster", []string{"iqn.x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"exportMode":  exportModeAccessGroup,
+		"accessGroup": "cluster",
+		"initiators":  "iqn.a",
+	})
+	if _, _, err := p.Provision(ctx, options); err != nil {
+		t.Fatal(err)
+	}
+	group, _ := s.AccessGroup("cluster")
+	if strings.Join(group.InitIDs, ",") != "iqn.x,iqn.a" {
+		t.Errorf("expected members iqn.x,iqn.a, got %v", group.InitIDs)
+	}
+}
+
+func TestAccessGroupControllerMergesSharedGroup(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	storageClass := func(name, initiators string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			Provisioner: "iscsi-targetd",
+			Parameters: map[string]string{
+				"exportMode":  exportModeAccessGroup,
+				"accessGroup": "cluster",
+				"initiators":  initiators,
+			},
+		}
+	}
+	fast, slow := storageClass("fast", "iqn.a,iqn.b"), storageClass("slow", "iqn.b,iqn.c")
+	// a storage class on another backend does not share the access group
+	other := storageClass("other", "iqn.d")
+	other.Parameters["backend"] = "unknown"
+	factory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	c := NewAccessGroupController(p.backends, "iscsi-targetd", factory, record.NewFakeRecorder(10), zap.NewNop())
+	indexer := factory.Storage().V1().StorageClasses().Informer().GetIndexer()
+	for _, storageClass := range []*storagev1.StorageClass{fast, slow, other} {
+		if err := indexer.Add(storageClass); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	if err := c.sync(ctx, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	group, _ := s.AccessGroup("cluster")
+	if members := strings.Join(group.InitIDs, ","); members != "iqn.a,iqn.b,iqn.c" {
+		t.Errorf("expected members iqn.a,iqn.b,iqn.c, got %s", members)
+	}
+
+	// the initiators of a deleted storage class are removed
+	if err := indexer.Delete(slow); err != nil {
+		t.Fatal(err)
+	}
+	c.enqueueSharing(slow)
+	if c.queue.Len() != 1 {
+		t.Errorf("expected the storage class sharing the access group to be enqueued, got %d keys", c.queue.Len())
+	}
+	if err := c.sync(ctx, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	group, _ = s.AccessGroup("cluster")
+	if members := strings.Join(group.InitIDs, ","); members != "iqn.a,iqn.b" {
+		t.Errorf("expected members iqn.a,iqn.b, got %s", members)
+	}
+}
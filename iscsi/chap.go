@@ -0,0 +1,315 @@
+package iscsi
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/transaction"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// chapCredentialsFile sets up every initiator with the credentials in
+	// the session-chap-credential-file-path
+	chapCredentialsFile = "file"
+	// chapCredentialsGenerated sets up the initiators of every volume with
+	// randomly generated credentials stored in a secret per volume, the
+	// credentials are per initiator and shared by all its volumes
+	chapCredentialsGenerated = "generated"
+
+	// DefaultChapSecretNamespace is the namespace of the secrets with
+	// generated chap credentials.
+	DefaultChapSecretNamespace = "kube-system"
+	// chapSecretLabel marks the secrets with generated chap credentials
+	chapSecretLabel = "targetd.sonck.nl/chap-credentials"
+	// chapInitiatorsAnnotation lists the initiators the credentials of a
+	// secret are set for
+	chapInitiatorsAnnotation = "targetd.sonck.nl/initiators"
+	chapSecretType           = "kubernetes.io/iscsi-chap"
+
+	chapUserLength     = 12
+	chapPasswordLength = 16
+	chapAlphabet       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// errSharedCredentials is returned when initiators already use other
+// generated chap credentials than the ones a volume needs.
+var errSharedCredentials = errors.New("initiators use different chap credentials")
+
+// getChapMode returns the chapCredentials storage class parameter.
+func getChapMode(parameters map[string]string) (string, error) {
+	switch parameters["chapCredentials"] {
+	case "", chapCredentialsFile:
+		return chapCredentialsFile, nil
+	case chapCredentialsGenerated:
+		if !getBool(parameters["chapAuthSession"]) {
+			return "", fmt.Errorf("chapCredentials %s requires chapAuthSession", chapCredentialsGenerated)
+		}
+		return chapCredentialsGenerated, nil
+	}
+	return "", fmt.Errorf("invalid chapCredentials %q: only %s and %s are supported", parameters["chapCredentials"], chapCredentialsFile, chapCredentialsGenerated)
+}
+
+// chapSecretName returns the name of the secret with the generated chap
+// credentials of the volume pvName.
+func chapSecretName(pvName string) string {
+	return pvName + "-chap"
+}
+
+// chapSecretNamespace returns the namespace of the secrets with generated
+// chap credentials.
+func chapSecretNamespace() string {
+	if namespace := viper.GetString("iscsi-chap-secret-namespace"); namespace != "" {
+		return namespace
+	}
+	return DefaultChapSecretNamespace
+}
+
+// randomString returns n random characters of chapAlphabet.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(chapAlphabet)))
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chapAlphabet[c.Int64()]
+	}
+	return string(b), nil
+}
+
+// generateChapCredentials returns random session credentials, with
+// credentials the target authenticates with when mutual is set.
+func generateChapCredentials(mutual bool) (*chapSessionCredentials, error) {
+	n := 2
+	if mutual {
+		n = 4
+	}
+	values := make([]string, n)
+	for i := range values {
+		length := chapPasswordLength
+		if i%2 == 0 {
+			length = chapUserLength
+		}
+		value, err := randomString(length)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	credentials := &chapSessionCredentials{
+		InUser:     values[0],
+		InPassword: values[1],
+	}
+	if mutual {
+		credentials.OutUser = values[2]
+		credentials.OutPassword = values[3]
+	}
+	return credentials, nil
+}
+
+// secretCredentials returns the session credentials in a secret, which uses
+// the keys of the iscsi volume plugin.
+func secretCredentials(secret *v1.Secret) *chapSessionCredentials {
+	return &chapSessionCredentials{
+		InUser:      string(secret.Data["node.session.auth.username"]),
+		InPassword:  string(secret.Data["node.session.auth.password"]),
+		OutUser:     string(secret.Data["node.session.auth.username_in"]),
+		OutPassword: string(secret.Data["node.session.auth.password_in"]),
+	}
+}
+
+// secretData returns the data of a secret with credentials.
+func secretData(credentials *chapSessionCredentials) map[string][]byte {
+	data := map[string][]byte{
+		"node.session.auth.username": []byte(credentials.InUser),
+		"node.session.auth.password": []byte(credentials.InPassword),
+	}
+	if credentials.OutUser != "" {
+		data["node.session.auth.username_in"] = []byte(credentials.OutUser)
+		data["node.session.auth.password_in"] = []byte(credentials.OutPassword)
+	}
+	return data
+}
+
+// listChapSecrets lists the secrets with generated chap credentials.
+func listChapSecrets(ctx context.Context, kube kubernetes.Interface) ([]v1.Secret, error) {
+	list, err := kube.CoreV1().Secrets(chapSecretNamespace()).List(ctx, metav1.ListOptions{LabelSelector: chapSecretLabel})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// sharedCredentials returns the generated credentials already set for any
+// of initiators by another volume than pvName, or nil when there are none.
+// Targetd sets credentials per initiator, so all volumes exported to an
+// initiator have to share them.
+func sharedCredentials(secrets []v1.Secret, pvName string, initiators []string) (*chapSessionCredentials, error) {
+	wanted := make(map[string]bool)
+	for _, initiator := range initiators {
+		wanted[initiator] = true
+	}
+	var shared *chapSessionCredentials
+	var sharedWith string
+	for i := range secrets {
+		secret := &secrets[i]
+		if secret.Name == chapSecretName(pvName) {
+			continue
+		}
+		for _, initiator := range splitInitiators(secret.Annotations[chapInitiatorsAnnotation]) {
+			if !wanted[initiator] {
+				continue
+			}
+			credentials := secretCredentials(secret)
+			if shared == nil {
+				shared, sharedWith = credentials, initiator
+			} else if *shared != *credentials {
+				return nil, fmt.Errorf("%w: %s and %s", errSharedCredentials, sharedWith, initiator)
+			}
+		}
+	}
+	return shared, nil
+}
+
+// ensureChapSecret returns the generated credentials of the volume pvName,
+// creating the secret with them when it does not exist yet. The discovery
+// credentials are copied into the secret, a volume can only reference one.
+func (p *iscsiProvisioner) ensureChapSecret(ctx context.Context, tx *transaction.Transaction, pvName string, initiators []string, mutual bool, discovery map[string][]byte) (*chapSessionCredentials, error) {
+	namespace, name := chapSecretNamespace(), chapSecretName(pvName)
+	secrets, err := listChapSecrets(ctx, p.kube)
+	if err != nil {
+		return nil, err
+	}
+	completed := func() {
+		tx.Completed("delete chap secret "+namespace+"/"+name, func(ctx context.Context) error {
+			err := p.kube.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		})
+	}
+	for i := range secrets {
+		if secrets[i].Name == name {
+			// an earlier attempt created the secret before failing
+			completed()
+			return secretCredentials(&secrets[i]), nil
+		}
+	}
+
+	credentials, err := sharedCredentials(secrets, pvName, initiators)
+	if err != nil {
+		return nil, err
+	}
+	if credentials != nil && mutual != (credentials.OutUser != "") {
+		return nil, errors.New("chapMutual differs from the chap credentials the initiators already use")
+	}
+	if credentials == nil {
+		credentials, err = generateChapCredentials(mutual)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := secretData(credentials)
+	for key, value := range discovery {
+		data[key] = value
+	}
+	sorted := append([]string{}, initiators...)
+	sort.Strings(sorted)
+	_, err = p.kube.CoreV1().Secrets(namespace).Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{chapSecretLabel: chapCredentialsGenerated},
+			Annotations: map[string]string{chapInitiatorsAnnotation: strings.Join(sorted, ",")},
+		},
+		Type: chapSecretType,
+		Data: data,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	completed()
+	return credentials, nil
+}
+
+// getSecretCredentials returns the credentials in the secret ref, along with
+// the secret.
+func getSecretCredentials(ctx context.Context, kube kubernetes.Interface, ref *v1.SecretReference) (*chapSessionCredentials, *v1.Secret, error) {
+	if ref == nil {
+		return nil, nil, errors.New("volume has no chap secret")
+	}
+	secret, err := kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return secretCredentials(secret), secret, nil
+}
+
+// getInitiatorAuth returns the session credentials initiators have on
+// backend, which are those in the chap secrets of the volumes exported to
+// them. Initiators without such volumes are missing and have none.
+func (p *iscsiProvisioner) getInitiatorAuth(ctx context.Context, backend string, initiators []string) (map[string]chapSessionCredentials, error) {
+	volumes, err := p.volumes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, initiator := range initiators {
+		wanted[initiator] = true
+	}
+	auth := make(map[string]chapSessionCredentials)
+	secrets := make(map[v1.SecretReference]*chapSessionCredentials)
+	for _, volume := range volumes {
+		if volume.Annotations["backend"] != backend || volume.Spec.ISCSI == nil || !volume.Spec.ISCSI.SessionCHAPAuth || volume.Spec.ISCSI.SecretRef == nil {
+			continue
+		}
+		ref := *volume.Spec.ISCSI.SecretRef
+		// like the iscsi volume plugin, a secret without namespace is in
+		// the namespace of the claim
+		if ref.Namespace == "" && volume.Spec.ClaimRef != nil {
+			ref.Namespace = volume.Spec.ClaimRef.Namespace
+		}
+		for _, initiator := range splitInitiators(volume.Annotations["initiators"]) {
+			if _, ok := auth[initiator]; ok || !wanted[initiator] {
+				continue
+			}
+			credentials, ok := secrets[ref]
+			if !ok {
+				credentials, _, err = getSecretCredentials(ctx, p.kube, &ref)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get chap secret %s/%s of volume %s: %w", ref.Namespace, ref.Name, volume.Name, err)
+				}
+				secrets[ref] = credentials
+			}
+			auth[initiator] = *credentials
+		}
+	}
+	return auth, nil
+}
+
+// deleteChapSecret deletes the secret with the generated credentials of a
+// volume.
+func deleteChapSecret(ctx context.Context, kube kubernetes.Interface, volume *v1.PersistentVolume) error {
+	if volume.Annotations["chap_credentials"] != chapCredentialsGenerated || volume.Spec.ISCSI == nil || volume.Spec.ISCSI.SecretRef == nil {
+		return nil
+	}
+	ref := volume.Spec.ISCSI.SecretRef
+	err := kube.CoreV1().Secrets(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func generatedParameters(initiators string) map[string]string {
+	return map[string]string{
+		"initiators":      initiators,
+		"chapAuthSession": "true",
+		"chapCredentials": chapCredentialsGenerated,
+	}
+}
+
+func TestGetChapMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		expected   string
+		err        bool
+	}{
+		{name: "default", parameters: map[string]string{}, expected: chapCredentialsFile},
+		{name: "file", parameters: map[string]string{"chapCredentials": "file"}, expected: chapCredentialsFile},
+		{name: "generated", parameters: map[string]string{"chapCredentials": "generated", "chapAuthSession": "true"}, expected: chapCredentialsGenerated},
+		{name: "generated without session auth", parameters: map[string]string{"chapCredentials": "generated"}, err: true},
+		{name: "invalid", parameters: map[string]string{"chapCredentials": "random"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mode, err := getChapMode(test.parameters)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got mode %s", mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode != test.expected {
+				t.Errorf("expected mode %s, got %s", test.expected, mode)
+			}
+		})
+	}
+}
+
+func TestProvisionGeneratesChapCredentials(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, generatedParameters("iqn.a"))
+	options.StorageClass.Parameters["chapMutual"] = "true"
+
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := pv.Spec.ISCSI.SecretRef
+	if ref == nil || ref.Name != "pvc-1-chap" || ref.Namespace != DefaultChapSecretNamespace {
+		t.Fatalf("expected secret ref %s/pvc-1-chap, got %+v", DefaultChapSecretNamespace, ref)
+	}
+	secret, err := p.kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != chapSecretType || secret.Annotations[chapInitiatorsAnnotation] != "iqn.a" {
+		t.Errorf("unexpected secret %+v", secret.ObjectMeta)
+	}
+	credentials := secretCredentials(secret)
+	if len(credentials.InUser) != chapUserLength || len(credentials.InPassword) != chapPasswordLength || credentials.OutUser == "" {
+		t.Errorf("expected generated mutual credentials, got %+v", credentials)
+	}
+	auth, ok := s.InitiatorAuth("iqn.a")
+	if !ok || auth.InUser != credentials.InUser || auth.InPassword != credentials.InPassword || auth.OutUser != credentials.OutUser || auth.OutPassword != credentials.OutPassword {
+		t.Errorf("expected the secret credentials to be set for iqn.a, got %+v", auth)
+	}
+
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the secret to be deleted, got %v", err)
+	}
+}
+
+func TestProvisionSharesChapCredentialsPerInitiator(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	ctx := context.Background()
+
+	first, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, generatedParameters("iqn.a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := p.Provision(ctx, provisionOptions("pvc-2", gib, generatedParameters("iqn.a,iqn.b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := func(name string) chapSessionCredentials {
+		secret, err := p.kube.CoreV1().Secrets(DefaultChapSecretNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *secretCredentials(secret)
+	}
+	if credentials(first.Spec.ISCSI.SecretRef.Name) != credentials(second.Spec.ISCSI.SecretRef.Name) {
+		t.Error("expected volumes exported to the same initiator to share credentials")
+	}
+
+	_, _, err = p.Provision(ctx, provisionOptions("pvc-3", gib, generatedParameters("iqn.c")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p.Provision(ctx, provisionOptions("pvc-4", gib, generatedParameters("iqn.a,iqn.c")))
+	if !errors.Is(err, errSharedCredentials) {
+		t.Errorf("expected errSharedCredentials, got %v", err)
+	}
+}
+
+func TestProvisionRollsBackGeneratedChapSecret(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	s.Inject("initiator_set_auth", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	if _, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, generatedParameters("iqn.a"))); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	_, err := p.kube.CoreV1().Secrets(DefaultChapSecretNamespace).Get(ctx, "pvc-1-chap", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the secret to be rolled back, got %v", err)
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); ok {
+		t.Error("expected the volume to be rolled back")
+	}
+}
+
+func TestProvisionRestoresPreviousChapAuth(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	writeChapCredentials(t, "new-user", "new-password")
+	// iqn.a has the credentials of the secret of an earlier volume
+	previous := chapSessionCredentials{InUser: "old-user", InPassword: "old-password"}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "chap", Namespace: "default"}, Data: secretData(&previous)}
+	if _, err := p.kube.CoreV1().Secrets("default").Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	setVolumes(t, p, &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pvc-0",
+			Annotations: map[string]string{"backend": "default", "initiators": "iqn.a"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				ISCSI: &v1.ISCSIPersistentVolumeSource{
+					SessionCHAPAuth: true,
+					SecretRef:       &v1.SecretReference{Name: "chap", Namespace: "default"},
+				},
+			},
+		},
+	})
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setInitiatorAuth(ctx, client, "iqn.a", &previous); err != nil {
+		t.Fatal(err)
+	}
+	// iqn.a gets the new credentials, iqn.b fails
+	s.Inject("initiator_set_auth", fake.Fault{Times: 1})
+	s.Inject("initiator_set_auth", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	_, _, err = p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{
+		"initiators":      "iqn.a,iqn.b",
+		"chapAuthSession": "true",
+	}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	// the setup, iqn.a, iqn.b and restoring iqn.a
+	if calls := s.Calls("initiator_set_auth"); calls != 4 {
+		t.Errorf("expected 4 initiator_set_auth calls, got %d", calls)
+	}
+	if auth, _ := s.InitiatorAuth("iqn.a"); auth.InUser != previous.InUser || auth.InPassword != previous.InPassword {
+		t.Errorf("expected iqn.a to get its previous credentials again, got %+v", auth)
+	}
+	if _, ok := s.InitiatorAuth("iqn.b"); ok {
+		t.Error("expected iqn.b to have no credentials")
+	}
+}
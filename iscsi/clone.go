@@ -0,0 +1,89 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// cloneSource is the volume a new volume is copied from.
+type cloneSource struct {
+	backend string
+	pool    string
+	vol     string
+}
+
+// getCloneSource returns the volume of the claim in the data source of the
+// claim being provisioned, or nil when it has no data source.
+func (p *iscsiProvisioner) getCloneSource(ctx context.Context, options controller.ProvisionOptions) (*cloneSource, error) {
+	dataSource := options.PVC.Spec.DataSource
+	if dataSource == nil {
+		return nil, nil
+	}
+	if dataSource.Kind != "PersistentVolumeClaim" || (dataSource.APIGroup != nil && *dataSource.APIGroup != "") {
+		return nil, fmt.Errorf("unsupported data source %s %s", dataSource.Kind, dataSource.Name)
+	}
+	claim, err := p.kube.CoreV1().PersistentVolumeClaims(options.PVC.Namespace).Get(ctx, dataSource.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source claim %s: %w", dataSource.Name, err)
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("source claim %s is not bound", claim.Name)
+	}
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != options.StorageClass.Name {
+		return nil, fmt.Errorf("source claim %s does not use storage class %s", claim.Name, options.StorageClass.Name)
+	}
+	volume, err := p.kube.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source volume %s: %w", claim.Spec.VolumeName, err)
+	}
+	if volume.Spec.ISCSI == nil || volume.Annotations["volume_name"] == "" || volume.Annotations["pool"] == "" {
+		return nil, fmt.Errorf("source volume %s is not an iscsi volume of this provisioner", volume.Name)
+	}
+	return &cloneSource{
+		backend: volume.Annotations["backend"],
+		pool:    volume.Annotations["pool"],
+		vol:     volume.Annotations["volume_name"],
+	}, nil
+}
+
+// copyVolume creates vol in pool with size bytes from the contents of source.
+func (p *iscsiProvisioner) copyVolume(ctx context.Context, client *targetd.Client, source *cloneSource, pool, vol string, size int64) error {
+	log := p.log.With(zap.String("vol", vol), zap.Int64("size", size), zap.String("pool", pool), zap.String("source", source.vol))
+	if source.pool != pool {
+		return fmt.Errorf("source volume %s is in pool %s, not in %s", source.vol, source.pool, pool)
+	}
+	vols, err := client.VolList(ctx, targetd.VolListArgs{Pool: pool})
+	if err != nil {
+		return err
+	}
+	var sourceSize int64 = -1
+	for _, v := range vols {
+		if v.Name == source.vol {
+			sourceSize = v.Size
+		}
+	}
+	if sourceSize < 0 {
+		return fmt.Errorf("source volume %s does not exist in pool %s", source.vol, pool)
+	}
+	if size < sourceSize {
+		return fmt.Errorf("requested size %d is smaller than the %d bytes of source volume %s", size, sourceSize, source.vol)
+	}
+	log.Debug("copying volume")
+	err = client.VolCopy(ctx, targetd.VolCopyArgs{
+		Pool:    pool,
+		VolOrig: source.vol,
+		VolNew:  vol,
+		Size:    size,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debug("copied volume")
+	return nil
+}
@@ -0,0 +1,126 @@
+package iscsi
+
+import (
+	"context"
+	"testing"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// provisionSource provisions pvc-1 and registers it with its bound claim
+// claim-pvc-1 of storage class iscsi in the kube client of p.
+func provisionSource(t *testing.T, p *iscsiProvisioner) *v1.PersistentVolume {
+	t.Helper()
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"})
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := options.PVC.DeepCopy()
+	claim.Spec.StorageClassName = &options.StorageClass.Name
+	claim.Spec.VolumeName = pv.Name
+	claim.Status.Phase = v1.ClaimBound
+	if _, err := p.kube.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.kube.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return pv
+}
+
+// cloneOptions requests pvc-2 of size bytes cloned from claim-pvc-1.
+func cloneOptions(size int64) controller.ProvisionOptions {
+	options := provisionOptions("pvc-2", size, map[string]string{"initiators": "iqn.a"})
+	options.PVC.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-pvc-1"}
+	return options
+}
+
+func TestProvisionClone(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	provisionSource(t, p)
+
+	pv, _, err := p.Provision(context.Background(), cloneOptions(2*gib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("vol_copy"); calls != 1 {
+		t.Errorf("expected 1 vol_copy call, got %d", calls)
+	}
+	if calls := s.Calls("vol_create"); calls != 1 {
+		t.Errorf("expected only the source to be created with vol_create, got %d calls", calls)
+	}
+	volume, ok := s.Volume("vg-targetd", "pvc-2")
+	if !ok {
+		t.Fatal("expected volume pvc-2 to be created")
+	}
+	if volume.Size != 2*gib {
+		t.Errorf("expected the clone to have %d bytes, got %d", int64(2*gib), volume.Size)
+	}
+	if pv.Annotations["volume_name"] != "pvc-2" || len(s.Exports()) != 2 {
+		t.Errorf("expected the clone to be exported, got %v and %+v", pv.Annotations, s.Exports())
+	}
+}
+
+func TestProvisionCloneRefusesSmallerSize(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	provisionSource(t, p)
+
+	if _, _, err := p.Provision(context.Background(), cloneOptions(gib/2)); err == nil {
+		t.Fatal("expected a clone smaller than its source to be refused")
+	}
+	if calls := s.Calls("vol_copy"); calls != 0 {
+		t.Errorf("expected no vol_copy calls, got %d", calls)
+	}
+}
+
+func TestProvisionCloneRequiresBoundSource(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	provisionSource(t, p)
+	claim, err := p.kube.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), "claim-pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim.Status.Phase = v1.ClaimPending
+	if _, err := p.kube.CoreV1().PersistentVolumeClaims("default").Update(context.Background(), claim, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := p.Provision(context.Background(), cloneOptions(gib)); err == nil {
+		t.Fatal("expected a clone of a pending claim to be refused")
+	}
+	if calls := s.Calls("vol_copy"); calls != 0 {
+		t.Errorf("expected no vol_copy calls, got %d", calls)
+	}
+}
+
+func TestProvisionCloneCopiesResumedVolumeAgain(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	provisionSource(t, p)
+	ctx := context.Background()
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an earlier attempt was interrupted while copying
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg-targetd", Name: "pvc-2", Size: 2 * gib}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := p.Provision(ctx, cloneOptions(2*gib)); err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("vol_destroy"); calls != 1 {
+		t.Errorf("expected the volume of the earlier attempt to be destroyed, got %d vol_destroy calls", calls)
+	}
+	if calls := s.Calls("vol_copy"); calls != 1 {
+		t.Errorf("expected the volume to be copied again, got %d vol_copy calls", calls)
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-2"); !ok {
+		t.Error("expected volume pvc-2 to exist")
+	}
+}
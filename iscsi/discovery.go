@@ -0,0 +1,63 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The keys of the discovery credentials in a secret of the iscsi volume
+// plugin.
+const (
+	discoveryUserKey       = "discovery.sendtargets.auth.username"
+	discoveryPasswordKey   = "discovery.sendtargets.auth.password"
+	discoveryUserInKey     = "discovery.sendtargets.auth.username_in"
+	discoveryPasswordInKey = "discovery.sendtargets.auth.password_in"
+)
+
+// getChapSecretRef returns the secret with the chap credentials of volumes
+// whose credentials are not generated, which is the chapSecret storage class
+// parameter as namespace/name, or <iscsi-provisioner-name>-chap-secret.
+func getChapSecretRef(parameters map[string]string) (*v1.SecretReference, error) {
+	ref := parameters["chapSecret"]
+	if ref == "" {
+		return &v1.SecretReference{Name: viper.GetString("iscsi-provisioner-name") + "-chap-secret"}, nil
+	}
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid chapSecret %q: must be namespace/name", ref)
+	}
+	return &v1.SecretReference{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// getDiscoveryCredentials returns the discovery credentials in the secret
+// ref, which is looked up in namespace when it has none like the iscsi
+// volume plugin does. They are only validated, targetd has no call to set
+// discovery authentication so the target has to be configured with the same
+// credentials by hand.
+func (p *iscsiProvisioner) getDiscoveryCredentials(ctx context.Context, ref *v1.SecretReference, namespace string) (map[string][]byte, error) {
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	secret, err := p.kube.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discovery chap secret %s/%s: %w", namespace, ref.Name, err)
+	}
+	if len(secret.Data[discoveryUserKey]) == 0 || len(secret.Data[discoveryPasswordKey]) == 0 {
+		return nil, fmt.Errorf("discovery chap secret %s/%s has no %s and %s", namespace, ref.Name, discoveryUserKey, discoveryPasswordKey)
+	}
+	if (len(secret.Data[discoveryUserInKey]) == 0) != (len(secret.Data[discoveryPasswordInKey]) == 0) {
+		return nil, fmt.Errorf("discovery chap secret %s/%s needs both %s and %s for mutual authentication", namespace, ref.Name, discoveryUserInKey, discoveryPasswordInKey)
+	}
+	credentials := make(map[string][]byte)
+	for _, key := range []string{discoveryUserKey, discoveryPasswordKey, discoveryUserInKey, discoveryPasswordInKey} {
+		if value := secret.Data[key]; len(value) > 0 {
+			credentials[key] = value
+		}
+	}
+	return credentials, nil
+}
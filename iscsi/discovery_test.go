@@ -0,0 +1,129 @@
+package iscsi
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGetChapSecretRef(t *testing.T) {
+	viper.Set("iscsi-provisioner-name", "iscsi-targetd")
+	defer viper.Reset()
+
+	tests := []struct {
+		chapSecret string
+		namespace  string
+		name       string
+		err        bool
+	}{
+		{name: "iscsi-targetd-chap-secret"},
+		{chapSecret: "storage/chap", namespace: "storage", name: "chap"},
+		{chapSecret: "chap", err: true},
+		{chapSecret: "storage/", err: true},
+	}
+	for _, test := range tests {
+		ref, err := getChapSecretRef(map[string]string{"chapSecret": test.chapSecret})
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.chapSecret, ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.chapSecret, err)
+			continue
+		}
+		if ref.Namespace != test.namespace || ref.Name != test.name {
+			t.Errorf("%q: expected %s/%s, got %s/%s", test.chapSecret, test.namespace, test.name, ref.Namespace, ref.Name)
+		}
+	}
+}
+
+// discoverySecret returns a secret with discovery credentials in storage/chap.
+func discoverySecret(data map[string]string) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "chap", Namespace: "storage"},
+		Data:       make(map[string][]byte),
+	}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
+
+func TestProvisionRequiresDiscoveryCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret *v1.Secret
+	}{
+		{name: "missing secret"},
+		{name: "no password", secret: discoverySecret(map[string]string{discoveryUserKey: "user"})},
+		{name: "half mutual", secret: discoverySecret(map[string]string{discoveryUserKey: "user", discoveryPasswordKey: "password", discoveryUserInKey: "target"})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, s := newTestProvisioner(t)
+			if test.secret != nil {
+				if _, err := p.kube.CoreV1().Secrets("storage").Create(context.Background(), test.secret, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			options := provisionOptions("pvc-1", gib, map[string]string{
+				"initiators":        "iqn.a",
+				"chapAuthDiscovery": "true",
+				"chapSecret":        "storage/chap",
+			})
+
+			if _, _, err := p.Provision(context.Background(), options); err == nil {
+				t.Fatal("expected provisioning to fail")
+			}
+			if s.Calls("vol_create") != 0 {
+				t.Error("expected no volume to be created")
+			}
+			select {
+			case event := <-p.recorder.(*record.FakeRecorder).Events:
+				if !strings.Contains(event, "DiscoveryCHAPMisconfigured") {
+					t.Errorf("expected a DiscoveryCHAPMisconfigured event, got %q", event)
+				}
+			default:
+				t.Error("expected a DiscoveryCHAPMisconfigured event")
+			}
+		})
+	}
+}
+
+func TestProvisionCopiesDiscoveryCredentials(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	ctx := context.Background()
+	secret := discoverySecret(map[string]string{discoveryUserKey: "user", discoveryPasswordKey: "password"})
+	if _, err := p.kube.CoreV1().Secrets("storage").Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	parameters := generatedParameters("iqn.a")
+	parameters["chapAuthDiscovery"] = "true"
+	parameters["chapSecret"] = "storage/chap"
+
+	pv, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, parameters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pv.Spec.ISCSI.DiscoveryCHAPAuth {
+		t.Error("expected discovery chap to be enabled")
+	}
+	ref := pv.Spec.ISCSI.SecretRef
+	generated, err := p.kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(generated.Data[discoveryUserKey]) != "user" || string(generated.Data[discoveryPasswordKey]) != "password" {
+		t.Errorf("expected the discovery credentials in %s/%s, got %v", ref.Namespace, ref.Name, generated.Data)
+	}
+	if len(generated.Data["node.session.auth.username"]) == 0 {
+		t.Error("expected the generated session credentials to be kept")
+	}
+}
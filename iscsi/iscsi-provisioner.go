@@ -4,16 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"go.sonck.nl/targetd-provisioner/capacity"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/transaction"
 	"go.uber.org/zap"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/magiconair/properties"
-	"github.com/powerman/rpc-codec/jsonrpc2"
 	"github.com/spf13/viper"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/util"
 )
@@ -25,67 +33,50 @@ type chapSessionCredentials struct {
 	OutPassword string `properties:"node.session.auth.password_in"`
 }
 
-type volCreateArgs struct {
-	Pool string `json:"pool"`
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-}
-
-//initiator_set_auth(initiator_wwn, in_user, in_pass, out_user, out_pass)
-type initiatorSetAuthArgs struct {
-	InitiatorWwn string `json:"initiator_wwn"`
-	InUser       string `json:"in_user"`
-	InPassword   string `json:"in_pass"`
-	OutUser      string `json:"out_user"`
-	OutPassword  string `json:"out_pass"`
-}
-
-type volDestroyArgs struct {
-	Pool string `json:"pool"`
-	Name string `json:"name"`
-}
-
-type exportCreateArgs struct {
-	Pool         string `json:"pool"`
-	Vol          string `json:"vol"`
-	InitiatorWwn string `json:"initiator_wwn"`
-	Lun          int32  `json:"lun"`
-}
-
-type exportDestroyArgs struct {
-	Pool         string `json:"pool"`
-	Vol          string `json:"vol"`
-	InitiatorWwn string `json:"initiator_wwn"`
-}
-
 type iscsiProvisioner struct {
-	targetdURL string
-	log *zap.Logger
+	kube     kubernetes.Interface
+	backends *targetd.Backends
+	log      *zap.Logger
+	recorder record.EventRecorder
+	nodes    corelisters.NodeLister
+	volumes  corelisters.PersistentVolumeLister
+	synced   []cache.InformerSynced
+	// lunLock serializes lun allocations of this process
+	lunLock sync.Mutex
 }
 
-type export struct {
-	InitiatorWwn string `json:"initiator_wwn"`
-	Lun          int32  `json:"lun"`
-	VolName      string `json:"vol_name"`
-	VolSize      int    `json:"vol_size"`
-	VolUUID      string `json:"vol_uuid"`
-	Pool         string `json:"pool"`
-}
-
-type exportList []export
+type exportList []targetd.Export
 
 func (l exportList) String() string {
-	return fmt.Sprint((interface{})(l))
+	return fmt.Sprint([]targetd.Export(l))
 }
 
-// NewiscsiProvisioner creates new iscsi provisioner
-func NewiscsiProvisioner(url string, logger *zap.Logger) controller.Provisioner {
+// NewiscsiProvisioner creates new iscsi provisioner, the caller starts the
+// informers of factory.
+func NewiscsiProvisioner(kube kubernetes.Interface, backends *targetd.Backends, factory informers.SharedInformerFactory, recorder record.EventRecorder, logger *zap.Logger) controller.Provisioner {
+	nodes := factory.Core().V1().Nodes()
+	volumes := factory.Core().V1().PersistentVolumes()
 	return &iscsiProvisioner{
-		targetdURL: url,
-		log: logger.With(zap.String("system", "iscsi")),
+		kube:     kube,
+		backends: backends,
+		log:      logger.With(zap.String("system", "iscsi")),
+		recorder: recorder,
+		nodes:    nodes.Lister(),
+		volumes:  volumes.Lister(),
+		synced:   []cache.InformerSynced{nodes.Informer().HasSynced, volumes.Informer().HasSynced},
 	}
 }
 
+// hasSynced returns whether the caches of the nodes and volumes have synced.
+func (p *iscsiProvisioner) hasSynced() bool {
+	for _, synced := range p.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
 // getAccessModes returns access modes iscsi volume supported.
 func (p *iscsiProvisioner) getAccessModes() []v1.PersistentVolumeAccessMode {
 	return []v1.PersistentVolumeAccessMode{
@@ -95,23 +86,80 @@ func (p *iscsiProvisioner) getAccessModes() []v1.PersistentVolumeAccessMode {
 }
 
 // Provision creates a storage asset and returns a PV object representing it.
-func (p *iscsiProvisioner) Provision(context context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
-	log := p.log.With(zap.String("name",options.PVName))
+func (p *iscsiProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	log := p.log.With(zap.String("name", options.PVName))
 	if !util.AccessModesContainedInAll(p.getAccessModes(), options.PVC.Spec.AccessModes) {
 		return nil, controller.ProvisioningNoChange, fmt.Errorf("invalid AccessModes %v: only AccessModes %v are supported", options.PVC.Spec.AccessModes, p.getAccessModes())
 	}
 	log.Debug("new provision request received for pvc")
-	vol, lun, pool, err := p.createVolume(options)
+	exportMode, err := getExportMode(options.StorageClass.Parameters)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	chapMode, err := getChapMode(options.StorageClass.Parameters)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	secretRef, err := getChapSecretRef(options.StorageClass.Parameters)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	var discovery map[string][]byte
+	if getBool(options.StorageClass.Parameters["chapAuthDiscovery"]) {
+		// without the credentials the volume would only fail when mounted
+		discovery, err = p.getDiscoveryCredentials(ctx, secretRef, options.PVC.Namespace)
+		if err != nil {
+			log.Warn("discovery chap is misconfigured", zap.Error(err))
+			p.recorder.Eventf(options.PVC, v1.EventTypeWarning, "DiscoveryCHAPMisconfigured", "chapAuthDiscovery is set but %v", err)
+			return nil, controller.ProvisioningNoChange, err
+		}
+	}
+	backend, client, err := p.backends.Get(options.StorageClass.Parameters["backend"])
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	source, err := p.getCloneSource(ctx, options)
+	if err != nil {
+		log.Warn("failed to get clone source", zap.Error(err))
+		return nil, controller.ProvisioningNoChange, err
+	}
+	if source != nil {
+		sourceBackend, _, err := p.backends.Get(source.backend)
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, err
+		}
+		if sourceBackend != backend {
+			return nil, controller.ProvisioningNoChange, fmt.Errorf("source volume %s is on backend %s, not on %s", source.vol, sourceBackend, backend)
+		}
+	}
+	initiators, static, affinity, err := p.getInitiators(options)
+	if err != nil {
+		log.Warn("failed to get initiators", zap.Error(err))
+		return nil, controller.ProvisioningNoChange, err
+	}
+	vol, lun, pool, err := p.createVolume(ctx, client, options, source, initiators, discovery)
 	if err != nil {
 		log.Warn("failed to create volume", zap.Error(err))
 		return nil, controller.ProvisioningNoChange, err
 	}
-	log.Debug("volume created", zap.String("vol",vol), zap.Int32("lun",lun))
+	log.Debug("volume created", zap.String("vol", vol), zap.Int32("lun", lun))
 
 	annotations := make(map[string]string)
+	annotations["backend"] = backend
 	annotations["volume_name"] = vol
 	annotations["pool"] = pool
-	annotations["initiators"] = options.StorageClass.Parameters["initiators"]
+	annotations["initiators"] = strings.Join(initiators, ",")
+	if selector := options.StorageClass.Parameters["initiatorNodeSelector"]; selector != "" {
+		annotations["initiator_selector"] = selector
+		annotations["static_initiators"] = strings.Join(static, ",")
+	}
+	if exportMode == exportModeAccessGroup {
+		annotations["access_group"] = getAccessGroup(options.StorageClass)
+	}
+	if chapMode == chapCredentialsGenerated {
+		annotations["chap_credentials"] = chapMode
+		secretRef = &v1.SecretReference{Name: chapSecretName(options.PVName), Namespace: chapSecretNamespace()}
+	}
 
 	var portals []string
 	if len(options.StorageClass.Parameters["portals"]) > 0 {
@@ -131,7 +179,8 @@ func (p *iscsiProvisioner) Provision(context context.Context, options controller
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
 			// set volumeMode from PVC Spec
-			VolumeMode: options.PVC.Spec.VolumeMode,
+			VolumeMode:   options.PVC.Spec.VolumeMode,
+			NodeAffinity: affinity,
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				ISCSI: &v1.ISCSIPersistentVolumeSource{
 					TargetPortal:      options.StorageClass.Parameters["targetPortal"],
@@ -143,7 +192,7 @@ func (p *iscsiProvisioner) Provision(context context.Context, options controller
 					FSType:            getFsType(options.StorageClass.Parameters["fsType"]),
 					DiscoveryCHAPAuth: getBool(options.StorageClass.Parameters["chapAuthDiscovery"]),
 					SessionCHAPAuth:   getBool(options.StorageClass.Parameters["chapAuthSession"]),
-					SecretRef:         getSecretRef(getBool(options.StorageClass.Parameters["chapAuthDiscovery"]), getBool(options.StorageClass.Parameters["chapAuthSession"]), &v1.SecretReference{Name: viper.GetString("provisioner-name") + "-chap-secret"}),
+					SecretRef:         getSecretRef(getBool(options.StorageClass.Parameters["chapAuthDiscovery"]), getBool(options.StorageClass.Parameters["chapAuthSession"]), secretRef),
 				},
 			},
 		},
@@ -184,100 +233,308 @@ func getBool(value string) bool {
 
 // Delete removes the storage asset that was created by Provision represented
 // by the given PV.
-func (p *iscsiProvisioner) Delete(context context.Context, volume *v1.PersistentVolume) error {
+func (p *iscsiProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	log := p.log.With(zap.String("name", volume.GetName()))
 	//vol from the annotation
 	log.Debug("volume deletion request received")
+	_, client, err := p.backends.Get(volume.Annotations["backend"])
+	if err != nil {
+		return err
+	}
 	{
 		log := log.With(zap.String("vol", volume.Annotations["volume_name"]), zap.String("pool", volume.Annotations["pool"]))
-		for _, initiator := range strings.Split(volume.Annotations["initiators"], ",") {
+		if group := volume.Annotations["access_group"]; group != "" {
+			log := log.With(zap.String("access_group", group))
+			log.Debug("removing access group mapping")
+			err := client.AccessGroupMapDestroy(ctx, targetd.AccessGroupMapDestroyArgs{
+				PoolName: volume.Annotations["pool"],
+				VolName:  volume.Annotations["volume_name"],
+				AgName:   group,
+			})
+			if err != nil {
+				if !targetd.IsNotFound(err) {
+					log.Warn("failed to remove access group mapping", zap.Error(err))
+					return err
+				}
+				log.Warn("access group mapping was already removed")
+			}
+			log.Debug("access group mapping removed")
+		}
+		for _, initiator := range p.getExportedInitiators(volume) {
 			log := log.With(zap.String("initiator", initiator))
 			log.Debug("removing iscsi export")
-			err := p.exportDestroy(volume.Annotations["volume_name"], volume.Annotations["pool"], initiator)
+			err := client.ExportDestroy(ctx, targetd.ExportDestroyArgs{
+				Pool:         volume.Annotations["pool"],
+				Vol:          volume.Annotations["volume_name"],
+				InitiatorWwn: initiator,
+			})
 			if err != nil {
-				log.Warn("failed to destroy iscsi export", zap.Error(err))
-				return err
+				if !targetd.IsNotFound(err) {
+					log.Warn("failed to destroy iscsi export", zap.Error(err))
+					return err
+				}
+				log.Warn("iscsi export was already removed")
 			}
 			log.Debug("iscsi export removed")
 		}
 		log.Debug("removing logical volume")
-		err := p.volDestroy(volume.Annotations["volume_name"], volume.Annotations["pool"])
+		err := client.VolDestroy(ctx, targetd.VolDestroyArgs{
+			Pool: volume.Annotations["pool"],
+			Name: volume.Annotations["volume_name"],
+		})
 		if err != nil {
-			log.Warn("failed to remove logical volume", zap.Error(err))
-			return err
+			if !errors.Is(err, targetd.NotFoundVolume) {
+				log.Warn("failed to remove logical volume", zap.Error(err))
+				return err
+			}
+			log.Warn("logical volume was already removed")
 		}
 		log.Debug("logical volume removed")
 	}
+	err = deleteChapSecret(ctx, p.kube, volume)
+	if err != nil {
+		log.Warn("failed to delete chap secret", zap.Error(err))
+		return err
+	}
 	log.Debug("volume deletion request completed")
 	return nil
 }
 
-func (p *iscsiProvisioner) createVolume(options controller.ProvisionOptions) (vol string, lun int32, pool string, err error) {
+func (p *iscsiProvisioner) createVolume(ctx context.Context, client *targetd.Client, options controller.ProvisionOptions, source *cloneSource, initiators []string, discovery map[string][]byte) (vol string, lun int32, pool string, err error) {
 	size := getSize(options)
 	vol = p.getVolumeName(options)
 	pool = p.getVolumeGroup(options)
-	initiators := p.getInitiators(options)
 	chapCredentials := &chapSessionCredentials{}
 	log := p.log
-	//read chap session authentication credentials
-	if getBool(options.StorageClass.Parameters["chapAuthSession"]) {
-		prop, err2 := properties.LoadFile(viper.GetString("session-chap-credential-file-path"), properties.UTF8)
-		if err2 != nil {
-			p.log.Warn("failed to load chap credentials", zap.Error(err2))
-			return "", 0, "", err2
-		}
-		err2 = prop.Decode(chapCredentials)
-		if err2 != nil {
-			p.log.Warn("failed to decode chap credentials", zap.Error(err2))
-			return "", 0, "", err2
-		}
-	}
-
-	p.log.Debug("calling export_list")
-	exportList1, err := p.exportList()
+	chapMode, err := getChapMode(options.StorageClass.Parameters)
 	if err != nil {
-		log.Warn("failed to get export_list", zap.Error(err))
 		return "", 0, "", err
 	}
-	log.Debug("export_list called")
-	lun, err = p.getFirstAvailableLun(exportList1)
-	if err != nil {
-		log.Warn("failed to get first available lun", zap.Error(err))
-		return "", 0, "", err
+	//read chap session authentication credentials
+	if getBool(options.StorageClass.Parameters["chapAuthSession"]) && chapMode == chapCredentialsFile {
+		chapCredentials, err = getChapCredentials()
+		if err != nil {
+			p.log.Warn("failed to load chap credentials", zap.Error(err))
+			return "", 0, "", err
+		}
 	}
+
+	// every step that completed is undone when a later one fails
+	tx := transaction.New(log.With(zap.String("vol", vol), zap.String("pool", pool)), p.recorder, options.PVC)
+	defer func() {
+		if err != nil {
+			tx.Rollback(err)
+		}
+	}()
+
 	{
 		log := log.With(zap.String("vol", vol), zap.Int64("size", size), zap.String("pool", pool))
-		log.Debug("creating volume")
-		err = p.volCreate(vol, size, pool)
+		var existing targetd.Volume
+		var found bool
+		existing, found, err = p.findVolume(ctx, client, pool, vol)
 		if err != nil {
-			log.Warn("failed to create volume", zap.Error(err))
+			log.Warn("failed to list volumes", zap.Error(err))
 			return "", 0, "", err
 		}
-		log.Debug("created volume name, size, pool")
-		for _, initiator := range initiators {
-			log := log.With(zap.String("initiator", initiator), zap.Int32("lun", lun))
-			log.Debug("exporting volume")
-			err = p.exportCreate(vol, lun, pool, initiator)
+		if found && source != nil {
+			// vol_copy of an earlier attempt may have been interrupted, a
+			// partial copy cannot be told apart from a complete one
+			log.Info("destroying volume of an earlier clone attempt to copy it again")
+			err = client.VolDestroy(ctx, targetd.VolDestroyArgs{Pool: pool, Name: vol})
+			if err != nil && !errors.Is(err, targetd.NotFoundVolume) {
+				log.Warn("failed to destroy volume of an earlier clone attempt", zap.Error(err))
+				return "", 0, "", err
+			}
+			found = false
+		}
+		if !found {
+			err = p.checkCapacity(ctx, client, options, pool, size)
+			if err != nil {
+				log.Warn("not enough capacity", zap.Error(err))
+				return "", 0, "", err
+			}
+		}
+		if found {
+			// an earlier attempt created the volume before failing
+			if existing.Size < size {
+				return "", 0, "", fmt.Errorf("volume %s already exists with %d bytes instead of %d", vol, existing.Size, size)
+			}
+			log.Debug("reusing existing volume")
+		} else if source != nil {
+			err = p.copyVolume(ctx, client, source, pool, vol, size)
+			if err != nil {
+				log.Warn("failed to copy volume", zap.Error(err))
+				return "", 0, "", err
+			}
+		} else {
+			log.Debug("creating volume")
+			err = client.VolCreate(ctx, targetd.VolCreateArgs{
+				Pool: pool,
+				Name: vol,
+				Size: size,
+			})
+			if err != nil {
+				log.Warn("failed to create volume", zap.Error(err))
+				return "", 0, "", err
+			}
+			log.Debug("created volume name, size, pool")
+		}
+		// the named results are cleared when returning an error, the
+		// compensations keep their own copy
+		vol, pool := vol, pool
+		// a volume left by an earlier attempt is not removed when this one
+		// fails
+		if !found {
+			tx.Completed("destroy volume "+vol, func(ctx context.Context) error {
+				err := client.VolDestroy(ctx, targetd.VolDestroyArgs{Pool: pool, Name: vol})
+				if errors.Is(err, targetd.NotFoundVolume) {
+					return nil
+				}
+				return err
+			})
+		}
+		var exportMode string
+		exportMode, err = getExportMode(options.StorageClass.Parameters)
+		if err != nil {
+			return "", 0, "", err
+		}
+		if exportMode == exportModeAccessGroup {
+			group := getAccessGroup(options.StorageClass)
+			// the access group controller removes the initiators no storage
+			// class sharing the group wants anymore
+			err = addAccessGroupMembers(ctx, client, log, group, initiators)
+			if err != nil {
+				log.Warn("failed to add initiators to access group", zap.String("access_group", group), zap.Error(err))
+				return "", 0, "", err
+			}
+			lun, err = p.mapVolume(ctx, client, pool, vol, group)
+			if err == nil {
+				tx.Completed("unmap volume "+vol+" from access group "+group, func(ctx context.Context) error {
+					err := client.AccessGroupMapDestroy(ctx, targetd.AccessGroupMapDestroyArgs{PoolName: pool, VolName: vol, AgName: group})
+					if targetd.IsNotFound(err) {
+						return nil
+					}
+					return err
+				})
+			}
+		} else {
+			lun, err = p.exportVolume(ctx, client, pool, vol, initiators)
+			if err == nil {
+				for _, initiator := range initiators {
+					initiator := initiator
+					tx.Completed("remove export of volume "+vol+" to "+initiator, func(ctx context.Context) error {
+						err := client.ExportDestroy(ctx, targetd.ExportDestroyArgs{Pool: pool, Vol: vol, InitiatorWwn: initiator})
+						if targetd.IsNotFound(err) {
+							return nil
+						}
+						return err
+					})
+				}
+			}
+		}
+		if err != nil {
+			log.Warn("failed to export volume", zap.Error(err))
+			return "", 0, "", err
+		}
+		if chapMode == chapCredentialsGenerated {
+			chapCredentials, err = p.ensureChapSecret(ctx, tx, options.PVName, initiators, getBool(options.StorageClass.Parameters["chapMutual"]), discovery)
 			if err != nil {
-				log.Warn("failed to create export", zap.Error(err))
+				log.Warn("failed to generate chap credentials", zap.Error(err))
 				return "", 0, "", err
 			}
-			log.Debug("exported volume")
+		}
+		var previous map[string]chapSessionCredentials
+		if getBool(options.StorageClass.Parameters["chapAuthSession"]) {
+			var backend string
+			backend, _, err = p.backends.Get(options.StorageClass.Parameters["backend"])
+			if err != nil {
+				return "", 0, "", err
+			}
+			// targetd cannot report the credentials of an initiator
+			previous, err = p.getInitiatorAuth(ctx, backend, initiators)
+			if err != nil {
+				log.Warn("failed to get the chap credentials of the initiators", zap.Error(err))
+				return "", 0, "", err
+			}
+		}
+		for _, initiator := range initiators {
+			log := log.With(zap.String("initiator", initiator), zap.Int32("lun", lun))
 			if getBool(options.StorageClass.Parameters["chapAuthSession"]) {
 				log := log.With(zap.String("in_user", chapCredentials.InUser), zap.String("out_user", chapCredentials.OutUser))
 				log.Debug("setting up chap session auth")
-				err = p.setInitiatorAuth(initiator, chapCredentials.InUser, chapCredentials.InPassword, chapCredentials.OutUser, chapCredentials.OutPassword)
+				err = client.InitiatorSetAuth(ctx, targetd.InitiatorSetAuthArgs{
+					InitiatorWwn: initiator,
+					InUser:       chapCredentials.InUser,
+					InPassword:   chapCredentials.InPassword,
+					OutUser:      chapCredentials.OutUser,
+					OutPassword:  chapCredentials.OutPassword,
+				})
 				if err != nil {
 					log.Warn("failed to set up chap session auth", zap.Error(err))
 					return "", 0, "", err
 				}
 				log.Debug("set up chap session auth")
+				// an initiator without earlier volumes gets no credentials
+				initiator, credentials := initiator, previous[initiator]
+				tx.Completed("restore chap session auth of "+initiator, func(ctx context.Context) error {
+					return setInitiatorAuth(ctx, client, initiator, &credentials)
+				})
 			}
 		}
 	}
 	return vol, lun, pool, nil
 }
 
+// checkCapacity refuses to allocate size bytes in pool when it does not
+// have them left, targetd would only fail vol_create with an unexpected
+// exit code.
+func (p *iscsiProvisioner) checkCapacity(ctx context.Context, client *targetd.Client, options controller.ProvisionOptions, pool string, size int64) error {
+	ratio, err := capacity.GetOvercommitRatio(options.StorageClass.Parameters)
+	if err != nil {
+		return err
+	}
+	err = capacity.Check(ctx, client, pool, size, ratio)
+	if errors.Is(err, capacity.ErrInsufficient) {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "InsufficientCapacity", err.Error())
+	}
+	return err
+}
+
+// findVolume returns the volume vol in pool, if it exists.
+func (p *iscsiProvisioner) findVolume(ctx context.Context, client *targetd.Client, pool, vol string) (targetd.Volume, bool, error) {
+	vols, err := client.VolList(ctx, targetd.VolListArgs{Pool: pool})
+	if err != nil {
+		return targetd.Volume{}, false, err
+	}
+	for _, v := range vols {
+		if v.Name == vol {
+			return v, true, nil
+		}
+	}
+	return targetd.Volume{}, false, nil
+}
+
+// getChapCredentials reads the session chap credentials from the
+// session-chap-credential-file-path.
+func getChapCredentials() (*chapSessionCredentials, error) {
+	return loadChapCredentials(viper.GetString("session-chap-credential-file-path"))
+}
+
+// loadChapCredentials reads session chap credentials from the properties
+// file path.
+func loadChapCredentials(path string) (*chapSessionCredentials, error) {
+	prop, err := properties.LoadFile(path, properties.UTF8)
+	if err != nil {
+		return nil, err
+	}
+	chapCredentials := &chapSessionCredentials{}
+	err = prop.Decode(chapCredentials)
+	if err != nil {
+		return nil, err
+	}
+	return chapCredentials, nil
+}
+
 func getSize(options controller.ProvisionOptions) int64 {
 	q := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	return q.Value()
@@ -294,183 +551,74 @@ func (p *iscsiProvisioner) getVolumeGroup(options controller.ProvisionOptions) s
 	return options.StorageClass.Parameters["volumeGroup"]
 }
 
-func (p *iscsiProvisioner) getInitiators(options controller.ProvisionOptions) []string {
-	return strings.Split(options.StorageClass.Parameters["initiators"], ",")
-}
-
-// getFirstAvailableLun gets first available Lun.
-func (p *iscsiProvisioner) getFirstAvailableLun(exportList exportList) (int32, error) {
-	log := p.log
-	sort.Sort(exportList)
-	log.Debug("sorted export List: ", zap.Any("exportList", exportList))
-	//this is sloppy way to remove duplicates
-	uniqueExport := make(map[int32]export)
-	for _, export := range exportList {
-		uniqueExport[export.Lun] = export
-	}
-	log.Debug("unique luns sorted export List: ", zap.Any("exportList", uniqueExport))
-
-	//this is a sloppy way to get the list of luns
-	luns := make([]int, len(uniqueExport), len(uniqueExport))
-	i := 0
-	for _, export := range uniqueExport {
-		luns[i] = int(export.Lun)
-		i++
-	}
-	log.Debug("lun list", zap.Ints("luns",luns))
-
-	if len(luns) >= 255 {
-		return -1, errors.New("255 luns allocated no more luns available")
-	}
-
-	var sluns sort.IntSlice
-	sluns = luns[0:]
-	sort.Sort(sluns)
-	log.Debug("sorted lun list", zap.Ints("luns",sluns))
-
-	lun := int32(len(sluns))
-	for i, clun := range sluns {
-		if i < int(clun) {
-			lun = int32(i)
-			break
-		}
+// getInitiators returns the initiators parameter together with the
+// initiators of the nodes matching the initiatorNodeSelector parameter, both
+// limited to the allowed topologies of the storage class. The static
+// initiators chosen from the initiators parameter and the node affinity
+// matching the nodes of all initiators are returned as well.
+func (p *iscsiProvisioner) getInitiators(options controller.ProvisionOptions) ([]string, []string, *v1.VolumeNodeAffinity, error) {
+	selector := options.StorageClass.Parameters["initiatorNodeSelector"]
+	allowed := topologySelector(options.StorageClass.AllowedTopologies)
+	// the initiators of the nodes would be missing from an empty cache
+	if !p.hasSynced() {
+		return nil, nil, nil, errors.New("nodes and volumes are not synced yet")
 	}
-	return lun, nil
-}
-
-// volDestroy removes calls vol_destroy targetd API to remove volume.
-func (p *iscsiProvisioner) volDestroy(vol string, pool string) error {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
+	nodes, err := p.nodes.List(labels.Everything())
 	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return err
-	}
-	args := volDestroyArgs{
-		Pool: pool,
-		Name: vol,
+		return nil, nil, nil, err
 	}
-	err = client.Call("vol_destroy", args, nil)
-	return err
-}
-
-// exportDestroy calls export_destroy targetd API to remove export of volume.
-func (p *iscsiProvisioner) exportDestroy(vol string, pool string, initiator string) error {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
+	initiators, static, owners, err := chooseInitiators(splitInitiators(options.StorageClass.Parameters["initiators"]), selector, nodes, allowed)
 	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return err
+		return nil, nil, nil, err
 	}
-	args := exportDestroyArgs{
-		Pool:         pool,
-		Vol:          vol,
-		InitiatorWwn: initiator,
+	if len(initiators) == 0 {
+		return nil, nil, nil, errors.New("no initiators configured and no node with an initiator name matches the initiatorNodeSelector and allowed topologies")
 	}
-	err = client.Call("export_destroy", args, nil)
-	return err
-}
-
-// volCreate calls vol_create targetd API to create a volume.
-func (p *iscsiProvisioner) volCreate(name string, size int64, pool string) error {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
+	// every chosen static initiator with an owner node is in owners
+	affinity, err := getNodeAffinity(selector, owners, len(owners) < len(static), allowed)
 	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return err
+		return nil, nil, nil, err
 	}
-	args := volCreateArgs{
-		Pool: pool,
-		Name: name,
-		Size: size,
-	}
-	err = client.Call("vol_create", args, nil)
-	return err
+	return initiators, static, affinity, nil
 }
 
-// exportCreate calls export_create targetd API to create an export of volume.
-func (p *iscsiProvisioner) exportCreate(vol string, lun int32, pool string, initiator string) error {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return err
-	}
-	args := exportCreateArgs{
-		Pool:         pool,
-		Vol:          vol,
-		InitiatorWwn: initiator,
-		Lun:          lun,
+// getExportedInitiators returns the initiators a volume was exported to one
+// by one, which are none for volumes mapped to an access group.
+func (p *iscsiProvisioner) getExportedInitiators(volume *v1.PersistentVolume) []string {
+	if volume.Annotations["access_group"] != "" {
+		return nil
 	}
-	err = client.Call("export_create", args, nil)
-	return err
+	return splitInitiators(volume.Annotations["initiators"])
 }
 
-// exportList lists calls export_list targetd API to get export objects.
-func (p *iscsiProvisioner) exportList() (exportList, error) {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return nil, err
+// getFirstAvailableLun gets the first lun in the range from min to max that is
+// not used by any of the initiators.
+func (p *iscsiProvisioner) getFirstAvailableLun(exportList exportList, initiators []string, min, max int32) (int32, error) {
+	used := make(map[int32]bool)
+	for _, export := range exportList {
+		for _, initiator := range initiators {
+			if export.InitiatorWwn == initiator {
+				used[export.Lun] = true
+			}
+		}
 	}
-	var result1 exportList
-	err = client.Call("export_list", nil, &result1)
-	return result1, err
-}
-
-//initiator_set_auth(initiator_wwn, in_user, in_pass, out_user, out_pass)
-
-func (p *iscsiProvisioner) setInitiatorAuth(initiator string, inUser string, inPassword string, outUser string, outPassword string) error {
-	log := p.log
-	client, err := p.getConnection()
-	defer client.Close()
+	p.log.Debug("luns in use", zap.Int("count", len(used)), zap.Strings("initiators", initiators))
+	lun, err := firstFreeLun(used, min, max)
 	if err != nil {
-		log.Warn("failed to get connection", zap.Error(err))
-		return err
+		return -1, fmt.Errorf("%w for %s", err, strings.Join(initiators, ","))
 	}
-
-	//make arguments object
-	args := initiatorSetAuthArgs{
-		InitiatorWwn: initiator,
-		InUser:       inUser,
-		InPassword:   inPassword,
-		OutUser:      outUser,
-		OutPassword:  outPassword,
-	}
-	//call remote procedure with args
-	err = client.Call("initiator_set_auth", args, nil)
-	return err
-}
-
-func (slice exportList) Len() int {
-	return len(slice)
-}
-
-func (slice exportList) Less(i, j int) bool {
-	return slice[i].Lun < slice[j].Lun
-}
-
-func (slice exportList) Swap(i, j int) {
-	slice[i], slice[j] = slice[j], slice[i]
+	return lun, nil
 }
 
-func (p *iscsiProvisioner) getConnection() (*jsonrpc2.Client, error) {
-	log := p.log.With(zap.String("url",p.targetdURL))
-	log.Debug("opening connection to targetd")
-
-	client := jsonrpc2.NewHTTPClient(p.targetdURL)
-	if client == nil {
-		log.Warn("error creating the connection to targetd")
-		return nil, errors.New("error creating the connection to targetd")
+// firstFreeLun gets the first lun in the range from min to max that is not
+// used.
+func firstFreeLun(used map[int32]bool, min, max int32) (int32, error) {
+	for lun := min; lun <= max; lun++ {
+		if !used[lun] {
+			return lun, nil
+		}
 	}
-	log.Debug("targetd client created")
-	return client, nil
+	return -1, fmt.Errorf("all luns from %d to %d are allocated", min, max)
 }
 
 func (p *iscsiProvisioner) SupportsBlock() bool {
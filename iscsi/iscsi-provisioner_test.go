@@ -0,0 +1,420 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+const gib = 1 << 30
+
+// newTestProvisioner returns a provisioner talking to a fake targetd with a
+// 10 GiB volume group vg-targetd.
+func newTestProvisioner(t *testing.T) (*iscsiProvisioner, *fake.Server) {
+	viper.Set("iscsi-lun-min", 0)
+	viper.Set("iscsi-lun-max", 255)
+	t.Cleanup(viper.Reset)
+
+	s := fake.NewServer()
+	t.Cleanup(s.Close)
+	s.AddBlockPool("vg-targetd", 10*gib)
+	client, err := targetd.NewClient(s.URL, zap.NewNop(), targetd.Retry(targetd.RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	backends, err := targetd.NewBackends("default", map[string]*targetd.Client{"default": client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &iscsiProvisioner{
+		kube:     kubefake.NewSimpleClientset(),
+		backends: backends,
+		log:      zap.NewNop(),
+		recorder: record.NewFakeRecorder(100),
+	}
+	setNodes(t, p)
+	setVolumes(t, p)
+	return p, s
+}
+
+// setNodes replaces the cached nodes of p with nodes.
+func setNodes(t *testing.T, p *iscsiProvisioner, nodes ...*v1.Node) {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		if err := indexer.Add(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.nodes = corelisters.NewNodeLister(indexer)
+}
+
+// setVolumes replaces the cached persistent volumes of p with volumes.
+func setVolumes(t *testing.T, p *iscsiProvisioner, volumes ...*v1.PersistentVolume) {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, volume := range volumes {
+		if err := indexer.Add(volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.volumes = corelisters.NewPersistentVolumeLister(indexer)
+}
+
+// provisionOptions requests a volume of size bytes with the storage class
+// parameters.
+func provisionOptions(name string, size int64, parameters map[string]string) controller.ProvisionOptions {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	return controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "iscsi"},
+			Provisioner:   "iscsi-targetd",
+			ReclaimPolicy: &reclaimPolicy,
+			Parameters:    parameters,
+		},
+		PVName: name,
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "claim-" + name, Namespace: "default"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI)},
+				},
+			},
+		},
+	}
+}
+
+func TestProvisionAndDelete(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"targetPortal": "192.168.1.1:3260",
+		"iqn":          "iqn.2003-01.org.linux-iscsi.targetd:target",
+		"initiators":   "iqn.a,iqn.b",
+	})
+
+	pv, state, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected state %v, got %v", controller.ProvisioningFinished, state)
+	}
+	volume, ok := s.Volume("vg-targetd", "pvc-1")
+	if !ok {
+		t.Fatal("expected volume pvc-1 to be created")
+	}
+	if volume.Size != gib {
+		t.Errorf("expected volume of %d bytes, got %d", int64(gib), volume.Size)
+	}
+	exports := s.Exports()
+	if len(exports) != 2 {
+		t.Fatalf("expected 2 exports, got %v", exports)
+	}
+	for _, export := range exports {
+		if export.VolName != "pvc-1" || export.Lun != pv.Spec.ISCSI.Lun {
+			t.Errorf("expected export of pvc-1 with lun %d, got %+v", pv.Spec.ISCSI.Lun, export)
+		}
+	}
+	if pv.Spec.ISCSI.TargetPortal != "192.168.1.1:3260" || pv.Spec.ISCSI.IQN != "iqn.2003-01.org.linux-iscsi.targetd:target" {
+		t.Errorf("unexpected iscsi source %+v", pv.Spec.ISCSI)
+	}
+	for key, expected := range map[string]string{
+		"backend":     "default",
+		"volume_name": "pvc-1",
+		"pool":        "vg-targetd",
+		"initiators":  "iqn.a,iqn.b",
+	} {
+		if pv.Annotations[key] != expected {
+			t.Errorf("expected annotation %s=%s, got %q", key, expected, pv.Annotations[key])
+		}
+	}
+
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); ok {
+		t.Error("expected volume pvc-1 to be removed")
+	}
+	if exports := s.Exports(); len(exports) != 0 {
+		t.Errorf("expected exports to be removed, got %v", exports)
+	}
+	// a second delete finds everything already removed
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Errorf("expected deleting twice to succeed, got %v", err)
+	}
+}
+
+func TestProvisionAllocatesFreeLuns(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	ctx := context.Background()
+	parameters := map[string]string{"initiators": "iqn.a"}
+
+	first, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, parameters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := p.Provision(ctx, provisionOptions("pvc-2", gib, parameters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Spec.ISCSI.Lun != 0 || second.Spec.ISCSI.Lun != 1 {
+		t.Errorf("expected luns 0 and 1, got %d and %d", first.Spec.ISCSI.Lun, second.Spec.ISCSI.Lun)
+	}
+}
+
+func TestProvisionReturnsTargetdErrors(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	s.Inject("vol_create", fake.Fault{Code: targetd.InvalidPool, Message: "Invalid pool", Times: 1})
+
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"}))
+	if !errors.Is(err, targetd.InvalidPool) {
+		t.Errorf("expected %v, got %v", targetd.InvalidPool, err)
+	}
+	if calls := s.Calls("export_create"); calls != 0 {
+		t.Errorf("expected no export_create calls, got %d", calls)
+	}
+}
+
+func TestProvisionUnknownBackend(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{
+		"backend":    "other",
+		"initiators": "iqn.a",
+	}))
+	if err == nil {
+		t.Fatal("expected provisioning on an unknown backend to fail")
+	}
+	if calls := s.Calls("vol_create"); calls != 0 {
+		t.Errorf("expected no vol_create calls, got %d", calls)
+	}
+}
+
+// createVolume creates vol of size bytes in vg-targetd exported to
+// initiators with lun, like an interrupted attempt to provision it would.
+func createVolume(t *testing.T, p *iscsiProvisioner, vol string, size int64, lun int32, initiators ...string) {
+	t.Helper()
+	ctx := context.Background()
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg-targetd", Name: vol, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	for _, initiator := range initiators {
+		err := client.ExportCreate(ctx, targetd.ExportCreateArgs{Pool: "vg-targetd", Vol: vol, InitiatorWwn: initiator, Lun: lun})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestProvisionResumesExistingVolume(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	createVolume(t, p, "pvc-1", gib, 5, "iqn.a")
+
+	pv, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a,iqn.b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("vol_create"); calls != 1 {
+		t.Errorf("expected the existing volume to be reused, got %d vol_create calls", calls)
+	}
+	if pv.Spec.ISCSI.Lun != 5 {
+		t.Errorf("expected the lun of the earlier export, got %d", pv.Spec.ISCSI.Lun)
+	}
+	exports := s.Exports()
+	if len(exports) != 2 {
+		t.Fatalf("expected 2 exports, got %+v", exports)
+	}
+	for _, export := range exports {
+		if export.Lun != 5 {
+			t.Errorf("expected export with lun 5, got %+v", export)
+		}
+	}
+}
+
+func TestProvisionRefusesSmallerExistingVolume(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	createVolume(t, p, "pvc-1", gib/2, 0)
+
+	if _, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"})); err == nil {
+		t.Fatal("expected an existing volume smaller than requested to be refused")
+	}
+	if exports := s.Exports(); len(exports) != 0 {
+		t.Errorf("expected the volume not to be exported, got %+v", exports)
+	}
+}
+
+func TestProvisionResumeReallocatesTakenLun(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	// the earlier export of pvc-1 has lun 0, which iqn.b uses for pvc-0
+	createVolume(t, p, "pvc-0", gib, 0, "iqn.b")
+	createVolume(t, p, "pvc-1", gib, 0, "iqn.a")
+
+	pv, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a,iqn.b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Spec.ISCSI.Lun != 1 {
+		t.Errorf("expected lun 1 free for both initiators, got %d", pv.Spec.ISCSI.Lun)
+	}
+	for _, export := range s.Exports() {
+		if export.VolName == "pvc-1" && export.Lun != 1 {
+			t.Errorf("expected the exports of pvc-1 to move to lun 1, got %+v", export)
+		}
+	}
+}
+
+func TestProvisionRollsBackFailedExport(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	// the second export fails after the first one was created
+	s.Inject("export_create", fake.Fault{Times: 1})
+	s.Inject("export_create", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	_, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a,iqn.b"}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("export_create"); calls != 2 {
+		t.Errorf("expected 2 export_create calls, got %d", calls)
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); ok {
+		t.Error("expected volume pvc-1 to be removed")
+	}
+	if exports := s.Exports(); len(exports) != 0 {
+		t.Errorf("expected exports to be removed, got %v", exports)
+	}
+	recorder := p.recorder.(*record.FakeRecorder)
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "RolledBack") {
+			t.Errorf("expected a RolledBack event, got %q", event)
+		}
+	default:
+		t.Error("expected a RolledBack event")
+	}
+}
+
+// writeChapCredentials writes a chap credential file without mutual
+// credentials and configures it as session-chap-credential-file-path.
+func writeChapCredentials(t *testing.T, user, password string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chap.properties")
+	data := "node.session.auth.username = " + user + "\nnode.session.auth.password = " + password + "\n" +
+		"node.session.auth.username_in =\nnode.session.auth.password_in =\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("session-chap-credential-file-path", path)
+}
+
+func TestProvisionRollsBackFailedChap(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	writeChapCredentials(t, "user", "password")
+	s.Inject("initiator_set_auth", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"initiators":      "iqn.a",
+		"chapAuthSession": "true",
+	})
+
+	if _, _, err := p.Provision(context.Background(), options); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if s.Calls("initiator_set_auth") != 1 {
+		t.Errorf("expected the credentials to be set once, got %d calls", s.Calls("initiator_set_auth"))
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); ok {
+		t.Error("expected volume pvc-1 to be removed")
+	}
+	if exports := s.Exports(); len(exports) != 0 {
+		t.Errorf("expected exports to be removed, got %v", exports)
+	}
+}
+
+func TestProvisionInsufficientCapacity(t *testing.T) {
+	p, s := newTestProvisioner(t)
+
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", 20*gib, map[string]string{"initiators": "iqn.a"}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("vol_create"); calls != 0 {
+		t.Errorf("expected no vol_create calls, got %d", calls)
+	}
+	select {
+	case event := <-p.recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, "InsufficientCapacity") {
+			t.Errorf("expected an InsufficientCapacity event, got %q", event)
+		}
+	default:
+		t.Error("expected an InsufficientCapacity event")
+	}
+}
+
+func TestProvisionOvercommitsPool(t *testing.T) {
+	p, s := newTestProvisioner(t)
+
+	// the fake pool is thick, so vol_create still fails
+	options := provisionOptions("pvc-1", 20*gib, map[string]string{"initiators": "iqn.a", "overcommitRatio": "2"})
+	if _, _, err := p.Provision(context.Background(), options); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("vol_create"); calls != 1 {
+		t.Errorf("expected the overcommitted volume to be created, got %d vol_create calls", calls)
+	}
+}
+
+func TestProvisionKeepsResumedVolume(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an earlier attempt created the volume before failing
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg-targetd", Name: "pvc-1", Size: gib}); err != nil {
+		t.Fatal(err)
+	}
+	s.Inject("export_create", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	_, _, err = p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if _, ok := s.Volume("vg-targetd", "pvc-1"); !ok {
+		t.Error("expected the volume of the earlier attempt to be kept")
+	}
+	if calls := s.Calls("vol_destroy"); calls != 0 {
+		t.Errorf("expected no vol_destroy calls, got %d", calls)
+	}
+
+	// the next attempt resumes with the same volume
+	if _, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"})); err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("vol_create"); calls != 1 {
+		t.Errorf("expected the volume to be created once, got %d vol_create calls", calls)
+	}
+}
@@ -0,0 +1,136 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+)
+
+// lunAttempts is how often a lun is allocated again when another provisioner
+// took it between listing the exports and creating them.
+const lunAttempts = 5
+
+// getLunRange returns the configured range of luns handed out to volumes.
+func getLunRange() (min, max int32, err error) {
+	min = viper.GetInt32("iscsi-lun-min")
+	max = viper.GetInt32("iscsi-lun-max")
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid lun range %d-%d", min, max)
+	}
+	return min, max, nil
+}
+
+// exportVolume exports a volume to all initiators with the first lun that
+// is free for each of them. The allocation is retried when targetd reports
+// that the lun was taken in the meantime, by another replica or by hand.
+//
+// Exports left behind by an earlier attempt to provision the volume are
+// reused, so the volume keeps the lun it was first exported with.
+func (p *iscsiProvisioner) exportVolume(ctx context.Context, client *targetd.Client, pool, vol string, initiators []string) (int32, error) {
+	min, max, err := getLunRange()
+	if err != nil {
+		return -1, err
+	}
+	p.lunLock.Lock()
+	defer p.lunLock.Unlock()
+
+	log := p.log.With(zap.String("vol", vol), zap.String("pool", pool))
+	for attempt := 1; ; attempt++ {
+		log.Debug("calling export_list")
+		exports, err := client.ExportList(ctx)
+		if err != nil {
+			log.Warn("failed to get export_list", zap.Error(err))
+			return -1, err
+		}
+		lun, exported := getExportedLun(exportList(exports), pool, vol)
+		if len(exported) > 0 {
+			log.Debug("reusing exports", zap.Int32("lun", lun), zap.Int("count", len(exported)))
+		} else {
+			lun, err = p.getFirstAvailableLun(exportList(exports), initiators, min, max)
+			if err != nil {
+				log.Warn("failed to get first available lun", zap.Error(err))
+				return -1, err
+			}
+		}
+		err = p.exportLun(ctx, client, pool, vol, initiators, lun, exported)
+		if err == nil {
+			return lun, nil
+		}
+		if !errors.Is(err, targetd.NoFreeHostLunId) && !targetd.IsConflict(err) {
+			return -1, err
+		}
+		if attempt == lunAttempts {
+			return -1, fmt.Errorf("failed to allocate a lun after %d attempts: %w", lunAttempts, err)
+		}
+		log.Warn("lun was taken, allocating another", zap.Int32("lun", lun), zap.Int("attempt", attempt), zap.Error(err))
+		// the lun of the earlier exports is not free for all initiators,
+		// start over with a lun that is
+		for initiator := range exported {
+			p.unexport(ctx, client, pool, vol, initiator)
+		}
+	}
+}
+
+// getExportedLun returns the lun a volume is exported with and the
+// initiators it is exported to.
+func getExportedLun(exports exportList, pool, vol string) (int32, map[string]bool) {
+	var lun int32 = -1
+	exported := make(map[string]bool)
+	for _, export := range exports {
+		if export.Pool != pool || export.VolName != vol {
+			continue
+		}
+		if lun == -1 {
+			lun = export.Lun
+		}
+		exported[export.InitiatorWwn] = true
+	}
+	return lun, exported
+}
+
+// exportLun exports a volume with lun to all initiators it is not exported
+// to yet, when an export fails the exports created by this call are removed
+// again.
+func (p *iscsiProvisioner) exportLun(ctx context.Context, client *targetd.Client, pool, vol string, initiators []string, lun int32, exported map[string]bool) error {
+	var created []string
+	for _, initiator := range initiators {
+		if exported[initiator] {
+			continue
+		}
+		log := p.log.With(zap.String("vol", vol), zap.String("initiator", initiator), zap.Int32("lun", lun))
+		log.Debug("exporting volume")
+		err := client.ExportCreate(ctx, targetd.ExportCreateArgs{
+			Pool:         pool,
+			Vol:          vol,
+			InitiatorWwn: initiator,
+			Lun:          lun,
+		})
+		if err != nil {
+			log.Warn("failed to create export", zap.Error(err))
+			for _, initiator := range created {
+				p.unexport(ctx, client, pool, vol, initiator)
+			}
+			return err
+		}
+		created = append(created, initiator)
+		log.Debug("exported volume")
+	}
+	return nil
+}
+
+// unexport removes the export of a volume to an initiator, failures are only
+// logged as the export is retried or removed again later.
+func (p *iscsiProvisioner) unexport(ctx context.Context, client *targetd.Client, pool, vol, initiator string) {
+	err := client.ExportDestroy(ctx, targetd.ExportDestroyArgs{
+		Pool:         pool,
+		Vol:          vol,
+		InitiatorWwn: initiator,
+	})
+	if err != nil && !targetd.IsNotFound(err) {
+		p.log.Warn("failed to remove export", zap.String("vol", vol), zap.String("initiator", initiator), zap.Error(err))
+	}
+}
@@ -0,0 +1,124 @@
+package iscsi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+)
+
+func TestGetFirstAvailableLun(t *testing.T) {
+	p := &iscsiProvisioner{log: zap.NewNop()}
+	exports := exportList{
+		{InitiatorWwn: "iqn.a", Lun: 0},
+		{InitiatorWwn: "iqn.a", Lun: 1},
+		{InitiatorWwn: "iqn.b", Lun: 0},
+		{InitiatorWwn: "iqn.b", Lun: 2},
+		{InitiatorWwn: "iqn.c", Lun: 3},
+	}
+	tests := []struct {
+		name       string
+		initiators []string
+		min, max   int32
+		expected   int32
+		err        bool
+	}{
+		{name: "first free", initiators: []string{"iqn.a"}, max: 255, expected: 2},
+		{name: "free for all initiators", initiators: []string{"iqn.a", "iqn.b"}, max: 255, expected: 3},
+		{name: "other initiators ignored", initiators: []string{"iqn.d"}, max: 255, expected: 0},
+		{name: "minimum", initiators: []string{"iqn.c"}, min: 3, max: 255, expected: 4},
+		{name: "exhausted", initiators: []string{"iqn.a"}, max: 1, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lun, err := p.getFirstAvailableLun(exports, test.initiators, test.min, test.max)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got lun %d", lun)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lun != test.expected {
+				t.Errorf("expected lun %d, got %d", test.expected, lun)
+			}
+		})
+	}
+}
+
+func TestProvisionAllocatesLunsPerInitiator(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	ctx := context.Background()
+
+	first, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := p.Provision(ctx, provisionOptions("pvc-2", gib, map[string]string{"initiators": "iqn.b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Spec.ISCSI.Lun != 0 || second.Spec.ISCSI.Lun != 0 {
+		t.Errorf("expected lun 0 for both initiators, got %d and %d", first.Spec.ISCSI.Lun, second.Spec.ISCSI.Lun)
+	}
+}
+
+func TestProvisionUsesLunRange(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	viper.Set("iscsi-lun-min", 10)
+	viper.Set("iscsi-lun-max", 10)
+	ctx := context.Background()
+	parameters := map[string]string{"initiators": "iqn.a"}
+
+	pv, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, parameters))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Spec.ISCSI.Lun != 10 {
+		t.Errorf("expected lun 10, got %d", pv.Spec.ISCSI.Lun)
+	}
+	if _, _, err := p.Provision(ctx, provisionOptions("pvc-2", gib, parameters)); err == nil {
+		t.Error("expected provisioning to fail when the lun range is exhausted")
+	}
+}
+
+func TestProvisionRetriesTakenLun(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	// the lun is taken for the second initiator after the exports were listed
+	s.Inject("export_create", fake.Fault{Times: 1})
+	s.Inject("export_create", fake.Fault{Code: targetd.NoFreeHostLunId, Message: "No free host lun id", Times: 1})
+
+	pv, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a,iqn.b"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("export_list"); calls != 2 {
+		t.Errorf("expected the exports to be listed again, got %d export_list calls", calls)
+	}
+	exports := s.Exports()
+	if len(exports) != 2 {
+		t.Fatalf("expected 2 exports, got %+v", exports)
+	}
+	for _, export := range exports {
+		if export.Lun != pv.Spec.ISCSI.Lun {
+			t.Errorf("expected export with lun %d, got %+v", pv.Spec.ISCSI.Lun, export)
+		}
+	}
+}
+
+func TestProvisionGivesUpTakenLun(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	s.Inject("export_create", fake.Fault{Code: targetd.NoFreeHostLunId, Message: "No free host lun id"})
+
+	if _, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"})); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("export_create"); calls != lunAttempts {
+		t.Errorf("expected %d export_create calls, got %d", lunAttempts, calls)
+	}
+}
@@ -0,0 +1,387 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DefaultInitiatorKey is the Node annotation or label holding the initiator
+// name of the node.
+const DefaultInitiatorKey = "targetd.sonck.nl/initiator-name"
+
+// annProvisionedBy is set on every PersistentVolume by the provision controller
+const annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
+// splitInitiators splits a comma separated list of initiators.
+func splitInitiators(list string) []string {
+	var initiators []string
+	for _, initiator := range strings.Split(list, ",") {
+		if initiator = strings.TrimSpace(initiator); initiator != "" {
+			initiators = append(initiators, initiator)
+		}
+	}
+	return initiators
+}
+
+// nodeInitiator returns the initiator name of a node from the configured
+// annotation, or label when there is no such annotation.
+func nodeInitiator(node *v1.Node) string {
+	key := viper.GetString("iscsi-initiator-key")
+	if key == "" {
+		key = DefaultInitiatorKey
+	}
+	if initiator, ok := node.Annotations[key]; ok {
+		return strings.TrimSpace(initiator)
+	}
+	return strings.TrimSpace(node.Labels[key])
+}
+
+// resolveInitiators returns the static initiators together with those of the
+// nodes matching selector, sorted and without duplicates. Without selector
+// only the static initiators are returned.
+func resolveInitiators(static []string, selector string, nodes []*v1.Node) ([]string, error) {
+	set := make(map[string]bool)
+	for _, initiator := range static {
+		set[initiator] = true
+	}
+	if selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid initiatorNodeSelector %q: %w", selector, err)
+		}
+		for _, node := range nodes {
+			if node.DeletionTimestamp != nil || !s.Matches(labels.Set(node.Labels)) {
+				continue
+			}
+			if initiator := nodeInitiator(node); initiator != "" {
+				set[initiator] = true
+			}
+		}
+	}
+	initiators := make([]string, 0, len(set))
+	for initiator := range set {
+		initiators = append(initiators, initiator)
+	}
+	sort.Strings(initiators)
+	return initiators, nil
+}
+
+// InitiatorController exports the volumes of storage classes with an
+// initiatorNodeSelector to the initiators of nodes joining the cluster, and
+// removes the exports to nodes that left. Volumes in access group mode are
+// handled by the AccessGroupController instead.
+type InitiatorController struct {
+	client          kubernetes.Interface
+	backends        *targetd.Backends
+	provisionerName string
+	log             *zap.Logger
+
+	nodes    corelisters.NodeLister
+	volumes  corelisters.PersistentVolumeLister
+	synced   []cache.InformerSynced
+	queue    workqueue.RateLimitingInterface
+	recorder record.EventRecorder
+}
+
+// NewInitiatorController creates a controller updating the exports of the
+// volumes provisioned by provisionerName, the caller starts the informers of
+// factory.
+func NewInitiatorController(client kubernetes.Interface, backends *targetd.Backends, provisionerName string, factory informers.SharedInformerFactory, recorder record.EventRecorder, logger *zap.Logger) *InitiatorController {
+	nodes := factory.Core().V1().Nodes()
+	volumes := factory.Core().V1().PersistentVolumes()
+
+	c := &InitiatorController{
+		client:          client,
+		backends:        backends,
+		provisionerName: provisionerName,
+		log:             logger.With(zap.String("system", "iscsi-initiators")),
+		nodes:           nodes.Lister(),
+		volumes:         volumes.Lister(),
+		synced:          []cache.InformerSynced{nodes.Informer().HasSynced, volumes.Informer().HasSynced},
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "iscsi-initiators"),
+		recorder:        recorder,
+	}
+	volumes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.enqueueAll() },
+		UpdateFunc: c.nodeUpdated,
+		DeleteFunc: func(interface{}) { c.enqueueAll() },
+	})
+	return c
+}
+
+func (c *InitiatorController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueAll enqueues every volume whose initiators follow the nodes.
+func (c *InitiatorController) enqueueAll() {
+	volumes, err := c.volumes.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, volume := range volumes {
+		if volume.Annotations["initiator_selector"] != "" {
+			c.enqueue(volume)
+		}
+	}
+}
+
+// nodeChanged returns whether the update of a node can change the initiators
+// resolved from it, nodes are updated far too often to resync on every
+// heartbeat.
+func nodeChanged(oldNode, newNode *v1.Node) bool {
+	return nodeInitiator(oldNode) != nodeInitiator(newNode) ||
+		!labels.Equals(oldNode.Labels, newNode.Labels) ||
+		(oldNode.DeletionTimestamp == nil) != (newNode.DeletionTimestamp == nil)
+}
+
+// nodeUpdated enqueues all volumes when the labels or initiator of a node
+// changed.
+func (c *InitiatorController) nodeUpdated(oldObj, newObj interface{}) {
+	oldNode, ok1 := oldObj.(*v1.Node)
+	newNode, ok2 := newObj.(*v1.Node)
+	if ok1 && ok2 && nodeChanged(oldNode, newNode) {
+		c.enqueueAll()
+	}
+}
+
+// Run processes volumes until ctx is done.
+func (c *InitiatorController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		c.log.Warn("failed to sync caches")
+		return
+	}
+	c.log.Debug("initiator controller started")
+	go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	<-ctx.Done()
+	c.log.Debug("initiator controller stopped")
+}
+
+func (c *InitiatorController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *InitiatorController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.sync(ctx, key.(string))
+	if err != nil {
+		c.log.Warn("failed to update exports", zap.String("name", key.(string)), zap.Error(err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync exports the volume key to the initiators of the nodes currently
+// matching its selector and removes the exports to all others.
+func (c *InitiatorController) sync(ctx context.Context, key string) error {
+	volume, err := c.volumes.Get(key)
+	if err != nil {
+		// the volume was deleted
+		return nil
+	}
+	selector := volume.Annotations["initiator_selector"]
+	if selector == "" || volume.Annotations[annProvisionedBy] != c.provisionerName || volume.Annotations["access_group"] != "" {
+		return nil
+	}
+	if volume.Spec.ISCSI == nil || volume.DeletionTimestamp != nil {
+		return nil
+	}
+	// released volumes are about to be deleted, exporting them again would
+	// race with the deletion
+	if volume.Status.Phase != v1.VolumeBound && volume.Status.Phase != v1.VolumeAvailable {
+		return nil
+	}
+	nodes, err := c.nodes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// the static initiators were already chosen within the allowed
+	// topologies when provisioning, the nodes joining later are limited to
+	// the node affinity of the volume
+	if volume.Spec.NodeAffinity != nil {
+		nodes, err = filterNodes(volume.Spec.NodeAffinity.Required, nodes)
+		if err != nil {
+			return err
+		}
+	}
+	wanted, err := resolveInitiators(splitInitiators(volume.Annotations["static_initiators"]), selector, nodes)
+	if err != nil {
+		return err
+	}
+	current := splitInitiators(volume.Annotations["initiators"])
+	exported := make(map[string]bool)
+	for _, initiator := range current {
+		exported[initiator] = true
+	}
+	isWanted := make(map[string]bool)
+	for _, initiator := range wanted {
+		isWanted[initiator] = true
+	}
+
+	_, client, err := c.backends.Get(volume.Annotations["backend"])
+	if err != nil {
+		return err
+	}
+	pool := volume.Annotations["pool"]
+	vol := volume.Annotations["volume_name"]
+	lun := volume.Spec.ISCSI.Lun
+	log := c.log.With(zap.String("name", volume.Name), zap.String("vol", vol), zap.Int32("lun", lun))
+
+	var chapCredentials *chapSessionCredentials
+	var chapSecret *v1.Secret
+	var chapSecrets []v1.Secret
+	generated := volume.Annotations["chap_credentials"] == chapCredentialsGenerated
+	if volume.Spec.ISCSI.SessionCHAPAuth && generated {
+		chapCredentials, chapSecret, err = getSecretCredentials(ctx, c.client, volume.Spec.ISCSI.SecretRef)
+		if err != nil {
+			return err
+		}
+		chapSecrets, err = listChapSecrets(ctx, c.client)
+		if err != nil {
+			return err
+		}
+	} else if volume.Spec.ISCSI.SessionCHAPAuth {
+		chapCredentials, err = getChapCredentials()
+		if err != nil {
+			return err
+		}
+	}
+
+	// exports created by an earlier sync that failed before updating the
+	// annotation are not created again
+	exports, err := client.ExportList(ctx)
+	if err != nil {
+		return err
+	}
+	_, onTarget := getExportedLun(exports, pool, vol)
+
+	var result []string
+	var failed error
+	for _, initiator := range wanted {
+		if exported[initiator] {
+			result = append(result, initiator)
+			continue
+		}
+		log := log.With(zap.String("initiator", initiator))
+		err = nil
+		if generated {
+			// the initiator may already use the credentials of other volumes
+			var shared *chapSessionCredentials
+			shared, err = sharedCredentials(chapSecrets, volume.Name, []string{initiator})
+			if err == nil && shared != nil && *shared != *chapCredentials {
+				err = fmt.Errorf("%w: %s already uses the credentials of another volume", errSharedCredentials, initiator)
+			}
+		}
+		if err == nil && !onTarget[initiator] {
+			err = client.ExportCreate(ctx, targetd.ExportCreateArgs{
+				Pool:         pool,
+				Vol:          vol,
+				InitiatorWwn: initiator,
+				Lun:          lun,
+			})
+		}
+		if err == nil && chapCredentials != nil {
+			err = client.InitiatorSetAuth(ctx, targetd.InitiatorSetAuthArgs{
+				InitiatorWwn: initiator,
+				InUser:       chapCredentials.InUser,
+				InPassword:   chapCredentials.InPassword,
+				OutUser:      chapCredentials.OutUser,
+				OutPassword:  chapCredentials.OutPassword,
+			})
+		}
+		if err != nil {
+			log.Warn("failed to export volume to new initiator", zap.Error(err))
+			c.recorder.Eventf(volume, v1.EventTypeWarning, "ExportFailed", "failed to export volume to %s with lun %d: %v", initiator, lun, err)
+			// a lun taken on the new node or credentials used by other
+			// volumes do not free up by retrying, the volume is synced
+			// again on the next change or resync
+			if !errors.Is(err, targetd.NoFreeHostLunId) && !targetd.IsConflict(err) && !errors.Is(err, errSharedCredentials) {
+				failed = err
+			}
+			continue
+		}
+		log.Info("exported volume to new initiator")
+		c.recorder.Eventf(volume, v1.EventTypeNormal, "Exported", "exported volume to %s", initiator)
+		result = append(result, initiator)
+	}
+	for _, initiator := range current {
+		if isWanted[initiator] {
+			continue
+		}
+		log := log.With(zap.String("initiator", initiator))
+		err := client.ExportDestroy(ctx, targetd.ExportDestroyArgs{
+			Pool:         pool,
+			Vol:          vol,
+			InitiatorWwn: initiator,
+		})
+		if err != nil && !targetd.IsNotFound(err) {
+			log.Warn("failed to remove export of departed initiator", zap.Error(err))
+			failed = err
+			result = append(result, initiator)
+			continue
+		}
+		log.Info("removed export of departed initiator")
+		c.recorder.Eventf(volume, v1.EventTypeNormal, "Unexported", "removed export to %s", initiator)
+	}
+
+	sort.Strings(result)
+	sort.Strings(current)
+	if chapSecret != nil && chapSecret.Annotations[chapInitiatorsAnnotation] != strings.Join(result, ",") {
+		chapSecret = chapSecret.DeepCopy()
+		if chapSecret.Annotations == nil {
+			chapSecret.Annotations = make(map[string]string)
+		}
+		chapSecret.Annotations[chapInitiatorsAnnotation] = strings.Join(result, ",")
+		_, err = c.client.CoreV1().Secrets(chapSecret.Namespace).Update(ctx, chapSecret, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	if strings.Join(result, ",") != strings.Join(current, ",") {
+		volume = volume.DeepCopy()
+		volume.Annotations["initiators"] = strings.Join(result, ",")
+		_, err = c.client.CoreV1().PersistentVolumes().Update(ctx, volume, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return failed
+}
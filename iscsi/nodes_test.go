@@ -0,0 +1,185 @@
+package iscsi
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// newNode returns a node with labels whose initiator name is set with the
+// default initiator annotation.
+func newNode(name, initiator string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: map[string]string{DefaultInitiatorKey: initiator},
+		},
+	}
+}
+
+func TestResolveInitiators(t *testing.T) {
+	storage := map[string]string{"storage": "iscsi"}
+	nodes := []*v1.Node{
+		newNode("a", "iqn.a", storage),
+		newNode("b", "iqn.b", map[string]string{"storage": "none"}),
+		newNode("c", "", storage),
+		{ObjectMeta: metav1.ObjectMeta{Name: "d", Labels: map[string]string{"storage": "iscsi", DefaultInitiatorKey: "iqn.d"}}},
+	}
+	tests := []struct {
+		name     string
+		static   []string
+		selector string
+		expected string
+		err      bool
+	}{
+		{name: "static only", static: []string{"iqn.z", "iqn.a"}, expected: "iqn.a,iqn.z"},
+		{name: "selected nodes", selector: "storage=iscsi", expected: "iqn.a,iqn.d"},
+		{name: "static and nodes", static: []string{"iqn.a", "iqn.z"}, selector: "storage=iscsi", expected: "iqn.a,iqn.d,iqn.z"},
+		{name: "no match", selector: "storage=nfs", expected: ""},
+		{name: "invalid selector", selector: "storage in (", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initiators, err := resolveInitiators(test.static, test.selector, nodes)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %v", initiators)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(initiators, ","); got != test.expected {
+				t.Errorf("expected initiators %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestProvisionDiscoversNodeInitiators(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	setNodes(t, p,
+		newNode("a", "iqn.a", map[string]string{"storage": "iscsi"}),
+		newNode("b", "iqn.b", map[string]string{"storage": "none"}),
+	)
+
+	pv, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{
+		"initiators":            "iqn.static",
+		"initiatorNodeSelector": "storage=iscsi",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"initiators":         "iqn.a,iqn.static",
+		"initiator_selector": "storage=iscsi",
+		"static_initiators":  "iqn.static",
+	} {
+		if pv.Annotations[key] != expected {
+			t.Errorf("expected annotation %s=%s, got %q", key, expected, pv.Annotations[key])
+		}
+	}
+	if exports := s.Exports(); len(exports) != 2 {
+		t.Errorf("expected exports to iqn.a and iqn.static, got %+v", exports)
+	}
+}
+
+func TestProvisionRequiresInitiators(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{
+		"initiatorNodeSelector": "storage=iscsi",
+	}))
+	if err == nil {
+		t.Fatal("expected provisioning without initiators to fail")
+	}
+	if calls := s.Calls("vol_create"); calls != 0 {
+		t.Errorf("expected no vol_create calls, got %d", calls)
+	}
+}
+
+func TestProvisionWaitsForNodeCache(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	p.synced = []cache.InformerSynced{func() bool { return false }}
+
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"}))
+	if err == nil {
+		t.Fatal("expected provisioning to wait for the node cache")
+	}
+	if calls := s.Calls("vol_create"); calls != 0 {
+		t.Errorf("expected no vol_create calls, got %d", calls)
+	}
+}
+
+func TestInitiatorControllerFollowsNodes(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	nodeA := newNode("a", "iqn.a", map[string]string{"storage": "iscsi"})
+	setNodes(t, p, nodeA)
+	pv, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"initiatorNodeSelector": "storage=iscsi"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv.Annotations[annProvisionedBy] = "iscsi-targetd"
+	pv.Status.Phase = v1.VolumeBound
+
+	client := kubefake.NewSimpleClientset(pv)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c := NewInitiatorController(client, p.backends, "iscsi-targetd", factory, record.NewFakeRecorder(10), zap.NewNop())
+	nodes := factory.Core().V1().Nodes().Informer().GetIndexer()
+	volumes := factory.Core().V1().PersistentVolumes().Informer().GetIndexer()
+	if err := volumes.Add(pv); err != nil {
+		t.Fatal(err)
+	}
+	initiators := func() string {
+		t.Helper()
+		volume, err := client.CoreV1().PersistentVolumes().Get(ctx, "pvc-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := volumes.Update(volume); err != nil {
+			t.Fatal(err)
+		}
+		return volume.Annotations["initiators"]
+	}
+
+	// node b joins
+	for _, node := range []*v1.Node{nodeA, newNode("b", "iqn.b", map[string]string{"storage": "iscsi"})} {
+		if err := nodes.Add(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.sync(ctx, "pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := initiators(); got != "iqn.a,iqn.b" {
+		t.Errorf("expected initiators iqn.a,iqn.b, got %s", got)
+	}
+	if exports := s.Exports(); len(exports) != 2 {
+		t.Errorf("expected exports to iqn.a and iqn.b, got %+v", exports)
+	}
+
+	// node a leaves
+	if err := nodes.Delete(nodeA); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.sync(ctx, "pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := initiators(); got != "iqn.b" {
+		t.Errorf("expected initiators iqn.b, got %s", got)
+	}
+	exports := s.Exports()
+	if len(exports) != 1 || exports[0].InitiatorWwn != "iqn.b" || exports[0].Lun != pv.Spec.ISCSI.Lun {
+		t.Errorf("expected only the export to iqn.b with lun %d, got %+v", pv.Spec.ISCSI.Lun, exports)
+	}
+}
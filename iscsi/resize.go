@@ -0,0 +1,263 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// ResizeController grows the targetd volumes of PersistentVolumeClaims whose
+// StorageClass belongs to the iscsi provisioner and allows volume expansion.
+// While the volume is resized the claim has the Resizing condition, once it
+// is resized the PersistentVolume capacity is updated and the condition is
+// replaced by FileSystemResizePending so the kubelet grows the filesystem.
+//
+// The expand controller of kube-controller-manager only records an
+// ExternalExpanding event for these claims as the in-tree iSCSI plugin cannot
+// expand volumes. No other resizer may handle the StorageClasses of the
+// provisioner, or both would resize the same volume.
+type ResizeController struct {
+	client          kubernetes.Interface
+	backends        *targetd.Backends
+	provisionerName string
+	log             *zap.Logger
+
+	claims         corelisters.PersistentVolumeClaimLister
+	volumes        corelisters.PersistentVolumeLister
+	storageClasses storagelisters.StorageClassLister
+	synced         []cache.InformerSynced
+	queue          workqueue.RateLimitingInterface
+	recorder       record.EventRecorder
+}
+
+// NewResizeController creates a controller resizing volumes provisioned by
+// provisionerName, the caller starts the informers of factory.
+func NewResizeController(client kubernetes.Interface, backends *targetd.Backends, provisionerName string, factory informers.SharedInformerFactory, recorder record.EventRecorder, logger *zap.Logger) *ResizeController {
+	claims := factory.Core().V1().PersistentVolumeClaims()
+	volumes := factory.Core().V1().PersistentVolumes()
+	storageClasses := factory.Storage().V1().StorageClasses()
+
+	c := &ResizeController{
+		client:          client,
+		backends:        backends,
+		provisionerName: provisionerName,
+		log:             logger.With(zap.String("system", "iscsi-resize")),
+		claims:          claims.Lister(),
+		volumes:         volumes.Lister(),
+		storageClasses:  storageClasses.Lister(),
+		synced:          []cache.InformerSynced{claims.Informer().HasSynced, volumes.Informer().HasSynced, storageClasses.Informer().HasSynced},
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "iscsi-resize"),
+		recorder:        recorder,
+	}
+	claims.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	return c
+}
+
+func (c *ResizeController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run processes claims until ctx is done.
+func (c *ResizeController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		c.log.Warn("failed to sync caches")
+		return
+	}
+	c.log.Debug("resize controller started")
+	go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	<-ctx.Done()
+	c.log.Debug("resize controller stopped")
+}
+
+func (c *ResizeController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *ResizeController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.sync(ctx, key.(string))
+	if err != nil {
+		c.log.Warn("failed to resize volume", zap.String("claim", key.(string)), zap.Error(err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync resizes the volume of the claim key when it requests more storage
+// than it currently has.
+func (c *ResizeController) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	claim, err := c.claims.PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		// the claim was deleted
+		return nil
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.StorageClassName == nil {
+		return nil
+	}
+	storageClass, err := c.storageClasses.Get(*claim.Spec.StorageClassName)
+	if err != nil {
+		return nil
+	}
+	if storageClass.Provisioner != c.provisionerName || storageClass.AllowVolumeExpansion == nil || !*storageClass.AllowVolumeExpansion {
+		return nil
+	}
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	current := claim.Status.Capacity[v1.ResourceStorage]
+	if requested.Cmp(current) <= 0 {
+		return nil
+	}
+
+	volume, err := c.volumes.Get(claim.Spec.VolumeName)
+	if err != nil {
+		return err
+	}
+	if volume.Spec.ISCSI == nil {
+		return nil
+	}
+	log := c.log.With(zap.String("claim", key), zap.String("name", volume.Name), zap.String("size", requested.String()))
+
+	capacity := volume.Spec.Capacity[v1.ResourceStorage]
+	if requested.Cmp(capacity) > 0 {
+		claim, err = c.markResizing(ctx, claim)
+		if err != nil {
+			return err
+		}
+		c.recorder.Eventf(claim, v1.EventTypeNormal, "Resizing", "resizing volume %s to %s", volume.Name, requested.String())
+		err = c.resizeVolume(ctx, volume, requested)
+		if err != nil {
+			c.recorder.Eventf(claim, v1.EventTypeWarning, "VolumeResizeFailed", "failed to resize volume %s: %v", volume.Name, err)
+			return err
+		}
+		log.Info("volume resized")
+		c.recorder.Eventf(claim, v1.EventTypeNormal, "VolumeResizeSuccessful", "resized volume %s to %s", volume.Name, requested.String())
+	}
+	return c.markFileSystemResizePending(ctx, claim)
+}
+
+// resizeVolume grows the targetd volume backing volume and records the new
+// capacity on the PersistentVolume.
+func (c *ResizeController) resizeVolume(ctx context.Context, volume *v1.PersistentVolume, size resource.Quantity) error {
+	_, client, err := c.backends.Get(volume.Annotations["backend"])
+	if err != nil {
+		return err
+	}
+	pool := volume.Annotations["pool"]
+	name := volume.Annotations["volume_name"]
+	vols, err := client.VolList(ctx, targetd.VolListArgs{Pool: pool})
+	if err != nil {
+		return err
+	}
+	// the persistent volume may lag behind an earlier resize, and lvm refuses
+	// to resize to the current size
+	resized := false
+	for _, vol := range vols {
+		if vol.Name == name && vol.Size >= size.Value() {
+			resized = true
+		}
+	}
+	if !resized {
+		err = client.VolResize(ctx, targetd.VolResizeArgs{
+			Pool: pool,
+			Name: name,
+			Size: size.Value(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	volume = volume.DeepCopy()
+	volume.Spec.Capacity[v1.ResourceStorage] = size
+	_, err = c.client.CoreV1().PersistentVolumes().Update(ctx, volume, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update capacity of persistent volume: %w", err)
+	}
+	return nil
+}
+
+// hasCondition reports whether claim has a condition of conditionType that
+// is true.
+func hasCondition(claim *v1.PersistentVolumeClaim, conditionType v1.PersistentVolumeClaimConditionType) bool {
+	for _, condition := range claim.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// markResizing sets the Resizing condition on claim while its volume is
+// grown, it stays set when resizing fails so the claim shows the resize is
+// still pending.
+func (c *ResizeController) markResizing(ctx context.Context, claim *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, error) {
+	if hasCondition(claim, v1.PersistentVolumeClaimResizing) {
+		return claim, nil
+	}
+	claim = claim.DeepCopy()
+	claim.Status.Conditions = append(claim.Status.Conditions, v1.PersistentVolumeClaimCondition{
+		Type:               v1.PersistentVolumeClaimResizing,
+		Status:             v1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	})
+	return c.client.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(ctx, claim, metav1.UpdateOptions{})
+}
+
+// markFileSystemResizePending replaces the Resizing condition of claim to
+// ask the kubelet to grow the filesystem on the volume the next time it is
+// mounted.
+func (c *ResizeController) markFileSystemResizePending(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	if hasCondition(claim, v1.PersistentVolumeClaimFileSystemResizePending) && !hasCondition(claim, v1.PersistentVolumeClaimResizing) {
+		return nil
+	}
+	claim = claim.DeepCopy()
+	var conditions []v1.PersistentVolumeClaimCondition
+	for _, condition := range claim.Status.Conditions {
+		if condition.Type != v1.PersistentVolumeClaimResizing && condition.Type != v1.PersistentVolumeClaimFileSystemResizePending {
+			conditions = append(conditions, condition)
+		}
+	}
+	claim.Status.Conditions = append(conditions, v1.PersistentVolumeClaimCondition{
+		Type:               v1.PersistentVolumeClaimFileSystemResizePending,
+		Status:             v1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Message:            "Waiting for user to (re-)start a pod to finish file system resize of volume on node.",
+	})
+	_, err := c.client.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(ctx, claim, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,173 @@
+package iscsi
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// newTestResizeController returns a resize controller for a provisioned
+// volume pvc-1 of 1 GiB bound to claim default/claim-pvc-1, which requests
+// requested bytes.
+func newTestResizeController(t *testing.T, requested int64) (*ResizeController, *kubefake.Clientset, *record.FakeRecorder) {
+	p, _ := newTestProvisioner(t)
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a"})
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	className := "iscsi"
+	expansion := true
+	storageClass := &storagev1.StorageClass{
+		ObjectMeta:           metav1.ObjectMeta{Name: className},
+		Provisioner:          "iscsi-targetd",
+		AllowVolumeExpansion: &expansion,
+	}
+	claim := options.PVC.DeepCopy()
+	claim.Spec.StorageClassName = &className
+	claim.Spec.VolumeName = pv.Name
+	claim.Spec.Resources.Requests[v1.ResourceStorage] = *resource.NewQuantity(requested, resource.BinarySI)
+	claim.Status.Phase = v1.ClaimBound
+	claim.Status.Capacity = v1.ResourceList{v1.ResourceStorage: *resource.NewQuantity(gib, resource.BinarySI)}
+
+	client := kubefake.NewSimpleClientset(storageClass, claim, pv)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	recorder := record.NewFakeRecorder(10)
+	c := NewResizeController(client, p.backends, "iscsi-targetd", factory, recorder, zap.NewNop())
+	for _, obj := range []interface{}{storageClass, claim, pv} {
+		var err error
+		switch obj := obj.(type) {
+		case *storagev1.StorageClass:
+			err = factory.Storage().V1().StorageClasses().Informer().GetIndexer().Add(obj)
+		case *v1.PersistentVolumeClaim:
+			err = factory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer().Add(obj)
+		case *v1.PersistentVolume:
+			err = factory.Core().V1().PersistentVolumes().Informer().GetIndexer().Add(obj)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, client, recorder
+}
+
+func volumeSize(t *testing.T, c *ResizeController) int64 {
+	t.Helper()
+	_, client, err := c.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vols, err := client.VolList(context.Background(), targetd.VolListArgs{Pool: "vg-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vol := range vols {
+		if vol.Name == "pvc-1" {
+			return vol.Size
+		}
+	}
+	t.Fatal("volume pvc-1 not found")
+	return 0
+}
+
+func TestResizeGrowsVolume(t *testing.T) {
+	c, client, recorder := newTestResizeController(t, 2*gib)
+	ctx := context.Background()
+
+	if err := c.sync(ctx, "default/claim-pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if size := volumeSize(t, c); size != 2*gib {
+		t.Errorf("expected volume of %d bytes, got %d", int64(2*gib), size)
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(ctx, "pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity := pv.Spec.Capacity[v1.ResourceStorage]; capacity.Value() != 2*gib {
+		t.Errorf("expected persistent volume capacity of %d bytes, got %s", int64(2*gib), capacity.String())
+	}
+	claim, err := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "claim-pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasCondition(claim, v1.PersistentVolumeClaimFileSystemResizePending) || hasCondition(claim, v1.PersistentVolumeClaimResizing) {
+		t.Errorf("expected the claim to be marked FileSystemResizePending only, got %+v", claim.Status.Conditions)
+	}
+	expectEvents(t, recorder, "Resizing", "VolumeResizeSuccessful")
+}
+
+func TestResizeFailureKeepsResizingCondition(t *testing.T) {
+	// more than the fake pool holds
+	c, client, recorder := newTestResizeController(t, 1024*gib)
+	ctx := context.Background()
+
+	if err := c.sync(ctx, "default/claim-pvc-1"); err == nil {
+		t.Fatal("expected resizing to fail")
+	}
+	claim, err := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "claim-pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasCondition(claim, v1.PersistentVolumeClaimResizing) || hasCondition(claim, v1.PersistentVolumeClaimFileSystemResizePending) {
+		t.Errorf("expected the claim to be marked Resizing only, got %+v", claim.Status.Conditions)
+	}
+	expectEvents(t, recorder, "Resizing", "VolumeResizeFailed")
+}
+
+// expectEvents fails t unless recorder recorded events with reasons, in
+// order.
+func expectEvents(t *testing.T, recorder *record.FakeRecorder, reasons ...string) {
+	t.Helper()
+	for _, reason := range reasons {
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, " "+reason+" ") {
+				t.Errorf("expected a %s event, got %q", reason, event)
+			}
+		default:
+			t.Errorf("expected a %s event", reason)
+		}
+	}
+}
+
+func TestResizeSkipsReachedSize(t *testing.T) {
+	c, client, _ := newTestResizeController(t, gib)
+	client.ClearActions()
+
+	if err := c.sync(context.Background(), "default/claim-pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if size := volumeSize(t, c); size != gib {
+		t.Errorf("expected volume to keep %d bytes, got %d", int64(gib), size)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no api calls, got %v", actions)
+	}
+}
+
+func TestResizeRefusesShrink(t *testing.T) {
+	c, client, _ := newTestResizeController(t, gib/2)
+	client.ClearActions()
+
+	if err := c.sync(context.Background(), "default/claim-pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if size := volumeSize(t, c); size != gib {
+		t.Errorf("expected volume to keep %d bytes, got %d", int64(gib), size)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no api calls, got %v", actions)
+	}
+}
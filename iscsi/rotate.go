@@ -0,0 +1,438 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RotateChapOptions configures RotateChap.
+type RotateChapOptions struct {
+	// ProvisionerName selects the volumes whose credentials are rotated.
+	ProvisionerName string
+	// CredentialsFile is a properties file like the
+	// session-chap-credential-file-path with the new credentials, new
+	// credentials are generated when it is empty.
+	CredentialsFile string
+	// SessionCredentialsFile is the session-chap-credential-file-path of
+	// the provisioner. Secrets shared with it are only rotated when it has
+	// the credentials of CredentialsFile already, otherwise volumes
+	// provisioned later would get the old credentials.
+	SessionCredentialsFile string
+	// Mutual generates mutual credentials for volumes that have none yet.
+	Mutual bool
+	// DryRun only reports what would be rotated.
+	DryRun bool
+}
+
+// InitiatorRotation is the outcome of setting the new credentials of an
+// initiator.
+type InitiatorRotation struct {
+	Backend   string
+	Initiator string
+	Err       error
+}
+
+// SecretRotation is the outcome of updating a secret referenced by volumes
+// with the new credentials.
+type SecretRotation struct {
+	Namespace string
+	Name      string
+	// Generated is set for secrets with generated credentials, the others
+	// are shared with the session-chap-credential-file-path.
+	Generated bool
+	Err       error
+}
+
+// RotateChapResult reports the rotation of every initiator and secret.
+type RotateChapResult struct {
+	Initiators []InitiatorRotation
+	Secrets    []SecretRotation
+}
+
+// Failed returns whether any initiator or secret failed to rotate.
+func (r *RotateChapResult) Failed() bool {
+	for _, i := range r.Initiators {
+		if i.Err != nil {
+			return true
+		}
+	}
+	for _, s := range r.Secrets {
+		if s.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// errInitiatorsFailed is reported for secrets that were not updated because
+// setting the credentials of their initiators failed.
+var errInitiatorsFailed = errors.New("not updated, setting the credentials of its initiators failed")
+
+// errSkipped is reported for initiators and secrets that were not rotated
+// because another initiator or secret of their group failed before.
+var errSkipped = errors.New("skipped, another initiator or secret of its group failed")
+
+// errRolledBack is reported for initiators and secrets that got the new
+// credentials, but were given their previous credentials again because
+// another initiator or secret of their group failed to rotate.
+var errRolledBack = errors.New("rolled back, another initiator or secret of its group failed")
+
+// errCredentialsFileShared is reported for the initiators and secrets of groups
+// with credentials shared with the session-chap-credential-file-path when
+// no new credentials were read from a file.
+var errCredentialsFileShared = errors.New("skipped, shared with the session-chap-credential-file-path, write the new credentials to it and pass them with --from-file")
+
+// errCredentialsFileStale is reported for the initiators and secrets of
+// groups with credentials shared with the session-chap-credential-file-path
+// when that file does not have the new credentials.
+var errCredentialsFileStale = errors.New("skipped, the session-chap-credential-file-path does not have the new credentials")
+
+// chapGroup is a set of secrets with the same credentials and the initiators
+// of their volumes, which have to be rotated together because targetd sets
+// credentials per initiator.
+type chapGroup struct {
+	credentials chapSessionCredentials
+	mutual      bool
+	// secrets maps the secrets to their current credentials
+	secrets   map[v1.SecretReference]chapSessionCredentials
+	generated map[v1.SecretReference]bool
+	// initiators maps backends to their initiators and the credentials
+	// they have now
+	initiators map[string]map[string]chapSessionCredentials
+}
+
+// RotateChap sets new session chap credentials for every initiator of the
+// volumes of options.ProvisionerName using session chap, and updates the
+// secrets those volumes reference. Established sessions keep working, nodes
+// need the new credentials when they log in again. A secret is only updated
+// when the credentials of all initiators of its volumes were set. When an
+// initiator or secret fails, the initiators and secrets of its group that
+// were already rotated get their previous credentials again, so nodes keep
+// credentials that match their targets. Groups with secrets shared with the
+// session-chap-credential-file-path are skipped unless that file has the
+// new credentials of options.CredentialsFile.
+func RotateChap(ctx context.Context, kube kubernetes.Interface, backends *targetd.Backends, log *zap.Logger, options RotateChapOptions) (*RotateChapResult, error) {
+	var fromFile *chapSessionCredentials
+	if options.CredentialsFile != "" {
+		var err error
+		fromFile, err = loadChapCredentials(options.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chap credentials: %w", err)
+		}
+	}
+	sharedErr := checkSessionCredentials(options, fromFile)
+	volumes, err := kube.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*chapGroup
+	secrets := make(map[v1.SecretReference]*chapGroup)
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annProvisionedBy] != options.ProvisionerName || volume.Spec.ISCSI == nil || !volume.Spec.ISCSI.SessionCHAPAuth || volume.Spec.ISCSI.SecretRef == nil {
+			continue
+		}
+		ref := *volume.Spec.ISCSI.SecretRef
+		// like the iscsi volume plugin, a secret without namespace is in
+		// the namespace of the claim
+		if ref.Namespace == "" && volume.Spec.ClaimRef != nil {
+			ref.Namespace = volume.Spec.ClaimRef.Namespace
+		}
+		group, ok := secrets[ref]
+		if !ok {
+			secret, err := kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get chap secret %s/%s of volume %s: %w", ref.Namespace, ref.Name, volume.Name, err)
+			}
+			credentials := *secretCredentials(secret)
+			for _, g := range groups {
+				if g.credentials == credentials {
+					group = g
+				}
+			}
+			if group == nil {
+				group = &chapGroup{
+					credentials: credentials,
+					mutual:      credentials.OutUser != "",
+					secrets:     make(map[v1.SecretReference]chapSessionCredentials),
+					generated:   make(map[v1.SecretReference]bool),
+					initiators:  make(map[string]map[string]chapSessionCredentials),
+				}
+				groups = append(groups, group)
+			}
+			secrets[ref] = group
+			group.secrets[ref] = credentials
+		}
+		if volume.Annotations["chap_credentials"] == chapCredentialsGenerated {
+			group.generated[ref] = true
+		}
+		backend, _, err := backends.Get(volume.Annotations["backend"])
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %w", volume.Name, err)
+		}
+		if group.initiators[backend] == nil {
+			group.initiators[backend] = make(map[string]chapSessionCredentials)
+		}
+		for _, initiator := range splitInitiators(volume.Annotations["initiators"]) {
+			if _, ok := group.initiators[backend][initiator]; !ok {
+				group.initiators[backend][initiator] = group.secrets[ref]
+			}
+		}
+	}
+
+	result := &RotateChapResult{}
+	for _, group := range mergeGroups(groups) {
+		if sharedErr != nil && group.shared() {
+			skipGroup(result, group, sharedErr)
+			continue
+		}
+		credentials := fromFile
+		if credentials == nil {
+			credentials, err = generateChapCredentials(options.Mutual || group.mutual)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var rotated []rotatedInitiator
+		initiatorsFailed, failed := false, false
+		for _, backend := range group.backends() {
+			_, client, err := backends.Get(backend)
+			if err != nil {
+				return nil, err
+			}
+			for _, initiator := range sortedInitiators(group.initiators[backend]) {
+				rotation := InitiatorRotation{Backend: backend, Initiator: initiator}
+				if !options.DryRun && !failed {
+					log.Debug("setting chap credentials", zap.String("backend", backend), zap.String("initiator", initiator))
+					rotation.Err = setInitiatorAuth(ctx, client, initiator, credentials)
+					if rotation.Err != nil {
+						log.Warn("failed to set chap credentials", zap.String("backend", backend), zap.String("initiator", initiator), zap.Error(rotation.Err))
+						initiatorsFailed, failed = true, true
+					} else {
+						rotated = append(rotated, rotatedInitiator{client: client, index: len(result.Initiators), previous: group.initiators[backend][initiator]})
+					}
+				} else if failed {
+					rotation.Err = errSkipped
+				}
+				result.Initiators = append(result.Initiators, rotation)
+			}
+		}
+		var updated []int
+		for _, ref := range group.sortedSecrets() {
+			rotation := SecretRotation{Namespace: ref.Namespace, Name: ref.Name, Generated: group.generated[ref]}
+			switch {
+			case initiatorsFailed:
+				rotation.Err = errInitiatorsFailed
+			case failed:
+				rotation.Err = errSkipped
+			case !options.DryRun:
+				rotation.Err = updateChapSecret(ctx, kube, ref, credentials)
+				if rotation.Err != nil {
+					log.Warn("failed to update chap secret", zap.String("secret", ref.Namespace+"/"+ref.Name), zap.Error(rotation.Err))
+					failed = true
+				} else {
+					updated = append(updated, len(result.Secrets))
+				}
+			}
+			result.Secrets = append(result.Secrets, rotation)
+		}
+		if failed {
+			rollback(ctx, kube, log, result, group, rotated, updated)
+		}
+	}
+	return result, nil
+}
+
+// checkSessionCredentials returns the error reported for groups with
+// credentials shared with the session-chap-credential-file-path, or nil
+// when that file has the new credentials fromFile and they can be rotated.
+func checkSessionCredentials(options RotateChapOptions, fromFile *chapSessionCredentials) error {
+	if fromFile == nil {
+		return errCredentialsFileShared
+	}
+	current, err := loadChapCredentials(options.SessionCredentialsFile)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCredentialsFileStale, err)
+	}
+	if *current != *fromFile {
+		return errCredentialsFileStale
+	}
+	return nil
+}
+
+// shared returns whether the group has secrets with the credentials of the
+// session-chap-credential-file-path instead of generated ones.
+func (g *chapGroup) shared() bool {
+	for ref := range g.secrets {
+		if !g.generated[ref] {
+			return true
+		}
+	}
+	return false
+}
+
+// backends returns the backends of the initiators of the group in order.
+func (g *chapGroup) backends() []string {
+	names := make([]string, 0, len(g.initiators))
+	for backend := range g.initiators {
+		names = append(names, backend)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedSecrets returns the secrets of the group in order.
+func (g *chapGroup) sortedSecrets() []v1.SecretReference {
+	refs := make([]v1.SecretReference, 0, len(g.secrets))
+	for ref := range g.secrets {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Namespace+"/"+refs[i].Name < refs[j].Namespace+"/"+refs[j].Name
+	})
+	return refs
+}
+
+// skipGroup reports err for every initiator and secret of group without
+// rotating them.
+func skipGroup(result *RotateChapResult, group *chapGroup, err error) {
+	for _, backend := range group.backends() {
+		for _, initiator := range sortedInitiators(group.initiators[backend]) {
+			result.Initiators = append(result.Initiators, InitiatorRotation{Backend: backend, Initiator: initiator, Err: err})
+		}
+	}
+	for _, ref := range group.sortedSecrets() {
+		result.Secrets = append(result.Secrets, SecretRotation{Namespace: ref.Namespace, Name: ref.Name, Generated: group.generated[ref], Err: err})
+	}
+}
+
+// mergeGroups merges the groups sharing an initiator, which happens when a
+// volume with generated credentials was exported to an initiator that also
+// uses the credentials of the session-chap-credential-file-path.
+func mergeGroups(groups []*chapGroup) []*chapGroup {
+	var merged []*chapGroup
+	for _, group := range groups {
+		for i := 0; i < len(merged); i++ {
+			if !sharesInitiator(merged[i], group) {
+				continue
+			}
+			for ref := range merged[i].generated {
+				group.generated[ref] = true
+			}
+			for ref, credentials := range merged[i].secrets {
+				group.secrets[ref] = credentials
+			}
+			for backend, initiators := range merged[i].initiators {
+				if group.initiators[backend] == nil {
+					group.initiators[backend] = make(map[string]chapSessionCredentials)
+				}
+				for initiator, credentials := range initiators {
+					if _, ok := group.initiators[backend][initiator]; !ok {
+						group.initiators[backend][initiator] = credentials
+					}
+				}
+			}
+			group.mutual = group.mutual || merged[i].mutual
+			merged = append(merged[:i], merged[i+1:]...)
+			i--
+		}
+		merged = append(merged, group)
+	}
+	return merged
+}
+
+func sharesInitiator(a, b *chapGroup) bool {
+	for backend, initiators := range a.initiators {
+		for initiator := range initiators {
+			if _, ok := b.initiators[backend][initiator]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rotatedInitiator is an initiator that got the new credentials, with the
+// index of its InitiatorRotation in the result.
+type rotatedInitiator struct {
+	client   *targetd.Client
+	index    int
+	previous chapSessionCredentials
+}
+
+// rollback gives the rotated initiators and the updated secrets of group,
+// the secrets given as indexes in result.Secrets, their previous
+// credentials again. Their rotations report errRolledBack, or the error of
+// restoring the credentials.
+func rollback(ctx context.Context, kube kubernetes.Interface, log *zap.Logger, result *RotateChapResult, group *chapGroup, rotated []rotatedInitiator, updated []int) {
+	for _, i := range rotated {
+		rotation := &result.Initiators[i.index]
+		rotation.Err = errRolledBack
+		previous := i.previous
+		if err := setInitiatorAuth(ctx, i.client, rotation.Initiator, &previous); err != nil {
+			log.Error("failed to restore chap credentials", zap.String("backend", rotation.Backend), zap.String("initiator", rotation.Initiator), zap.Error(err))
+			rotation.Err = fmt.Errorf("failed to restore the previous credentials: %w", err)
+		}
+	}
+	for _, i := range updated {
+		rotation := &result.Secrets[i]
+		rotation.Err = errRolledBack
+		ref := v1.SecretReference{Namespace: rotation.Namespace, Name: rotation.Name}
+		previous := group.secrets[ref]
+		if err := updateChapSecret(ctx, kube, ref, &previous); err != nil {
+			log.Error("failed to restore chap secret", zap.String("secret", ref.Namespace+"/"+ref.Name), zap.Error(err))
+			rotation.Err = fmt.Errorf("failed to restore the previous credentials: %w", err)
+		}
+	}
+}
+
+// setInitiatorAuth sets the session credentials of initiator.
+func setInitiatorAuth(ctx context.Context, client *targetd.Client, initiator string, credentials *chapSessionCredentials) error {
+	return client.InitiatorSetAuth(ctx, targetd.InitiatorSetAuthArgs{
+		InitiatorWwn: initiator,
+		InUser:       credentials.InUser,
+		InPassword:   credentials.InPassword,
+		OutUser:      credentials.OutUser,
+		OutPassword:  credentials.OutPassword,
+	})
+}
+
+// updateChapSecret replaces the session credentials in the secret ref,
+// keeping the discovery credentials.
+func updateChapSecret(ctx context.Context, kube kubernetes.Interface, ref v1.SecretReference, credentials *chapSessionCredentials) error {
+	secret, err := kube.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	secret = secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	delete(secret.Data, "node.session.auth.username_in")
+	delete(secret.Data, "node.session.auth.password_in")
+	for key, value := range secretData(credentials) {
+		secret.Data[key] = value
+	}
+	_, err = kube.CoreV1().Secrets(ref.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// sortedInitiators returns the initiators of a backend of a chapGroup in
+// order.
+func sortedInitiators(initiators map[string]chapSessionCredentials) []string {
+	keys := make([]string, 0, len(initiators))
+	for key := range initiators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
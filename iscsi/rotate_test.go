@@ -0,0 +1,294 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var currentCredentials = chapSessionCredentials{InUser: "user", InPassword: "password"}
+
+// newRotateTest returns a provisioner with a volume exported to iqn.a and
+// iqn.b using the session chap credentials of the secret default/chap,
+// which the initiators have too. mode is the chapCredentials of the volume.
+func newRotateTest(t *testing.T, mode string) (*iscsiProvisioner, *fake.Server, *kubefake.Clientset) {
+	p, s := newTestProvisioner(t)
+	kube := kubefake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "chap", Namespace: "default"},
+			Data:       secretData(&currentCredentials),
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "pvc-1",
+				Annotations: map[string]string{
+					annProvisionedBy:   "iscsi-targetd",
+					"backend":          "default",
+					"initiators":       "iqn.a,iqn.b",
+					"chap_credentials": mode,
+				},
+			},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					ISCSI: &v1.ISCSIPersistentVolumeSource{
+						SessionCHAPAuth: true,
+						SecretRef:       &v1.SecretReference{Name: "chap", Namespace: "default"},
+					},
+				},
+			},
+		},
+	)
+	p.kube = kube
+	_, client, err := p.backends.Get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, initiator := range []string{"iqn.a", "iqn.b"} {
+		err := client.InitiatorSetAuth(context.Background(), targetd.InitiatorSetAuthArgs{
+			InitiatorWwn: initiator,
+			InUser:       currentCredentials.InUser,
+			InPassword:   currentCredentials.InPassword,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, s, kube
+}
+
+// secretCredentialsOf returns the credentials in the secret default/chap.
+func secretCredentialsOf(t *testing.T, kube *kubefake.Clientset) chapSessionCredentials {
+	t.Helper()
+	secret, err := kube.CoreV1().Secrets("default").Get(context.Background(), "chap", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *secretCredentials(secret)
+}
+
+// expectInitiatorCredentials fails t unless iqn.a and iqn.b have credentials.
+func expectInitiatorCredentials(t *testing.T, s *fake.Server, credentials chapSessionCredentials) {
+	t.Helper()
+	for _, initiator := range []string{"iqn.a", "iqn.b"} {
+		auth, _ := s.InitiatorAuth(initiator)
+		if auth.InUser != credentials.InUser || auth.InPassword != credentials.InPassword {
+			t.Errorf("expected %s to have credentials %+v, got %+v", initiator, credentials, auth)
+		}
+	}
+}
+
+func TestRotateChap(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), RotateChapOptions{ProvisionerName: "iscsi-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed() {
+		t.Fatalf("expected the rotation to succeed, got %+v", result)
+	}
+	if len(result.Initiators) != 2 || len(result.Secrets) != 1 || !result.Secrets[0].Generated {
+		t.Errorf("expected two initiators and one generated secret, got %+v", result)
+	}
+	credentials := secretCredentialsOf(t, kube)
+	if credentials == currentCredentials {
+		t.Fatal("expected the secret to get new credentials")
+	}
+	expectInitiatorCredentials(t, s, credentials)
+}
+
+func TestRotateChapFromFile(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+	writeChapCredentials(t, "new-user", "new-password")
+
+	options := RotateChapOptions{ProvisionerName: "iscsi-targetd", CredentialsFile: viper.GetString("session-chap-credential-file-path")}
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed() {
+		t.Fatalf("expected the rotation to succeed, got %+v", result)
+	}
+	expected := chapSessionCredentials{InUser: "new-user", InPassword: "new-password"}
+	if credentials := secretCredentialsOf(t, kube); credentials != expected {
+		t.Errorf("expected the secret to get the credentials of the file, got %+v", credentials)
+	}
+	expectInitiatorCredentials(t, s, expected)
+}
+
+func TestRotateChapSkipsSharedCredentials(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsFile)
+
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), RotateChapOptions{ProvisionerName: "iscsi-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSkipped(t, result, errCredentialsFileShared)
+	if s.Calls("initiator_set_auth") != 2 {
+		t.Error("expected no credentials to be set")
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+}
+
+func TestRotateChapSkipsStaleCredentialsFile(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsFile)
+	writeChapCredentials(t, "user", "password")
+	session := viper.GetString("session-chap-credential-file-path")
+	writeChapCredentials(t, "new-user", "new-password")
+
+	options := RotateChapOptions{
+		ProvisionerName:        "iscsi-targetd",
+		CredentialsFile:        viper.GetString("session-chap-credential-file-path"),
+		SessionCredentialsFile: session,
+	}
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSkipped(t, result, errCredentialsFileStale)
+	if s.Calls("initiator_set_auth") != 2 {
+		t.Error("expected no credentials to be set")
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+}
+
+func TestRotateChapSharedCredentialsFromFile(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsFile)
+	writeChapCredentials(t, "new-user", "new-password")
+
+	options := RotateChapOptions{
+		ProvisionerName:        "iscsi-targetd",
+		CredentialsFile:        viper.GetString("session-chap-credential-file-path"),
+		SessionCredentialsFile: viper.GetString("session-chap-credential-file-path"),
+	}
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed() {
+		t.Fatalf("expected the rotation to succeed, got %+v", result)
+	}
+	expected := chapSessionCredentials{InUser: "new-user", InPassword: "new-password"}
+	if credentials := secretCredentialsOf(t, kube); credentials != expected {
+		t.Errorf("expected the secret to get the credentials of the file, got %+v", credentials)
+	}
+	expectInitiatorCredentials(t, s, expected)
+}
+
+// expectSkipped fails t unless every initiator and secret of result was
+// skipped with err.
+func expectSkipped(t *testing.T, result *RotateChapResult, err error) {
+	t.Helper()
+	if len(result.Initiators) != 2 || len(result.Secrets) != 1 {
+		t.Fatalf("expected two initiators and one secret to be reported, got %+v", result)
+	}
+	for _, rotation := range result.Initiators {
+		if !errors.Is(rotation.Err, err) {
+			t.Errorf("expected %s to be skipped with %v, got %v", rotation.Initiator, err, rotation.Err)
+		}
+	}
+	if !errors.Is(result.Secrets[0].Err, err) {
+		t.Errorf("expected the secret to be skipped with %v, got %v", err, result.Secrets[0].Err)
+	}
+}
+
+func TestRotateChapDryRun(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+
+	options := RotateChapOptions{ProvisionerName: "iscsi-targetd", DryRun: true}
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Initiators) != 2 || len(result.Secrets) != 1 {
+		t.Errorf("expected two initiators and one secret to be reported, got %+v", result)
+	}
+	if s.Calls("initiator_set_auth") != 2 {
+		t.Error("expected no credentials to be set")
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+}
+
+func TestRotateChapKeepsSecretOfFailedInitiators(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+	s.Inject("initiator_set_auth", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), RotateChapOptions{ProvisionerName: "iscsi-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Failed() {
+		t.Fatal("expected the rotation to fail")
+	}
+	if len(result.Secrets) != 1 || !errors.Is(result.Secrets[0].Err, errInitiatorsFailed) {
+		t.Errorf("expected the secret not to be updated, got %+v", result.Secrets)
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+}
+
+func TestRotateChapRollsBackFailedInitiator(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+	// iqn.a gets the new credentials, iqn.b fails
+	s.Inject("initiator_set_auth", fake.Fault{Times: 1})
+	s.Inject("initiator_set_auth", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), RotateChapOptions{ProvisionerName: "iscsi-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Failed() {
+		t.Fatal("expected the rotation to fail")
+	}
+	if len(result.Initiators) != 2 || !errors.Is(result.Initiators[0].Err, errRolledBack) {
+		t.Errorf("expected iqn.a to be rolled back, got %+v", result.Initiators)
+	}
+	if len(result.Secrets) != 1 || !errors.Is(result.Secrets[0].Err, errInitiatorsFailed) {
+		t.Errorf("expected the secret not to be updated, got %+v", result.Secrets)
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+	expectInitiatorCredentials(t, s, currentCredentials)
+}
+
+func TestRotateChapRollsBackFailedSecret(t *testing.T) {
+	p, s, kube := newRotateTest(t, chapCredentialsGenerated)
+	kube.PrependReactor("update", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("conflict")
+	})
+
+	result, err := RotateChap(context.Background(), kube, p.backends, zap.NewNop(), RotateChapOptions{ProvisionerName: "iscsi-targetd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Secrets) != 1 || result.Secrets[0].Err == nil {
+		t.Errorf("expected the secret update to fail, got %+v", result.Secrets)
+	}
+	for _, rotation := range result.Initiators {
+		if !errors.Is(rotation.Err, errRolledBack) {
+			t.Errorf("expected %s to be rolled back, got %v", rotation.Initiator, rotation.Err)
+		}
+	}
+	if credentials := secretCredentialsOf(t, kube); credentials != currentCredentials {
+		t.Errorf("expected the secret to be kept, got %+v", credentials)
+	}
+	expectInitiatorCredentials(t, s, currentCredentials)
+}
@@ -0,0 +1,230 @@
+package iscsi
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// nodeOperators maps the operators of node selector requirements to those of
+// label requirements.
+var nodeOperators = map[v1.NodeSelectorOperator]selection.Operator{
+	v1.NodeSelectorOpIn:           selection.In,
+	v1.NodeSelectorOpNotIn:        selection.NotIn,
+	v1.NodeSelectorOpExists:       selection.Exists,
+	v1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	v1.NodeSelectorOpGt:           selection.GreaterThan,
+	v1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// labelOperators maps the operators of label requirements to those of node
+// selector requirements.
+var labelOperators = map[selection.Operator]v1.NodeSelectorOperator{
+	selection.In:           v1.NodeSelectorOpIn,
+	selection.Equals:       v1.NodeSelectorOpIn,
+	selection.DoubleEquals: v1.NodeSelectorOpIn,
+	selection.NotIn:        v1.NodeSelectorOpNotIn,
+	selection.NotEquals:    v1.NodeSelectorOpNotIn,
+	selection.Exists:       v1.NodeSelectorOpExists,
+	selection.DoesNotExist: v1.NodeSelectorOpDoesNotExist,
+	selection.GreaterThan:  v1.NodeSelectorOpGt,
+	selection.LessThan:     v1.NodeSelectorOpLt,
+}
+
+// topologySelector returns the nodes allowed by the allowed topologies of a
+// storage class, or nil when all nodes are allowed.
+func topologySelector(terms []v1.TopologySelectorTerm) *v1.NodeSelector {
+	if len(terms) == 0 {
+		return nil
+	}
+	selector := &v1.NodeSelector{}
+	for _, term := range terms {
+		var requirements []v1.NodeSelectorRequirement
+		for _, expression := range term.MatchLabelExpressions {
+			requirements = append(requirements, v1.NodeSelectorRequirement{
+				Key:      expression.Key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   expression.Values,
+			})
+		}
+		selector.NodeSelectorTerms = append(selector.NodeSelectorTerms, v1.NodeSelectorTerm{MatchExpressions: requirements})
+	}
+	return selector
+}
+
+// matchRequirements returns whether set matches all requirements.
+func matchRequirements(requirements []v1.NodeSelectorRequirement, set labels.Set) (bool, error) {
+	for _, requirement := range requirements {
+		op, ok := nodeOperators[requirement.Operator]
+		if !ok {
+			return false, fmt.Errorf("unsupported node selector operator %q", requirement.Operator)
+		}
+		r, err := labels.NewRequirement(requirement.Key, op, requirement.Values)
+		if err != nil {
+			return false, err
+		}
+		if !r.Matches(set) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// nodeMatches returns whether node matches any term of selector, a nil
+// selector matches all nodes.
+func nodeMatches(selector *v1.NodeSelector, node *v1.Node) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	for _, term := range selector.NodeSelectorTerms {
+		// an empty term matches no nodes
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		ok, err := matchRequirements(term.MatchExpressions, labels.Set(node.Labels))
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		ok, err = matchRequirements(term.MatchFields, labels.Set{"metadata.name": node.Name})
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// filterNodes returns the nodes matching selector.
+func filterNodes(selector *v1.NodeSelector, nodes []*v1.Node) ([]*v1.Node, error) {
+	if selector == nil {
+		return nodes, nil
+	}
+	var matching []*v1.Node
+	for _, node := range nodes {
+		ok, err := nodeMatches(selector, node)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matching = append(matching, node)
+		}
+	}
+	return matching, nil
+}
+
+// chooseInitiators resolves the initiators like resolveInitiators, but only
+// from the nodes matching allowed. Static initiators of nodes not matching
+// allowed are left out, static initiators that are not the initiator of any
+// node are kept. The chosen static initiators and the nodes they belong to
+// are returned as well.
+func chooseInitiators(static []string, selector string, nodes []*v1.Node, allowed *v1.NodeSelector) (initiators []string, chosen []string, owners []*v1.Node, err error) {
+	allowedNodes, err := filterNodes(allowed, nodes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	isAllowed := make(map[string]bool)
+	for _, node := range allowedNodes {
+		isAllowed[node.Name] = true
+	}
+	owner := make(map[string]*v1.Node)
+	for _, node := range nodes {
+		if initiator := nodeInitiator(node); initiator != "" {
+			owner[initiator] = node
+		}
+	}
+	for _, initiator := range static {
+		node, ok := owner[initiator]
+		if !ok {
+			chosen = append(chosen, initiator)
+			continue
+		}
+		if isAllowed[node.Name] {
+			chosen = append(chosen, initiator)
+			owners = append(owners, node)
+		}
+	}
+	initiators, err = resolveInitiators(chosen, selector, allowedNodes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return initiators, chosen, owners, nil
+}
+
+// hostname returns the hostname label of a node, which the scheduler matches
+// volume node affinity against.
+func hostname(node *v1.Node) string {
+	if name := node.Labels[v1.LabelHostname]; name != "" {
+		return name
+	}
+	return node.Name
+}
+
+// getNodeAffinity returns the node affinity of a volume exported to the
+// static initiators of owners and the initiators of the nodes matching
+// selector, limited to the nodes matching allowed. Without any nodes to
+// match on the affinity is allowed itself, which is nil when all nodes are
+// allowed. So is the affinity when unowned static initiators, which are not
+// the initiator of any node, were chosen as they can belong to any node.
+func getNodeAffinity(selector string, owners []*v1.Node, unowned bool, allowed *v1.NodeSelector) (*v1.VolumeNodeAffinity, error) {
+	var terms []v1.NodeSelectorTerm
+	if selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid initiatorNodeSelector %q: %w", selector, err)
+		}
+		requirements, _ := s.Requirements()
+		var expressions []v1.NodeSelectorRequirement
+		for _, r := range requirements {
+			expressions = append(expressions, v1.NodeSelectorRequirement{
+				Key:      r.Key(),
+				Operator: labelOperators[r.Operator()],
+				Values:   r.Values().List(),
+			})
+		}
+		// nodes joining later are exported to by the InitiatorController,
+		// so the affinity follows the selector instead of the nodes matching
+		// it now
+		if allowed == nil {
+			terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: expressions})
+		} else {
+			for _, term := range allowed.NodeSelectorTerms {
+				combined := append(append([]v1.NodeSelectorRequirement{}, expressions...), term.MatchExpressions...)
+				terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: combined, MatchFields: term.MatchFields})
+			}
+		}
+	}
+	if len(owners) > 0 {
+		set := make(map[string]bool)
+		var hostnames []string
+		for _, node := range owners {
+			if name := hostname(node); !set[name] {
+				set[name] = true
+				hostnames = append(hostnames, name)
+			}
+		}
+		sort.Strings(hostnames)
+		terms = append(terms, v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{{
+			Key:      v1.LabelHostname,
+			Operator: v1.NodeSelectorOpIn,
+			Values:   hostnames,
+		}}})
+	}
+	if unowned {
+		terms = nil
+	}
+	if len(terms) == 0 {
+		if allowed == nil {
+			return nil, nil
+		}
+		terms = allowed.NodeSelectorTerms
+	}
+	return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: terms}}, nil
+}
@@ -0,0 +1,109 @@
+package iscsi
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetNodeAffinity(t *testing.T) {
+	node := func(name string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{v1.LabelHostname: name}}}
+	}
+	hostnames := func(names ...string) v1.NodeSelectorTerm {
+		return v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{{Key: v1.LabelHostname, Operator: v1.NodeSelectorOpIn, Values: names}}}
+	}
+	storage := v1.NodeSelectorRequirement{Key: "storage", Operator: v1.NodeSelectorOpIn, Values: []string{"iscsi"}}
+	zoneA := v1.NodeSelectorRequirement{Key: "zone", Operator: v1.NodeSelectorOpIn, Values: []string{"a"}}
+	zone := v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{zoneA}}
+	allowed := &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{zone}}
+
+	tests := []struct {
+		name     string
+		selector string
+		owners   []*v1.Node
+		unowned  bool
+		allowed  *v1.NodeSelector
+		expected []v1.NodeSelectorTerm
+	}{
+		{name: "no nodes"},
+		{name: "no nodes with allowed topologies", allowed: allowed, expected: []v1.NodeSelectorTerm{zone}},
+		{name: "owners", owners: []*v1.Node{node("b"), node("a"), node("b")}, expected: []v1.NodeSelectorTerm{hostnames("a", "b")}},
+		{name: "owners and unowned", owners: []*v1.Node{node("a")}, unowned: true},
+		{name: "owners and unowned with allowed topologies", owners: []*v1.Node{node("a")}, unowned: true, allowed: allowed, expected: []v1.NodeSelectorTerm{zone}},
+		{name: "selector and unowned", selector: "storage=iscsi", unowned: true},
+		{name: "selector", selector: "storage=iscsi", expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{storage}}}},
+		{name: "selector with allowed topologies", selector: "storage=iscsi", allowed: allowed, expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{storage, zoneA}}}},
+		{name: "selector and owners", selector: "storage=iscsi", owners: []*v1.Node{node("a")}, expected: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{storage}}, hostnames("a")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			affinity, err := getNodeAffinity(test.selector, test.owners, test.unowned, test.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected == nil {
+				if affinity != nil {
+					t.Errorf("expected no affinity, got %+v", affinity.Required)
+				}
+				return
+			}
+			if affinity == nil || !reflect.DeepEqual(affinity.Required.NodeSelectorTerms, test.expected) {
+				t.Errorf("expected terms %+v, got %+v", test.expected, affinity)
+			}
+		})
+	}
+}
+
+func TestChooseInitiators(t *testing.T) {
+	nodes := []*v1.Node{
+		newNode("a", "iqn.a", map[string]string{"zone": "a", "storage": "iscsi"}),
+		newNode("b", "iqn.b", map[string]string{"zone": "b", "storage": "iscsi"}),
+	}
+	allowed := topologySelector([]v1.TopologySelectorTerm{{
+		MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{{Key: "zone", Values: []string{"a"}}},
+	}})
+
+	initiators, chosen, owners, err := chooseInitiators([]string{"iqn.a", "iqn.b", "iqn.external"}, "storage=iscsi", nodes, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(initiators, ","); got != "iqn.a,iqn.external" {
+		t.Errorf("expected initiators iqn.a,iqn.external, got %s", got)
+	}
+	if got := strings.Join(chosen, ","); got != "iqn.a,iqn.external" {
+		t.Errorf("expected static initiators iqn.a,iqn.external, got %s", got)
+	}
+	if len(owners) != 1 || owners[0].Name != "a" {
+		t.Errorf("expected owner node a, got %v", owners)
+	}
+}
+
+func TestProvisionHonoursAllowedTopologies(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	setNodes(t, p,
+		newNode("a", "iqn.a", map[string]string{"zone": "a", v1.LabelHostname: "a"}),
+		newNode("b", "iqn.b", map[string]string{"zone": "b", v1.LabelHostname: "b"}),
+	)
+	options := provisionOptions("pvc-1", gib, map[string]string{"initiators": "iqn.a,iqn.b"})
+	options.StorageClass.AllowedTopologies = []v1.TopologySelectorTerm{{
+		MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{{Key: "zone", Values: []string{"a"}}},
+	}}
+
+	pv, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports := s.Exports()
+	if len(exports) != 1 || exports[0].InitiatorWwn != "iqn.a" {
+		t.Errorf("expected only the export to iqn.a, got %+v", exports)
+	}
+	expected := []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{{Key: v1.LabelHostname, Operator: v1.NodeSelectorOpIn, Values: []string{"a"}}}}}
+	if pv.Spec.NodeAffinity == nil || !reflect.DeepEqual(pv.Spec.NodeAffinity.Required.NodeSelectorTerms, expected) {
+		t.Errorf("expected affinity to node a, got %+v", pv.Spec.NodeAffinity)
+	}
+}
@@ -0,0 +1,140 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// cloneSource is the filesystem, and optionally the snapshot of it, a new
+// filesystem is cloned from.
+type cloneSource struct {
+	backend    string
+	uuid       string
+	snapshotID string
+	// size is the smallest size a clone can be requested with
+	size resource.Quantity
+}
+
+// getCloneSource returns the source of the claim or snapshot in the data
+// source of the claim being provisioned, or nil when it has no data source.
+func (p *nfsProvisioner) getCloneSource(ctx context.Context, options controller.ProvisionOptions) (*cloneSource, error) {
+	dataSource := options.PVC.Spec.DataSource
+	if dataSource == nil {
+		return nil, nil
+	}
+	switch {
+	case dataSource.Kind == "PersistentVolumeClaim" && (dataSource.APIGroup == nil || *dataSource.APIGroup == ""):
+		return p.getClaimSource(ctx, options, dataSource.Name)
+	case dataSource.Kind == "VolumeSnapshot" && dataSource.APIGroup != nil && *dataSource.APIGroup == SnapshotGroup:
+		return p.getSnapshotSource(ctx, options, dataSource.Name)
+	}
+	return nil, fmt.Errorf("unsupported data source %s %s", dataSource.Kind, dataSource.Name)
+}
+
+func (p *nfsProvisioner) getClaimSource(ctx context.Context, options controller.ProvisionOptions, name string) (*cloneSource, error) {
+	claim, err := p.kube.CoreV1().PersistentVolumeClaims(options.PVC.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source claim %s: %w", name, err)
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("source claim %s is not bound", claim.Name)
+	}
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName != options.StorageClass.Name {
+		return nil, fmt.Errorf("source claim %s does not use storage class %s", claim.Name, options.StorageClass.Name)
+	}
+	volume, err := p.kube.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source volume %s: %w", claim.Spec.VolumeName, err)
+	}
+	if volume.Spec.NFS == nil || volume.Annotations["uuid"] == "" {
+		return nil, fmt.Errorf("source volume %s is not an nfs volume of this provisioner", volume.Name)
+	}
+	return &cloneSource{
+		backend: volume.Annotations["backend"],
+		uuid:    volume.Annotations["uuid"],
+		size:    volume.Spec.Capacity[v1.ResourceStorage],
+	}, nil
+}
+
+func (p *nfsProvisioner) getSnapshotSource(ctx context.Context, options controller.ProvisionOptions, name string) (*cloneSource, error) {
+	if p.dynamic == nil {
+		return nil, errors.New("restoring snapshots is not enabled")
+	}
+	snapshots := schema.GroupVersionResource{Group: SnapshotGroup, Version: p.snapshotAPIVersion, Resource: "volumesnapshots"}
+	contents := schema.GroupVersionResource{Group: SnapshotGroup, Version: p.snapshotAPIVersion, Resource: "volumesnapshotcontents"}
+
+	obj, err := p.dynamic.Resource(snapshots).Namespace(options.PVC.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source snapshot %s: %w", name, err)
+	}
+	var snapshot volumeSnapshot
+	if err := fromUnstructured(obj, &snapshot); err != nil {
+		return nil, err
+	}
+	status := snapshot.Status
+	if status == nil || status.ReadyToUse == nil || !*status.ReadyToUse || status.BoundVolumeSnapshotContentName == nil || status.RestoreSize == nil {
+		return nil, fmt.Errorf("source snapshot %s is not ready to use", name)
+	}
+	obj, err = p.dynamic.Resource(contents).Get(ctx, *status.BoundVolumeSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot content %s: %w", *status.BoundVolumeSnapshotContentName, err)
+	}
+	var content volumeSnapshotContent
+	if err := fromUnstructured(obj, &content); err != nil {
+		return nil, err
+	}
+	if content.Spec.VolumeSnapshotRef.UID != snapshot.UID {
+		return nil, fmt.Errorf("snapshot content %s is not bound to snapshot %s", content.Name, name)
+	}
+	if content.Annotations["uuid"] == "" || content.Status == nil || content.Status.SnapshotHandle == nil {
+		return nil, fmt.Errorf("snapshot content %s was not created by this provisioner", content.Name)
+	}
+	return &cloneSource{
+		backend:    content.Annotations["backend"],
+		uuid:       content.Annotations["uuid"],
+		snapshotID: *content.Status.SnapshotHandle,
+		size:       *status.RestoreSize,
+	}, nil
+}
+
+// cloneVolume creates the filesystem name from source, targetd creates clones
+// in the pool of their source so it must be pool.
+func (p *nfsProvisioner) cloneVolume(ctx context.Context, client *targetd.Client, source *cloneSource, name, pool string) error {
+	log := p.log.With(zap.String("name", name), zap.String("source", source.uuid), zap.String("snapshot", source.snapshotID))
+	filesystems, err := client.FsList(ctx)
+	if err != nil {
+		return err
+	}
+	sourcePool := ""
+	for _, fs := range filesystems {
+		if fs.UUID == source.uuid {
+			sourcePool = fs.Pool
+		}
+	}
+	if sourcePool == "" {
+		return fmt.Errorf("source filesystem %s does not exist", source.uuid)
+	}
+	if sourcePool != pool {
+		return fmt.Errorf("source filesystem %s is in pool %s, not in %s", source.uuid, sourcePool, pool)
+	}
+	log.Debug("cloning volume")
+	err = client.FsClone(ctx, targetd.FsCloneArgs{
+		FsUUID:     source.uuid,
+		DestFsName: name,
+		SnapshotID: source.snapshotID,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debug("cloned volume")
+	return nil
+}
@@ -0,0 +1,125 @@
+package nfs
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// provisionSource provisions pvc-1 with the storage class parameters and
+// registers it with its bound claim claim-pvc-1 in the kube client of p.
+func provisionSource(t *testing.T, p *nfsProvisioner, parameters map[string]string) *v1.PersistentVolume {
+	t.Helper()
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, parameters)
+	pv, _, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := options.PVC.DeepCopy()
+	claim.Spec.StorageClassName = &options.StorageClass.Name
+	claim.Spec.VolumeName = pv.Name
+	claim.Status.Phase = v1.ClaimBound
+	if _, err := p.kube.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.kube.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return pv
+}
+
+// cloneOptions requests pvc-2 of size bytes cloned from the data source.
+func cloneOptions(size int64, parameters map[string]string, dataSource v1.TypedLocalObjectReference) controller.ProvisionOptions {
+	options := provisionOptions("pvc-2", size, parameters)
+	options.PVC.Spec.DataSource = &dataSource
+	return options
+}
+
+var claimSource = v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-pvc-1"}
+
+func TestProvisionClone(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	parameters := map[string]string{"hosts": "10.0.0.1"}
+	provisionSource(t, p, parameters)
+
+	pv, _, err := p.Provision(context.Background(), cloneOptions(gib, parameters, claimSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := s.Calls("fs_clone"); calls != 1 {
+		t.Errorf("expected 1 fs_clone call, got %d", calls)
+	}
+	fs, ok := s.Filesystem("vg-targetd", "pvc-2")
+	if !ok {
+		t.Fatal("expected filesystem pvc-2 to be created")
+	}
+	if pv.Annotations["uuid"] != fs.UUID || pv.Spec.NFS.Path != fs.FullPath {
+		t.Errorf("expected the pv to point to the clone %+v, got %v and %+v", fs, pv.Annotations, pv.Spec.NFS)
+	}
+	if exports := s.NfsExports(); len(exports) != 2 {
+		t.Errorf("expected the clone to be exported, got %+v", exports)
+	}
+}
+
+func TestProvisionCloneLargerThanSource(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+	parameters := map[string]string{"hosts": "10.0.0.1"}
+	provisionSource(t, p, parameters)
+
+	// the clone shares the pool like its source
+	pv, _, err := p.Provision(context.Background(), cloneOptions(2*gib, parameters, claimSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity := pv.Spec.Capacity[v1.ResourceStorage]; capacity.Value() != 2*gib {
+		t.Errorf("expected the requested capacity of %d bytes, got %s", int64(2*gib), capacity.String())
+	}
+}
+
+func TestProvisionCloneRefusesSmallerSize(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	parameters := map[string]string{"hosts": "10.0.0.1"}
+	provisionSource(t, p, parameters)
+
+	if _, _, err := p.Provision(context.Background(), cloneOptions(gib/2, parameters, claimSource)); err == nil {
+		t.Fatal("expected a clone smaller than its source to be refused")
+	}
+	if calls := s.Calls("fs_clone"); calls != 0 {
+		t.Errorf("expected no fs_clone calls, got %d", calls)
+	}
+}
+
+func TestProvisionRestoreSnapshot(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	p := test.provisioner
+	p.dynamic = test.dynamic
+	apiGroup := SnapshotGroup
+	source := v1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: "VolumeSnapshot", Name: "snapshot"}
+
+	pv, _, err := p.Provision(ctx, cloneOptions(gib, map[string]string{"hosts": "10.0.0.1"}, source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, ok := test.server.Filesystem("vg-targetd", "pvc-2")
+	if !ok {
+		t.Fatal("expected filesystem pvc-2 to be restored")
+	}
+	if pv.Annotations["uuid"] != fs.UUID {
+		t.Errorf("expected the pv to point to the restored filesystem %s, got %v", fs.UUID, pv.Annotations)
+	}
+
+	// without the dynamic client snapshots cannot be restored
+	p.dynamic = nil
+	if _, _, err := p.Provision(ctx, cloneOptions(gib, map[string]string{"hosts": "10.0.0.1"}, source)); err == nil {
+		t.Error("expected restoring without snapshot support to fail")
+	}
+}
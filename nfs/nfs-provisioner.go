@@ -2,69 +2,44 @@ package nfs
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/powerman/rpc-codec/jsonrpc2"
+	"go.sonck.nl/targetd-provisioner/capacity"
 	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/transaction"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/util"
 	"strconv"
 	"strings"
 )
 
-type volCreateArgs struct {
-	Pool string `json:"pool_name"`
-	Name string `json:"name"`
-	Size int64  `json:"size_bytes"`
-}
-
-type volDestroyArgs struct {
-	Uuid string `json:"uuid"`
-}
-
-type exportCreateArgs struct {
-	Host    string   `json:"host"`
-	Path    string   `json:"path"`
-	Options []string `json:"options"`
-}
-
-type exportDestroyArgs struct {
-	Host string `json:"host"`
-	Path string `json:"path"`
-}
-
-type volume struct {
-	Name       string `json:"name"`
-	Uuid       string `json:"uuid"`
-	TotalSpace int64  `json:"total_space"`
-	FreeSpace  int64  `json:"free_space"`
-	Pool       string `json:"pool"`
-	FullPath   string `json:"full_path"`
-}
-
-type volumeList []volume
-
 type nfsProvisioner struct {
-	targetdURL string
-	log        *zap.Logger
-}
-
-type export struct {
-	Host    string   `json:"host"`
-	Path    string   `json:"path"`
-	Options []string `json:"options"`
+	kube               kubernetes.Interface
+	dynamic            dynamic.Interface
+	snapshotAPIVersion string
+	backends           *targetd.Backends
+	log                *zap.Logger
+	recorder           record.EventRecorder
 }
 
-type exportList []export
-
-func NewnfsProvisioner(url string, logger *zap.Logger) controller.Provisioner {
+// NewnfsProvisioner creates a new nfs provisioner, claims can only be
+// restored from VolumeSnapshots of version snapshotAPIVersion when
+// dynamicClient is not nil.
+func NewnfsProvisioner(kube kubernetes.Interface, dynamicClient dynamic.Interface, snapshotAPIVersion string, backends *targetd.Backends, recorder record.EventRecorder, logger *zap.Logger) controller.Provisioner {
 	return &nfsProvisioner{
-		targetdURL: url,
-		log:        logger.With(zap.String("system","nfs")),
+		kube:               kube,
+		dynamic:            dynamicClient,
+		snapshotAPIVersion: snapshotAPIVersion,
+		backends:           backends,
+		log:                logger.With(zap.String("system", "nfs")),
+		recorder:           recorder,
 	}
 }
 
@@ -76,12 +51,34 @@ func (p *nfsProvisioner) getAccessModes() []v1.PersistentVolumeAccessMode {
 	}
 }
 
-func (p *nfsProvisioner) Provision(context context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+func (p *nfsProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	if !util.AccessModesContainedInAll(p.getAccessModes(), options.PVC.Spec.AccessModes) {
 		return nil, controller.ProvisioningNoChange, fmt.Errorf("invalid AccessModes %v: only AccessModes %v are supported", options.PVC.Spec.AccessModes, p.getAccessModes())
 	}
 	p.log.Debug("new provision request received for pvc", zap.String("name", options.PVName))
-	vol, _, path, uuid, err := p.createVolume(options)
+	backend, client, err := p.backends.Get(options.StorageClass.Parameters["backend"])
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	source, err := p.getCloneSource(ctx, options)
+	if err != nil {
+		p.log.Warn("failed to get clone source", zap.Error(err))
+		return nil, controller.ProvisioningNoChange, err
+	}
+	if source != nil {
+		sourceBackend, _, err := p.backends.Get(source.backend)
+		if err != nil {
+			return nil, controller.ProvisioningNoChange, err
+		}
+		if sourceBackend != backend {
+			return nil, controller.ProvisioningNoChange, fmt.Errorf("source filesystem %s is on backend %s, not on %s", source.uuid, sourceBackend, backend)
+		}
+		requested := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]
+		if requested.Cmp(source.size) < 0 {
+			return nil, controller.ProvisioningNoChange, fmt.Errorf("requested size %s is smaller than the source size %s", requested.String(), source.size.String())
+		}
+	}
+	vol, _, path, uuid, capacity, err := p.createVolume(ctx, client, options, source)
 	if err != nil {
 		p.log.Warn("failed to create volume", zap.Error(err))
 		return nil, controller.ProvisioningNoChange, err
@@ -89,6 +86,7 @@ func (p *nfsProvisioner) Provision(context context.Context, options controller.P
 	p.log.Debug("volume created", zap.String("volume", vol), zap.String("path", path))
 
 	annotations := make(map[string]string)
+	annotations["backend"] = backend
 	annotations["uuid"] = uuid
 	annotations["hosts"] = options.StorageClass.Parameters["hosts"]
 
@@ -104,7 +102,7 @@ func (p *nfsProvisioner) Provision(context context.Context, options controller.P
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
 			Capacity: v1.ResourceList{
-				v1.ResourceStorage: options.PVC.Spec.Resources.Requests[v1.ResourceStorage],
+				v1.ResourceStorage: capacity,
 			},
 			VolumeMode: options.PVC.Spec.VolumeMode,
 			PersistentVolumeSource: v1.PersistentVolumeSource{
@@ -127,23 +125,21 @@ func getReadOnly(readonly string) bool {
 	return isReadOnly
 }
 
-func (p *nfsProvisioner) Delete(context context.Context, volume *v1.PersistentVolume) error {
+func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	log := p.log.With(zap.String("vol", volume.GetName()), zap.String("uuid", volume.Annotations["uuid"]))
 	log.Debug("volume deletion request")
+	_, client, err := p.backends.Get(volume.Annotations["backend"])
+	if err != nil {
+		return err
+	}
 	for _, host := range strings.Split(volume.Annotations["hosts"], ",") {
 		log := log.With(zap.String("host", host), zap.String("path", volume.Spec.NFS.Path))
 		log.Debug("removing nfs export")
-		err := p.exportDestroy(host, volume.Spec.NFS.Path)
+		err := p.exportDestroy(ctx, client, volume.Spec.NFS.Path, host)
 		if err != nil {
-			var errorInfo targetd.ErrorInfo
-			err2 := json.Unmarshal([]byte(err.Error()), &errorInfo)
-			if err2 != nil {
+			if !errors.Is(err, targetd.NotFoundNfsExport) {
+				log.Warn("failed to destroy nfs export", zap.Error(err))
 				return err
-			}
-
-			if errorInfo.Code != targetd.NotFoundNfsExport {
-				log.Warn("failed to destroy nfs export", zap.Error(errorInfo))
-				return errorInfo
 			} else {
 				log.Warn("nfs export was already removed")
 			}
@@ -151,48 +147,95 @@ func (p *nfsProvisioner) Delete(context context.Context, volume *v1.PersistentVo
 		log.Debug("nfs export removed")
 	}
 	log.Debug("removing filesystem volume")
-	err := p.volDestroy(volume.Annotations["uuid"])
+	err = p.volDestroy(ctx, client, volume.Annotations["uuid"])
 	if err != nil {
-		var errorInfo targetd.ErrorInfo
-		err2 := json.Unmarshal([]byte(err.Error()), &errorInfo)
-		if err2 != nil {
+		if !targetd.IsNotFound(err) {
 			log.Warn("failed to destroy filesystem volume", zap.Error(err))
+			return err
 		}
-		if errorInfo.Code != targetd.NotFoundVolume {
-			log.Warn("failed to destroy filesystem volume", zap.Error(errorInfo))
-		}
+		log.Warn("filesystem volume was already removed")
 	}
 	log.Debug("logical volume removed")
 	log.Debug("volume deletion request completed")
 	return nil
 }
 
-func (p *nfsProvisioner) createVolume(options controller.ProvisionOptions) (vol, pool, path, uuid string, err error) {
+// createVolume creates and exports a filesystem. targetd ignores the size
+// in fs_create, so the filesystem shares its pool with the other filesystems
+// and capacity is only the requested size.
+func (p *nfsProvisioner) createVolume(ctx context.Context, client *targetd.Client, options controller.ProvisionOptions, source *cloneSource) (vol, pool, path, uuid string, capacity resource.Quantity, err error) {
 	vol = p.getVolumeName(options)
 	pool = p.getVolumeGroup(options)
 	hosts := p.getHosts(options)
 	nfsOpts := p.getNfsOptions(options)
+	capacity = options.PVC.Spec.Resources.Requests[v1.ResourceStorage]
 
-	p.log.Debug("creating volume", zap.String("name", vol), zap.String("pool", pool))
-	err = p.volCreate(vol, pool)
-	if err != nil {
-		p.log.Warn("failed to create volume", zap.Error(err))
-		return "", "", "", "", err
+	// every step that completed is undone when a later one fails
+	tx := transaction.New(p.log.With(zap.String("name", vol), zap.String("pool", pool)), p.recorder, options.PVC)
+	defer func() {
+		if err != nil {
+			tx.Rollback(err)
+		}
+	}()
+
+	if source != nil {
+		err = p.cloneVolume(ctx, client, source, vol, pool)
+		if err != nil {
+			p.log.Warn("failed to clone volume", zap.Error(err))
+			return "", "", "", "", capacity, err
+		}
+	} else {
+		err = p.checkCapacity(ctx, client, options, pool, capacity.Value())
+		if err != nil {
+			p.log.Warn("not enough capacity", zap.Error(err))
+			return "", "", "", "", capacity, err
+		}
+		p.log.Debug("creating volume", zap.String("name", vol), zap.String("pool", pool))
+		err = p.volCreate(ctx, client, vol, pool)
+		if err != nil {
+			p.log.Warn("failed to create volume", zap.Error(err))
+			return "", "", "", "", capacity, err
+		}
 	}
+	// the named results are cleared when returning an error, the
+	// compensations keep their own copy
+	name, fsPool := vol, pool
+	tx.Completed("destroy filesystem "+name, func(ctx context.Context) error {
+		fs, err := p.volFind(ctx, client, name, fsPool)
+		if err != nil {
+			return err
+		}
+		err = p.volDestroy(ctx, client, fs.UUID)
+		if targetd.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
 
-	path, uuid, err = p.volFind(vol, pool)
+	fs, err := p.volFind(ctx, client, vol, pool)
 	if err != nil {
 		p.log.Warn("failed to find created volume", zap.Error(err))
-		return "", "", "", "", err
+		return "", "", "", "", capacity, err
 	}
-	p.log.Debug("created volume", zap.String("name", vol), zap.String("pool", pool), zap.String("fullPath", path))
+	path = fs.FullPath
+	uuid = fs.UUID
+	p.log.Debug("created volume", zap.String("name", vol), zap.String("pool", pool), zap.String("fullPath", path), zap.Int64("totalSpace", fs.TotalSpace))
 
 	for _, host := range hosts {
 		p.log.Debug("exporting volume", zap.String("name", vol), zap.String("pool", pool), zap.String("host", host))
-		err = p.exportCreate(path, host, nfsOpts)
+		err = p.exportCreate(ctx, client, path, host, nfsOpts)
 		if err != nil {
-			p.log.Warn("failed to create export", zap.Error(err))
+			p.log.Warn("failed to create export", zap.String("host", host), zap.Error(err))
+			return "", "", "", "", capacity, err
 		}
+		host, path := host, path
+		tx.Completed("remove export of "+path+" to "+host, func(ctx context.Context) error {
+			err := p.exportDestroy(ctx, client, path, host)
+			if errors.Is(err, targetd.NotFoundNfsExport) {
+				return nil
+			}
+			return err
+		})
 	}
 	return
 }
@@ -216,124 +259,62 @@ func (p *nfsProvisioner) getNfsOptions(options controller.ProvisionOptions) []st
 	return strings.Split(options.StorageClass.Parameters["options"], ",")
 }
 
-func (p *nfsProvisioner) volCreate(name, pool string) error {
-	client, err := p.getConnection()
-	defer client.Close()
+// checkCapacity refuses a filesystem of size bytes in pool when it does not
+// have them left. The filesystem reserves nothing, but it could not hold the
+// requested size.
+func (p *nfsProvisioner) checkCapacity(ctx context.Context, client *targetd.Client, options controller.ProvisionOptions, pool string, size int64) error {
+	ratio, err := capacity.GetOvercommitRatio(options.StorageClass.Parameters)
 	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
 		return err
 	}
-	args := volCreateArgs{
-		Pool: pool,
-		Name: name,
-		Size: 0,
+	err = capacity.Check(ctx, client, pool, size, ratio)
+	if errors.Is(err, capacity.ErrInsufficient) {
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "InsufficientCapacity", err.Error())
 	}
-	err = client.Call("fs_create", args, nil)
 	return err
 }
 
-func (p *nfsProvisioner) volFind(name, pool string) (path, uuid string, err error) {
-	volumeList, err := p.volList()
+func (p *nfsProvisioner) volCreate(ctx context.Context, client *targetd.Client, name, pool string) error {
+	return client.FsCreate(ctx, targetd.FsCreateArgs{
+		PoolName:  pool,
+		Name:      name,
+		SizeBytes: 0,
+	})
+}
+
+func (p *nfsProvisioner) volFind(ctx context.Context, client *targetd.Client, name, pool string) (targetd.Filesystem, error) {
+	volumeList, err := client.FsList(ctx)
 	if err != nil {
 		p.log.Warn("failed to get volumes", zap.Error(err))
+		return targetd.Filesystem{}, err
 	}
 	for _, volume := range volumeList {
 		if volume.Pool == pool && volume.Name == name {
-			path = volume.FullPath
-			uuid = volume.Uuid
-			return
+			return volume, nil
 		}
 	}
-	return "", "", errors.New("failed to find the created volume")
+	return targetd.Filesystem{}, errors.New("failed to find the created volume")
 }
 
-func (p *nfsProvisioner) volDestroy(uuid string) error {
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
-	}
-	args := volDestroyArgs{
-		Uuid: uuid,
-	}
-	err = client.Call("fs_destroy", args, nil)
-	return err
+func (p *nfsProvisioner) volDestroy(ctx context.Context, client *targetd.Client, uuid string) error {
+	return client.FsDestroy(ctx, targetd.FsDestroyArgs{
+		UUID: uuid,
+	})
 }
 
-func (p *nfsProvisioner) exportCreate(fullPath, host string, nfsOptions []string) error {
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
-		return err
-	}
-	args := exportCreateArgs{
+func (p *nfsProvisioner) exportCreate(ctx context.Context, client *targetd.Client, fullPath, host string, nfsOptions []string) error {
+	return client.NfsExportAdd(ctx, targetd.NfsExportAddArgs{
 		Host:    host,
 		Path:    fullPath,
 		Options: nfsOptions,
-	}
-	err = client.Call("nfs_export_add", args, nil)
-	return err
+	})
 }
 
-func (p *nfsProvisioner) exportDestroy(fullPath, host string) error {
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
-		return err
-	}
-	args := exportDestroyArgs{
+func (p *nfsProvisioner) exportDestroy(ctx context.Context, client *targetd.Client, fullPath, host string) error {
+	return client.NfsExportRemove(ctx, targetd.NfsExportRemoveArgs{
 		Host: host,
 		Path: fullPath,
-	}
-	err = client.Call("nfs_export_remove", args, nil)
-	return err
-}
-
-func (p *nfsProvisioner) volList() (volumeList, error) {
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
-		return nil, err
-	}
-	var result1 volumeList
-	err = client.Call("fs_list", nil, &result1)
-	if err != nil {
-		p.log.Warn("failed to get fs_list", zap.Error(err))
-		return nil, err
-	}
-	return result1, err
-}
-
-func (p *nfsProvisioner) exportList() (exportList, error) {
-	client, err := p.getConnection()
-	defer client.Close()
-	if err != nil {
-		p.log.Warn("failed to get connection", zap.Error(err))
-		return nil, err
-	}
-	var result1 exportList
-	err = client.Call("nfs_export_list", nil, &result1)
-	if err != nil {
-		p.log.Warn("failed to get nfs_export_list", zap.Error(err))
-		return nil, err
-	}
-	return result1, nil
-}
-
-func (p *nfsProvisioner) getConnection() (*jsonrpc2.Client, error) {
-	log := p.log.With(zap.String("url", p.targetdURL))
-	log.Debug("opening connection to targetd")
-
-	client := jsonrpc2.NewHTTPClient(p.targetdURL)
-	if client == nil {
-		p.log.Warn("error creating the connection to targetd", zap.String("url", p.targetdURL))
-		return nil, errors.New("error creating the connection to targetd")
-	}
-	log.Debug("targetd client created")
-	return client, nil
+	})
 }
 
 func (p *nfsProvisioner) SupportsBlock() bool {
@@ -0,0 +1,228 @@
+package nfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+const gib = 1 << 30
+
+// newTestProvisioner returns a provisioner talking to a fake targetd with a
+// 10 GiB filesystem pool vg-targetd.
+func newTestProvisioner(t *testing.T) (*nfsProvisioner, *fake.Server) {
+	s := fake.NewServer()
+	t.Cleanup(s.Close)
+	s.AddFsPool("vg-targetd", 10*gib)
+	client, err := targetd.NewClient(s.URL, zap.NewNop(), targetd.Retry(targetd.RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	backends, err := targetd.NewBackends("default", map[string]*targetd.Client{"default": client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &nfsProvisioner{
+		kube:               kubefake.NewSimpleClientset(),
+		snapshotAPIVersion: DefaultSnapshotAPIVersion,
+		backends:           backends,
+		log:                zap.NewNop(),
+		recorder:           record.NewFakeRecorder(100),
+	}
+	return p, s
+}
+
+// provisionOptions requests a filesystem of size bytes with the storage
+// class parameters.
+func provisionOptions(name string, size int64, parameters map[string]string) controller.ProvisionOptions {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	return controller.ProvisionOptions{
+		StorageClass: &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "nfs"},
+			Provisioner:   "nfs-targetd",
+			ReclaimPolicy: &reclaimPolicy,
+			Parameters:    parameters,
+		},
+		PVName: name,
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "claim-" + name, Namespace: "default"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI)},
+				},
+			},
+		},
+	}
+}
+
+func TestProvisionAndDelete(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	options := provisionOptions("pvc-1", gib, map[string]string{
+		"host":    "192.168.1.1",
+		"hosts":   "10.0.0.1,10.0.0.2",
+		"options": "rw,no_root_squash",
+	})
+
+	pv, state, err := p.Provision(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != controller.ProvisioningFinished {
+		t.Errorf("expected state %v, got %v", controller.ProvisioningFinished, state)
+	}
+	fs, ok := s.Filesystem("vg-targetd", "pvc-1")
+	if !ok {
+		t.Fatal("expected filesystem pvc-1 to be created")
+	}
+	if pv.Spec.NFS.Server != "192.168.1.1" || pv.Spec.NFS.Path != fs.FullPath {
+		t.Errorf("expected %s:%s, got %+v", "192.168.1.1", fs.FullPath, pv.Spec.NFS)
+	}
+	if pv.Annotations["uuid"] != fs.UUID || pv.Annotations["backend"] != "default" {
+		t.Errorf("unexpected annotations %v", pv.Annotations)
+	}
+	exports := s.NfsExports()
+	if len(exports) != 2 {
+		t.Fatalf("expected 2 nfs exports, got %+v", exports)
+	}
+	for i, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		if exports[i].Host != host || exports[i].Path != fs.FullPath {
+			t.Errorf("expected export of %s to %s, got %+v", fs.FullPath, host, exports[i])
+		}
+		if strings.Join(exports[i].Options, ",") != "rw,no_root_squash" {
+			t.Errorf("expected options rw,no_root_squash, got %v", exports[i].Options)
+		}
+	}
+
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Filesystem("vg-targetd", "pvc-1"); ok {
+		t.Error("expected filesystem pvc-1 to be removed")
+	}
+	// a second delete finds everything already removed
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Errorf("expected deleting twice to succeed, got %v", err)
+	}
+}
+
+// TestDeleteRemovesExports guards against passing host and path swapped to
+// nfs_export_remove, which targetd answers with NotFoundNfsExport and Delete
+// took for an export that was already removed.
+func TestDeleteRemovesExports(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	pv, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"hosts": "10.0.0.1,10.0.0.2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an export of another filesystem to the same host is kept
+	other, _, err := p.Provision(ctx, provisionOptions("pvc-2", gib, map[string]string{"hosts": "10.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Delete(ctx, pv); err != nil {
+		t.Fatal(err)
+	}
+	exports := s.NfsExports()
+	if len(exports) != 1 || exports[0].Path != other.Spec.NFS.Path || exports[0].Host != "10.0.0.1" {
+		t.Errorf("expected only the export of %s to 10.0.0.1 to be left, got %+v", other.Spec.NFS.Path, exports)
+	}
+}
+
+func TestProvisionRejectsInvalidAccessModes(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	options := provisionOptions("pvc-1", gib, map[string]string{"hosts": "10.0.0.1"})
+	options.PVC.Spec.AccessModes = []v1.PersistentVolumeAccessMode{"ReadWriteSometimes"}
+
+	if _, _, err := p.Provision(context.Background(), options); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("fs_create"); calls != 0 {
+		t.Errorf("expected no fs_create calls, got %d", calls)
+	}
+}
+
+func TestProvisionSharesPool(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	pv, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", gib, map[string]string{"hosts": "10.0.0.1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, ok := s.Filesystem("vg-targetd", "pvc-1")
+	if !ok {
+		t.Fatal("expected filesystem pvc-1 to be created")
+	}
+	if fs.TotalSpace != 10*gib {
+		t.Errorf("expected filesystem pvc-1 sharing the pool, got %+v", fs)
+	}
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	if capacity.Value() != gib {
+		t.Errorf("expected the requested capacity of %d bytes, got %s", int64(gib), capacity.String())
+	}
+}
+
+func TestProvisionRollsBackFailedExport(t *testing.T) {
+	p, s := newTestProvisioner(t)
+	ctx := context.Background()
+	// the second export fails after the first one was added
+	s.Inject("nfs_export_add", fake.Fault{Times: 1})
+	s.Inject("nfs_export_add", fake.Fault{Code: targetd.InvalidArgument, Message: "Invalid argument", Times: 1})
+
+	_, _, err := p.Provision(ctx, provisionOptions("pvc-1", gib, map[string]string{"hosts": "10.0.0.1,10.0.0.2"}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("nfs_export_add"); calls != 2 {
+		t.Errorf("expected 2 nfs_export_add calls, got %d", calls)
+	}
+	if _, ok := s.Filesystem("vg-targetd", "pvc-1"); ok {
+		t.Error("expected filesystem pvc-1 to be removed")
+	}
+	if exports := s.NfsExports(); len(exports) != 0 {
+		t.Errorf("expected nfs exports to be removed, got %+v", exports)
+	}
+}
+
+func TestProvisionInsufficientCapacity(t *testing.T) {
+	p, s := newTestProvisioner(t)
+
+	_, _, err := p.Provision(context.Background(), provisionOptions("pvc-1", 20*gib, map[string]string{"hosts": "10.0.0.1"}))
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if calls := s.Calls("fs_create"); calls != 0 {
+		t.Errorf("expected no fs_create calls, got %d", calls)
+	}
+	select {
+	case event := <-p.recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, "InsufficientCapacity") {
+			t.Errorf("expected an InsufficientCapacity event, got %q", event)
+		}
+	default:
+		t.Error("expected an InsufficientCapacity event")
+	}
+}
+
+func TestProvisionOvercommitsPool(t *testing.T) {
+	p, _ := newTestProvisioner(t)
+
+	options := provisionOptions("pvc-1", 20*gib, map[string]string{"hosts": "10.0.0.1", "overcommitRatio": "2"})
+	if _, _, err := p.Provision(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+}
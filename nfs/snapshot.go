@@ -0,0 +1,595 @@
+package nfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// SnapshotGroup is the api group of the VolumeSnapshot resources
+	SnapshotGroup = "snapshot.storage.k8s.io"
+	// DefaultSnapshotAPIVersion is the version of the VolumeSnapshot resources
+	DefaultSnapshotAPIVersion = "v1beta1"
+
+	// snapshotFinalizer keeps a VolumeSnapshotContent until its targetd
+	// snapshot is removed
+	snapshotFinalizer = "targetd.sonck.nl/snapshot-protection"
+	// annProvisionedBy is set on every PersistentVolume by the provision controller
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
+	snapshotKeyPrefix = "snapshot/"
+	contentKeyPrefix  = "content/"
+
+	// contentNamePrefix is prepended to the uid of a VolumeSnapshot to name
+	// its content, the snapshot-controller names its own snapcontent-<uid>
+	contentNamePrefix = "targetd-snapcontent-"
+)
+
+// volumeSnapshot mirrors the fields of a VolumeSnapshot used by this controller.
+type volumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		Source struct {
+			PersistentVolumeClaimName *string `json:"persistentVolumeClaimName,omitempty"`
+			VolumeSnapshotContentName *string `json:"volumeSnapshotContentName,omitempty"`
+		} `json:"source"`
+		VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+	} `json:"spec"`
+	Status *volumeSnapshotStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotStatus struct {
+	BoundVolumeSnapshotContentName *string            `json:"boundVolumeSnapshotContentName,omitempty"`
+	CreationTime                   *metav1.Time       `json:"creationTime,omitempty"`
+	ReadyToUse                     *bool              `json:"readyToUse,omitempty"`
+	RestoreSize                    *resource.Quantity `json:"restoreSize,omitempty"`
+	Error                          *snapshotError     `json:"error,omitempty"`
+}
+
+type snapshotError struct {
+	Time    *metav1.Time `json:"time,omitempty"`
+	Message *string      `json:"message,omitempty"`
+}
+
+// volumeSnapshotClass mirrors the fields of a VolumeSnapshotClass.
+type volumeSnapshotClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Driver            string `json:"driver"`
+	DeletionPolicy    string `json:"deletionPolicy"`
+}
+
+// volumeSnapshotContent mirrors the fields of a VolumeSnapshotContent.
+type volumeSnapshotContent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              struct {
+		VolumeSnapshotRef v1.ObjectReference `json:"volumeSnapshotRef"`
+		DeletionPolicy    string             `json:"deletionPolicy"`
+		Driver            string             `json:"driver"`
+		Source            struct {
+			VolumeHandle   *string `json:"volumeHandle,omitempty"`
+			SnapshotHandle *string `json:"snapshotHandle,omitempty"`
+		} `json:"source"`
+		VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+	} `json:"spec"`
+	Status *volumeSnapshotContentStatus `json:"status,omitempty"`
+}
+
+type volumeSnapshotContentStatus struct {
+	SnapshotHandle *string `json:"snapshotHandle,omitempty"`
+	CreationTime   *int64  `json:"creationTime,omitempty"`
+	RestoreSize    *int64  `json:"restoreSize,omitempty"`
+	ReadyToUse     *bool   `json:"readyToUse,omitempty"`
+}
+
+// SnapshotController creates targetd snapshots for VolumeSnapshots of nfs
+// volumes whose VolumeSnapshotClass names this provisioner as driver, and
+// removes them again together with their VolumeSnapshotContent.
+//
+// The content of a snapshot carries the backend and uuid annotations of the
+// snapshotted filesystem, its snapshot handle is the uuid of the targetd
+// snapshot.
+//
+// The controller takes the place of the snapshot-controller of
+// external-snapshotter, which must not run in the cluster: it handles every
+// VolumeSnapshot whatever its driver and would bind the snapshots of this
+// provisioner to contents of its own. Snapshots already bound to another
+// content are left alone.
+type SnapshotController struct {
+	client          kubernetes.Interface
+	dynamic         dynamic.Interface
+	backends        *targetd.Backends
+	provisionerName string
+	log             *zap.Logger
+
+	snapshotResource schema.GroupVersionResource
+	contentResource  schema.GroupVersionResource
+	classResource    schema.GroupVersionResource
+
+	claims    corelisters.PersistentVolumeClaimLister
+	volumes   corelisters.PersistentVolumeLister
+	snapshots cache.GenericLister
+	contents  cache.GenericLister
+	classes   cache.GenericLister
+	synced    []cache.InformerSynced
+	queue     workqueue.RateLimitingInterface
+	recorder  record.EventRecorder
+}
+
+// NewSnapshotController creates a controller handling the VolumeSnapshots of
+// provisionerName using version apiVersion of the snapshot api. The caller
+// starts the informers of factory and dynamicFactory.
+func NewSnapshotController(client kubernetes.Interface, dynamicClient dynamic.Interface, backends *targetd.Backends, provisionerName, apiVersion string, factory informers.SharedInformerFactory, dynamicFactory dynamicinformer.DynamicSharedInformerFactory, recorder record.EventRecorder, logger *zap.Logger) *SnapshotController {
+	claims := factory.Core().V1().PersistentVolumeClaims()
+	volumes := factory.Core().V1().PersistentVolumes()
+
+	c := &SnapshotController{
+		client:           client,
+		dynamic:          dynamicClient,
+		backends:         backends,
+		provisionerName:  provisionerName,
+		log:              logger.With(zap.String("system", "nfs-snapshot")),
+		snapshotResource: schema.GroupVersionResource{Group: SnapshotGroup, Version: apiVersion, Resource: "volumesnapshots"},
+		contentResource:  schema.GroupVersionResource{Group: SnapshotGroup, Version: apiVersion, Resource: "volumesnapshotcontents"},
+		classResource:    schema.GroupVersionResource{Group: SnapshotGroup, Version: apiVersion, Resource: "volumesnapshotclasses"},
+		claims:           claims.Lister(),
+		volumes:          volumes.Lister(),
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nfs-snapshot"),
+		recorder:         recorder,
+	}
+	snapshots := dynamicFactory.ForResource(c.snapshotResource)
+	contents := dynamicFactory.ForResource(c.contentResource)
+	classes := dynamicFactory.ForResource(c.classResource)
+	c.snapshots = snapshots.Lister()
+	c.contents = contents.Lister()
+	c.classes = classes.Lister()
+	c.synced = []cache.InformerSynced{
+		claims.Informer().HasSynced,
+		volumes.Informer().HasSynced,
+		snapshots.Informer().HasSynced,
+		contents.Informer().HasSynced,
+		classes.Informer().HasSynced,
+	}
+
+	snapshots.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(snapshotKeyPrefix, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(snapshotKeyPrefix, obj) },
+		DeleteFunc: c.enqueueSnapshotContent,
+	})
+	contents.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: c.isOwnContent,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.enqueue(contentKeyPrefix, obj) },
+			UpdateFunc: func(_, obj interface{}) { c.enqueue(contentKeyPrefix, obj) },
+		},
+	})
+	return c
+}
+
+// isOwnContent returns whether obj is a VolumeSnapshotContent of this
+// provisioner. The snapshots are filtered on the driver of their class when
+// they are synced, as the class may not be cached yet.
+func (c *SnapshotController) isOwnContent(obj interface{}) bool {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+	var content volumeSnapshotContent
+	if err := fromUnstructured(u, &content); err != nil {
+		return false
+	}
+	return content.Spec.Driver == c.provisionerName
+}
+
+func (c *SnapshotController) enqueue(prefix string, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(prefix + key)
+}
+
+// enqueueSnapshotContent enqueues the content bound to a deleted snapshot.
+func (c *SnapshotController) enqueueSnapshotContent(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var snapshot volumeSnapshot
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &snapshot); err != nil {
+		return
+	}
+	if snapshot.Status != nil && snapshot.Status.BoundVolumeSnapshotContentName != nil {
+		c.queue.Add(contentKeyPrefix + *snapshot.Status.BoundVolumeSnapshotContentName)
+	}
+}
+
+// Run processes snapshots until ctx is done.
+func (c *SnapshotController) Run(ctx context.Context) {
+	defer c.queue.ShutDown()
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		c.log.Warn("failed to sync caches")
+		return
+	}
+	c.log.Debug("snapshot controller started")
+	go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	<-ctx.Done()
+	c.log.Debug("snapshot controller stopped")
+}
+
+func (c *SnapshotController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *SnapshotController) processNextItem(ctx context.Context) bool {
+	item, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	var err error
+	switch {
+	case len(key) > len(snapshotKeyPrefix) && key[:len(snapshotKeyPrefix)] == snapshotKeyPrefix:
+		err = c.syncSnapshot(ctx, key[len(snapshotKeyPrefix):])
+	case len(key) > len(contentKeyPrefix) && key[:len(contentKeyPrefix)] == contentKeyPrefix:
+		err = c.syncContent(ctx, key[len(contentKeyPrefix):])
+	}
+	if err != nil {
+		c.log.Warn("failed to sync", zap.String("key", key), zap.Error(err))
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	c.queue.Forget(item)
+	return true
+}
+
+// getClass returns the snapshot class name when its driver is this provisioner.
+func (c *SnapshotController) getClass(name *string) (*volumeSnapshotClass, bool) {
+	if name == nil {
+		return nil, false
+	}
+	obj, err := c.classes.Get(*name)
+	if err != nil {
+		return nil, false
+	}
+	var class volumeSnapshotClass
+	if err := fromUnstructured(obj, &class); err != nil {
+		return nil, false
+	}
+	return &class, class.Driver == c.provisionerName
+}
+
+// syncSnapshot creates the targetd snapshot and content of a VolumeSnapshot
+// and reports it ready to use.
+func (c *SnapshotController) syncSnapshot(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	obj, err := c.snapshots.ByNamespace(namespace).Get(name)
+	if err != nil {
+		// the snapshot was deleted
+		return nil
+	}
+	var snapshot volumeSnapshot
+	if err := fromUnstructured(obj, &snapshot); err != nil {
+		return err
+	}
+	class, ok := c.getClass(snapshot.Spec.VolumeSnapshotClassName)
+	if !ok || snapshot.DeletionTimestamp != nil || snapshot.Spec.Source.PersistentVolumeClaimName == nil {
+		return nil
+	}
+	if snapshot.Status != nil && snapshot.Status.ReadyToUse != nil && *snapshot.Status.ReadyToUse {
+		return nil
+	}
+	log := c.log.With(zap.String("snapshot", key))
+	contentName := contentNamePrefix + string(snapshot.UID)
+	if snapshot.Status != nil && snapshot.Status.BoundVolumeSnapshotContentName != nil && *snapshot.Status.BoundVolumeSnapshotContentName != contentName {
+		log.Warn("snapshot is bound to a content of another controller", zap.String("content", *snapshot.Status.BoundVolumeSnapshotContentName))
+		c.recorder.Eventf(obj, v1.EventTypeWarning, "SnapshotBoundElsewhere", "snapshot is bound to content %s of another controller, the snapshot-controller of external-snapshotter must not run next to %s", *snapshot.Status.BoundVolumeSnapshotContentName, c.provisionerName)
+		return nil
+	}
+
+	claim, err := c.claims.PersistentVolumeClaims(namespace).Get(*snapshot.Spec.Source.PersistentVolumeClaimName)
+	if err != nil {
+		return c.snapshotFailed(ctx, obj, fmt.Errorf("failed to get claim %s: %w", *snapshot.Spec.Source.PersistentVolumeClaimName, err))
+	}
+	if claim.Spec.VolumeName == "" {
+		return c.snapshotFailed(ctx, obj, fmt.Errorf("claim %s is not bound", claim.Name))
+	}
+	volume, err := c.volumes.Get(claim.Spec.VolumeName)
+	if err != nil {
+		return c.snapshotFailed(ctx, obj, fmt.Errorf("failed to get volume %s: %w", claim.Spec.VolumeName, err))
+	}
+	if volume.Annotations[annProvisionedBy] != c.provisionerName || volume.Annotations["uuid"] == "" {
+		return c.snapshotFailed(ctx, obj, fmt.Errorf("volume %s was not provisioned by %s", volume.Name, c.provisionerName))
+	}
+	backend, client, err := c.backends.Get(volume.Annotations["backend"])
+	if err != nil {
+		return c.snapshotFailed(ctx, obj, err)
+	}
+
+	fsUUID := volume.Annotations["uuid"]
+	ssName := "snapshot-" + string(snapshot.UID)
+	ss, err := c.createSnapshot(ctx, client, fsUUID, ssName)
+	if err != nil {
+		c.recorder.Eventf(obj, v1.EventTypeWarning, "SnapshotCreationFailed", "failed to create snapshot: %v", err)
+		return err
+	}
+	log.Info("snapshot created", zap.String("uuid", fsUUID), zap.String("ss_uuid", ss.UUID))
+
+	restoreSize := volume.Spec.Capacity[v1.ResourceStorage]
+	creationTime := time.Unix(ss.Timestamp, 0)
+	err = c.createContent(ctx, contentName, &snapshot, class, backend, fsUUID, ss.UUID, creationTime, restoreSize)
+	if err != nil {
+		return err
+	}
+
+	ready := true
+	snapshot.Status = &volumeSnapshotStatus{
+		BoundVolumeSnapshotContentName: &contentName,
+		CreationTime:                   &metav1.Time{Time: creationTime},
+		ReadyToUse:                     &ready,
+		RestoreSize:                    &restoreSize,
+	}
+	err = c.updateSnapshotStatus(ctx, obj, snapshot.Status)
+	if err != nil {
+		return err
+	}
+	c.recorder.Eventf(obj, v1.EventTypeNormal, "SnapshotReady", "snapshot %s of volume %s is ready to use", ss.Name, volume.Name)
+	return nil
+}
+
+// createSnapshot creates the targetd snapshot name of a filesystem, or
+// returns it when it was created before.
+func (c *SnapshotController) createSnapshot(ctx context.Context, client *targetd.Client, fsUUID, name string) (targetd.Snapshot, error) {
+	find := func() (targetd.Snapshot, bool, error) {
+		snapshots, err := client.FsSnapshotList(ctx, targetd.FsSnapshotListArgs{FsUUID: fsUUID})
+		if err != nil {
+			return targetd.Snapshot{}, false, err
+		}
+		for _, ss := range snapshots {
+			if ss.Name == name {
+				return ss, true, nil
+			}
+		}
+		return targetd.Snapshot{}, false, nil
+	}
+	ss, found, err := find()
+	if err != nil || found {
+		return ss, err
+	}
+	err = client.FsSnapshot(ctx, targetd.FsSnapshotArgs{FsUUID: fsUUID, DestSsName: name})
+	if err != nil {
+		return targetd.Snapshot{}, err
+	}
+	ss, found, err = find()
+	if err == nil && !found {
+		err = errors.New("failed to find the created snapshot")
+	}
+	return ss, err
+}
+
+func (c *SnapshotController) createContent(ctx context.Context, name string, snapshot *volumeSnapshot, class *volumeSnapshotClass, backend, fsUUID, ssUUID string, creationTime time.Time, restoreSize resource.Quantity) error {
+	var content volumeSnapshotContent
+	content.APIVersion = c.contentResource.GroupVersion().String()
+	content.Kind = "VolumeSnapshotContent"
+	content.Name = name
+	content.Annotations = map[string]string{
+		"backend": backend,
+		"uuid":    fsUUID,
+	}
+	content.Finalizers = []string{snapshotFinalizer}
+	content.Spec.VolumeSnapshotRef = v1.ObjectReference{
+		APIVersion: c.snapshotResource.GroupVersion().String(),
+		Kind:       "VolumeSnapshot",
+		Namespace:  snapshot.Namespace,
+		Name:       snapshot.Name,
+		UID:        snapshot.UID,
+	}
+	content.Spec.DeletionPolicy = class.DeletionPolicy
+	content.Spec.Driver = c.provisionerName
+	content.Spec.Source.VolumeHandle = &fsUUID
+	content.Spec.VolumeSnapshotClassName = &class.Name
+
+	obj, err := toUnstructured(&content)
+	if err != nil {
+		return err
+	}
+	created, err := c.dynamic.Resource(c.contentResource).Create(ctx, obj, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		created, err = c.dynamic.Resource(c.contentResource).Get(ctx, name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot content: %w", err)
+	}
+
+	ready := true
+	nanos := creationTime.UnixNano()
+	size := restoreSize.Value()
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&volumeSnapshotContentStatus{
+		SnapshotHandle: &ssUUID,
+		CreationTime:   &nanos,
+		RestoreSize:    &size,
+		ReadyToUse:     &ready,
+	})
+	if err != nil {
+		return err
+	}
+	created.Object["status"] = status
+	_, err = c.dynamic.Resource(c.contentResource).UpdateStatus(ctx, created, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update snapshot content status: %w", err)
+	}
+	return nil
+}
+
+func (c *SnapshotController) updateSnapshotStatus(ctx context.Context, obj runtime.Object, status *volumeSnapshotStatus) error {
+	u := obj.(*unstructured.Unstructured).DeepCopy()
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return err
+	}
+	u.Object["status"] = value
+	_, err = c.dynamic.Resource(c.snapshotResource).Namespace(u.GetNamespace()).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// snapshotFailed records err on the snapshot and returns it, so the snapshot
+// is retried with the backoff of the queue. The status is only written when
+// the error changed, writing it triggers another sync.
+func (c *SnapshotController) snapshotFailed(ctx context.Context, obj runtime.Object, err error) error {
+	message := err.Error()
+	var snapshot volumeSnapshot
+	if convertErr := fromUnstructured(obj, &snapshot); convertErr != nil {
+		return convertErr
+	}
+	if status := snapshot.Status; status != nil && status.Error != nil && status.Error.Message != nil && *status.Error.Message == message {
+		return err
+	}
+	c.recorder.Eventf(obj, v1.EventTypeWarning, "SnapshotCreationFailed", "%v", err)
+	now := metav1.Now()
+	ready := false
+	updateErr := c.updateSnapshotStatus(ctx, obj, &volumeSnapshotStatus{
+		ReadyToUse: &ready,
+		Error: &snapshotError{
+			Time:    &now,
+			Message: &message,
+		},
+	})
+	if updateErr != nil {
+		return updateErr
+	}
+	return err
+}
+
+// syncContent deletes a content whose snapshot is gone and removes the
+// targetd snapshot of a deleted content.
+func (c *SnapshotController) syncContent(ctx context.Context, name string) error {
+	obj, err := c.contents.Get(name)
+	if err != nil {
+		return nil
+	}
+	var content volumeSnapshotContent
+	if err := fromUnstructured(obj, &content); err != nil {
+		return err
+	}
+	if content.Spec.Driver != c.provisionerName {
+		return nil
+	}
+	log := c.log.With(zap.String("content", name))
+
+	if content.DeletionTimestamp == nil {
+		ref := content.Spec.VolumeSnapshotRef
+		snapshot, err := c.snapshots.ByNamespace(ref.Namespace).Get(ref.Name)
+		if err == nil && snapshot.(metav1.Object).GetUID() == ref.UID {
+			return nil
+		}
+		if content.Spec.DeletionPolicy != "Delete" {
+			return nil
+		}
+		log.Debug("snapshot was deleted, deleting content")
+		err = c.dynamic.Resource(c.contentResource).Delete(ctx, name, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !hasFinalizer(&content.ObjectMeta, snapshotFinalizer) {
+		return nil
+	}
+	if content.Spec.DeletionPolicy == "Delete" && content.Status != nil && content.Status.SnapshotHandle != nil {
+		_, client, err := c.backends.Get(content.Annotations["backend"])
+		if err != nil {
+			return err
+		}
+		err = client.FsSnapshotDelete(ctx, targetd.FsSnapshotDeleteArgs{
+			FsUUID: content.Annotations["uuid"],
+			SsUUID: *content.Status.SnapshotHandle,
+		})
+		if err != nil && !targetd.IsNotFound(err) {
+			return err
+		}
+		log.Info("snapshot deleted", zap.String("uuid", content.Annotations["uuid"]), zap.String("ss_uuid", *content.Status.SnapshotHandle))
+	}
+
+	finalizers := make([]string, 0, len(content.Finalizers))
+	for _, finalizer := range content.Finalizers {
+		if finalizer != snapshotFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": content.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamic.Resource(c.contentResource).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func hasFinalizer(meta *metav1.ObjectMeta, finalizer string) bool {
+	for _, f := range meta.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func fromUnstructured(obj runtime.Object, into interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object %T", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, into)
+}
+
+func toUnstructured(obj interface{}) (*unstructured.Unstructured, error) {
+	value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: value}, nil
+}
@@ -0,0 +1,330 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.sonck.nl/targetd-provisioner/targetd/fake"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// snapshotTest is a snapshot controller with a provisioned filesystem pvc-1
+// bound to claim default/claim-pvc-1 and a snapshot class targetd.
+type snapshotTest struct {
+	*SnapshotController
+	provisioner    *nfsProvisioner
+	server         *fake.Server
+	dynamic        *dynamicfake.FakeDynamicClient
+	dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	recorder       *record.FakeRecorder
+	volume         *v1.PersistentVolume
+}
+
+func newSnapshotTest(t *testing.T) *snapshotTest {
+	p, s := newTestProvisioner(t)
+	options := provisionOptions("pvc-1", gib, map[string]string{"hosts": "10.0.0.1"})
+	pv, _, err := p.Provision(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv.Annotations[annProvisionedBy] = "nfs-targetd"
+	claim := options.PVC.DeepCopy()
+	claim.Spec.VolumeName = pv.Name
+
+	class := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion":     SnapshotGroup + "/" + DefaultSnapshotAPIVersion,
+		"kind":           "VolumeSnapshotClass",
+		"metadata":       map[string]interface{}{"name": "targetd"},
+		"driver":         "nfs-targetd",
+		"deletionPolicy": "Delete",
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), class)
+	client := kubefake.NewSimpleClientset(claim, pv)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	recorder := record.NewFakeRecorder(10)
+	c := NewSnapshotController(client, dynamicClient, p.backends, "nfs-targetd", DefaultSnapshotAPIVersion, factory, dynamicFactory, recorder, zap.NewNop())
+	test := &snapshotTest{SnapshotController: c, provisioner: p, server: s, dynamic: dynamicClient, dynamicFactory: dynamicFactory, recorder: recorder, volume: pv}
+	add(t, factory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer(), claim)
+	add(t, factory.Core().V1().PersistentVolumes().Informer().GetIndexer(), pv)
+	test.cache(t, c.classResource, class)
+	return test
+}
+
+func add(t *testing.T, indexer interface{ Add(interface{}) error }, obj interface{}) {
+	t.Helper()
+	if err := indexer.Add(obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cache adds or updates obj in the informer cache of resource.
+func (test *snapshotTest) cache(t *testing.T, resource schema.GroupVersionResource, obj *unstructured.Unstructured) {
+	t.Helper()
+	if err := test.dynamicFactory.ForResource(resource).Informer().GetIndexer().Update(obj); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createSnapshot creates snapshot default/snapshot of claim-pvc-1 with the
+// snapshot class className.
+func (test *snapshotTest) createSnapshot(t *testing.T, className string) *unstructured.Unstructured {
+	t.Helper()
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": SnapshotGroup + "/" + DefaultSnapshotAPIVersion,
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      "snapshot",
+			"uid":       "1234",
+		},
+		"spec": map[string]interface{}{
+			"source":                  map[string]interface{}{"persistentVolumeClaimName": "claim-pvc-1"},
+			"volumeSnapshotClassName": className,
+		},
+	}}
+	created, err := test.dynamic.Resource(test.snapshotResource).Namespace("default").Create(context.Background(), snapshot, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.cache(t, test.snapshotResource, created)
+	return created
+}
+
+// get returns an object of resource from the api, namespace is empty for
+// cluster scoped resources.
+func (test *snapshotTest) get(t *testing.T, resource schema.GroupVersionResource, namespace, name string) *unstructured.Unstructured {
+	t.Helper()
+	obj, err := test.dynamic.Resource(resource).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestSnapshotCreate(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := test.server.Snapshots(test.volume.Annotations["uuid"])
+	if len(snapshots) != 1 || snapshots[0].Name != "snapshot-1234" {
+		t.Fatalf("expected targetd snapshot snapshot-1234, got %+v", snapshots)
+	}
+
+	content := test.get(t, test.contentResource, "", "targetd-snapcontent-1234")
+	if finalizers := content.GetFinalizers(); len(finalizers) != 1 || finalizers[0] != snapshotFinalizer {
+		t.Errorf("expected finalizer %s on the content, got %v", snapshotFinalizer, finalizers)
+	}
+	if handle, _, _ := unstructured.NestedString(content.Object, "status", "snapshotHandle"); handle != snapshots[0].UUID {
+		t.Errorf("expected snapshot handle %s, got %q", snapshots[0].UUID, handle)
+	}
+	if uuid := content.GetAnnotations()["uuid"]; uuid != test.volume.Annotations["uuid"] {
+		t.Errorf("expected the content to name filesystem %s, got %q", test.volume.Annotations["uuid"], uuid)
+	}
+
+	snapshot := test.get(t, test.snapshotResource, "default", "snapshot")
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); !ready {
+		t.Errorf("expected the snapshot to be ready to use, got %v", snapshot.Object["status"])
+	}
+	if bound, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName"); bound != "targetd-snapcontent-1234" {
+		t.Errorf("expected the snapshot to be bound to targetd-snapcontent-1234, got %q", bound)
+	}
+	if restoreSize, _, _ := unstructured.NestedString(snapshot.Object, "status", "restoreSize"); restoreSize != "1Gi" {
+		t.Errorf("expected a restore size of 1Gi, got %q", restoreSize)
+	}
+}
+
+func TestSnapshotReadyIsKept(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	test.cache(t, test.snapshotResource, test.get(t, test.snapshotResource, "default", "snapshot"))
+
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := test.server.Calls("fs_snapshot"); calls != 1 {
+		t.Errorf("expected a ready snapshot not to be taken again, got %d fs_snapshot calls", calls)
+	}
+}
+
+func TestSnapshotIgnoresOtherDrivers(t *testing.T) {
+	test := newSnapshotTest(t)
+	other := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion":     SnapshotGroup + "/" + DefaultSnapshotAPIVersion,
+		"kind":           "VolumeSnapshotClass",
+		"metadata":       map[string]interface{}{"name": "other"},
+		"driver":         "other.csi.example.com",
+		"deletionPolicy": "Delete",
+	}}
+	test.cache(t, test.classResource, other)
+	test.createSnapshot(t, "other")
+
+	if err := test.syncSnapshot(context.Background(), "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := test.server.Calls("fs_snapshot"); calls != 0 {
+		t.Errorf("expected no fs_snapshot calls, got %d", calls)
+	}
+	if status := test.get(t, test.snapshotResource, "default", "snapshot").Object["status"]; status != nil {
+		t.Errorf("expected the snapshot status to be left alone, got %v", status)
+	}
+}
+
+func TestSnapshotLeavesSnapshotBoundElsewhere(t *testing.T) {
+	test := newSnapshotTest(t)
+	snapshot := test.createSnapshot(t, "targetd")
+	// the snapshot-controller of external-snapshotter got there first
+	snapshot.Object["status"] = map[string]interface{}{"boundVolumeSnapshotContentName": "snapcontent-1234"}
+	test.cache(t, test.snapshotResource, snapshot)
+
+	if err := test.syncSnapshot(context.Background(), "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := test.server.Calls("fs_snapshot"); calls != 0 {
+		t.Errorf("expected no fs_snapshot calls, got %d", calls)
+	}
+	select {
+	case event := <-test.recorder.Events:
+		if !strings.Contains(event, "SnapshotBoundElsewhere") {
+			t.Errorf("expected a SnapshotBoundElsewhere event, got %q", event)
+		}
+	default:
+		t.Error("expected a SnapshotBoundElsewhere event")
+	}
+}
+
+func TestSnapshotFiltersContentsOnDriver(t *testing.T) {
+	test := newSnapshotTest(t)
+	content := func(driver string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": SnapshotGroup + "/" + DefaultSnapshotAPIVersion,
+			"kind":       "VolumeSnapshotContent",
+			"metadata":   map[string]interface{}{"name": "content"},
+			"spec":       map[string]interface{}{"driver": driver},
+		}}
+	}
+
+	if !test.isOwnContent(content("nfs-targetd")) {
+		t.Error("expected a content of nfs-targetd to be handled")
+	}
+	if test.isOwnContent(content("other.csi.example.com")) {
+		t.Error("expected a content of another driver to be ignored")
+	}
+}
+
+func TestSnapshotDeleteRemovesContent(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	test.cache(t, test.contentResource, test.get(t, test.contentResource, "", "targetd-snapcontent-1234"))
+
+	// the snapshot is deleted
+	if err := test.dynamic.Resource(test.snapshotResource).Namespace("default").Delete(ctx, "snapshot", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetNamespace("default")
+	snapshot.SetName("snapshot")
+	if err := test.dynamicFactory.ForResource(test.snapshotResource).Informer().GetIndexer().Delete(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.syncContent(ctx, "targetd-snapcontent-1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.dynamic.Resource(test.contentResource).Get(ctx, "targetd-snapcontent-1234", metav1.GetOptions{}); err == nil {
+		t.Error("expected the content of the deleted snapshot to be deleted")
+	}
+}
+
+func TestSnapshotContentFinalizer(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+	if err := test.syncSnapshot(ctx, "default/snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	// the content is being deleted
+	content := test.get(t, test.contentResource, "", "targetd-snapcontent-1234")
+	now := metav1.Now()
+	content.SetDeletionTimestamp(&now)
+	test.cache(t, test.contentResource, content)
+
+	if err := test.syncContent(ctx, "targetd-snapcontent-1234"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots := test.server.Snapshots(test.volume.Annotations["uuid"]); len(snapshots) != 0 {
+		t.Errorf("expected the targetd snapshot to be deleted, got %+v", snapshots)
+	}
+	if finalizers := test.get(t, test.contentResource, "", "targetd-snapcontent-1234").GetFinalizers(); len(finalizers) != 0 {
+		t.Errorf("expected the finalizer to be removed, got %v", finalizers)
+	}
+
+	// a targetd snapshot that is already gone does not keep the finalizer
+	test.cache(t, test.contentResource, content)
+	if err := test.syncContent(ctx, "targetd-snapcontent-1234"); err != nil {
+		t.Errorf("expected a removed targetd snapshot to be ignored, got %v", err)
+	}
+}
+
+func TestSnapshotFailedOnlyUpdatesChangedErrors(t *testing.T) {
+	test := newSnapshotTest(t)
+	ctx := context.Background()
+	test.createSnapshot(t, "targetd")
+	updates := func() int {
+		count := 0
+		for _, action := range test.dynamic.Actions() {
+			if action.GetVerb() == "update" {
+				count++
+			}
+		}
+		return count
+	}
+
+	for i, step := range []struct {
+		err     error
+		updates int
+	}{
+		{err: errors.New("claim claim is not bound"), updates: 1},
+		{err: errors.New("claim claim is not bound"), updates: 1},
+		{err: errors.New("failed to get volume pvc-1"), updates: 2},
+	} {
+		err := test.snapshotFailed(ctx, test.get(t, test.snapshotResource, "default", "snapshot"), step.err)
+		if err != step.err {
+			t.Errorf("%d: expected %v to be returned for a rate limited retry, got %v", i, step.err, err)
+		}
+		if updates() != step.updates {
+			t.Errorf("%d: expected %d status updates, got %d", i, step.updates, updates())
+		}
+	}
+	message, _, _ := unstructured.NestedString(test.get(t, test.snapshotResource, "default", "snapshot").Object, "status", "error", "message")
+	if message != "failed to get volume pvc-1" {
+		t.Errorf("expected the last error in the status, got %q", message)
+	}
+	if len(test.recorder.Events) != 2 {
+		t.Errorf("expected an event for every changed error, got %d", len(test.recorder.Events))
+	}
+}
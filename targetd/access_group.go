@@ -0,0 +1,97 @@
+package targetd
+
+import "context"
+
+// AccessGroup describes an access group as returned by access_group_list.
+type AccessGroup struct {
+	Name     string   `json:"name"`
+	InitIDs  []string `json:"init_ids"`
+	InitType string   `json:"init_type"`
+}
+
+// AccessGroupMap describes a volume mapped to an access group as returned
+// by access_group_map_list.
+type AccessGroupMap struct {
+	AgName   string `json:"ag_name"`
+	HLunID   int32  `json:"h_lun_id"`
+	PoolName string `json:"pool_name"`
+	VolName  string `json:"vol_name"`
+}
+
+type AccessGroupCreateArgs struct {
+	AgName   string `json:"ag_name"`
+	InitID   string `json:"init_id"`
+	InitType string `json:"init_type"`
+}
+
+type AccessGroupDestroyArgs struct {
+	AgName string `json:"ag_name"`
+}
+
+type AccessGroupInitArgs struct {
+	AgName   string `json:"ag_name"`
+	InitID   string `json:"init_id"`
+	InitType string `json:"init_type"`
+}
+
+type AccessGroupMapCreateArgs struct {
+	PoolName string `json:"pool_name"`
+	VolName  string `json:"vol_name"`
+	AgName   string `json:"ag_name"`
+	HLunID   *int32 `json:"h_lun_id,omitempty"`
+}
+
+type AccessGroupMapDestroyArgs struct {
+	PoolName string `json:"pool_name"`
+	VolName  string `json:"vol_name"`
+	AgName   string `json:"ag_name"`
+}
+
+// AccessGroupList calls access_group_list to get all access groups.
+func (c *Client) AccessGroupList(ctx context.Context) ([]AccessGroup, error) {
+	var groups []AccessGroup
+	err := c.call(ctx, "access_group_list", nil, &groups)
+	return groups, err
+}
+
+// AccessGroupCreate calls access_group_create to create an access group
+// containing a single initiator.
+func (c *Client) AccessGroupCreate(ctx context.Context, args AccessGroupCreateArgs) error {
+	return c.call(ctx, "access_group_create", args, nil)
+}
+
+// AccessGroupDestroy calls access_group_destroy to remove an access group.
+func (c *Client) AccessGroupDestroy(ctx context.Context, args AccessGroupDestroyArgs) error {
+	return c.call(ctx, "access_group_destroy", args, nil)
+}
+
+// AccessGroupInitAdd calls access_group_init_add to add an initiator to an
+// access group.
+func (c *Client) AccessGroupInitAdd(ctx context.Context, args AccessGroupInitArgs) error {
+	return c.call(ctx, "access_group_init_add", args, nil)
+}
+
+// AccessGroupInitDel calls access_group_init_del to remove an initiator from
+// an access group.
+func (c *Client) AccessGroupInitDel(ctx context.Context, args AccessGroupInitArgs) error {
+	return c.call(ctx, "access_group_init_del", args, nil)
+}
+
+// AccessGroupMapList calls access_group_map_list to get all volume mappings.
+func (c *Client) AccessGroupMapList(ctx context.Context) ([]AccessGroupMap, error) {
+	var maps []AccessGroupMap
+	err := c.call(ctx, "access_group_map_list", nil, &maps)
+	return maps, err
+}
+
+// AccessGroupMapCreate calls access_group_map_create to map a volume to an
+// access group.
+func (c *Client) AccessGroupMapCreate(ctx context.Context, args AccessGroupMapCreateArgs) error {
+	return c.call(ctx, "access_group_map_create", args, nil)
+}
+
+// AccessGroupMapDestroy calls access_group_map_destroy to unmap a volume from
+// an access group.
+func (c *Client) AccessGroupMapDestroy(ctx context.Context, args AccessGroupMapDestroyArgs) error {
+	return c.call(ctx, "access_group_map_destroy", args, nil)
+}
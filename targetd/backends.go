@@ -0,0 +1,63 @@
+package targetd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoDefaultBackend is returned for a StorageClass or PersistentVolume
+// that does not name a backend when no default backend is configured.
+var ErrNoDefaultBackend = errors.New("no targetd backend set and no default targetd backend configured")
+
+// Backends holds a client for every named targetd backend.
+type Backends struct {
+	clients     map[string]*Client
+	defaultName string
+}
+
+// NewBackends creates a set of backends, defaultName is used when a
+// StorageClass or PersistentVolume does not name a backend. Without a
+// defaultName every StorageClass and PersistentVolume must name one.
+func NewBackends(defaultName string, clients map[string]*Client) (*Backends, error) {
+	if _, ok := clients[defaultName]; defaultName != "" && !ok {
+		return nil, fmt.Errorf("default targetd backend %q is not configured", defaultName)
+	}
+	return &Backends{
+		clients:     clients,
+		defaultName: defaultName,
+	}, nil
+}
+
+// Get returns the name and client of backend name, or of the default
+// backend when name is empty.
+func (b *Backends) Get(name string) (string, *Client, error) {
+	if name == "" {
+		if b.defaultName == "" {
+			return "", nil, ErrNoDefaultBackend
+		}
+		name = b.defaultName
+	}
+	client, ok := b.clients[name]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown targetd backend %q", name)
+	}
+	return name, client, nil
+}
+
+// Names returns the names of all backends in sorted order.
+func (b *Backends) Names() []string {
+	names := make([]string, 0, len(b.clients))
+	for name := range b.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CloseIdleConnections closes the idle connections of every backend.
+func (b *Backends) CloseIdleConnections() {
+	for _, client := range b.clients {
+		client.CloseIdleConnections()
+	}
+}
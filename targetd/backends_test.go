@@ -0,0 +1,71 @@
+package targetd
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBackendsGet(t *testing.T) {
+	a, err := NewClient("http://a:18700/targetrpc", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewClient("http://b:18700/targetrpc", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := map[string]*Client{"a": a, "b": b}
+
+	tests := []struct {
+		name        string
+		defaultName string
+		backend     string
+		expected    string
+		err         bool
+	}{
+		{name: "named", backend: "b", expected: "b"},
+		{name: "default", defaultName: "a", expected: "a"},
+		{name: "named with default", defaultName: "a", backend: "b", expected: "b"},
+		{name: "unknown", defaultName: "a", backend: "c", err: true},
+		{name: "no default", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backends, err := NewBackends(test.defaultName, clients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, client, err := backends.Get(test.backend)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got backend %s", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != test.expected || client != clients[test.expected] {
+				t.Errorf("expected backend %s, got %s", test.expected, name)
+			}
+		})
+	}
+}
+
+func TestBackendsWithoutDefault(t *testing.T) {
+	backends, err := NewBackends("", map[string]*Client{"a": nil, "b": nil})
+	if err != nil {
+		t.Fatalf("expected backends without a default to be accepted, got %v", err)
+	}
+	if _, _, err := backends.Get(""); !errors.Is(err, ErrNoDefaultBackend) {
+		t.Errorf("expected %v, got %v", ErrNoDefaultBackend, err)
+	}
+	if names := backends.Names(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("expected backends a and b, got %v", names)
+	}
+	if _, err := NewBackends("c", map[string]*Client{"a": nil}); err == nil {
+		t.Error("expected an unknown default backend to be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+package targetd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// provision makes the calls of provisioning an iscsi volume exported to
+// three initiators.
+func provision(ctx context.Context, c *Client) error {
+	if _, err := c.VolList(ctx, VolListArgs{Pool: "vg"}); err != nil {
+		return err
+	}
+	if err := c.VolCreate(ctx, VolCreateArgs{Pool: "vg", Name: "vol", Size: 1 << 30}); err != nil {
+		return err
+	}
+	if _, err := c.ExportList(ctx); err != nil {
+		return err
+	}
+	for _, initiator := range []string{"iqn.a", "iqn.b", "iqn.c"} {
+		err := c.ExportCreate(ctx, ExportCreateArgs{Pool: "vg", Vol: "vol", InitiatorWwn: initiator, Lun: 1})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// benchmarkProvision provisions against a stub and reports the number of
+// connections opened per provision.
+func benchmarkProvision(b *testing.B, keepAlive bool) {
+	var connections int64
+	s := newUnstartedStub(b)
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	s.Start()
+	c, err := NewClient(s.URL, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	c.http.Transport.(*http.Transport).DisableKeepAlives = !keepAlive
+	defer c.CloseIdleConnections()
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := provision(ctx, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&connections))/float64(b.N), "conns/op")
+}
+
+// BenchmarkProvisionSharedTransport provisions through one client reusing
+// its keep-alive connections.
+func BenchmarkProvisionSharedTransport(b *testing.B) {
+	benchmarkProvision(b, true)
+}
+
+// BenchmarkProvisionNewConnectionPerCall provisions opening a new connection
+// for every call, like the provisioners did before they shared a client.
+func BenchmarkProvisionNewConnectionPerCall(b *testing.B) {
+	benchmarkProvision(b, false)
+}
@@ -0,0 +1,137 @@
+package targetd
+
+import "context"
+
+// Volume describes a block volume as returned by vol_list.
+type Volume struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	UUID string `json:"uuid"`
+}
+
+type VolListArgs struct {
+	Pool string `json:"pool"`
+}
+
+type VolCreateArgs struct {
+	Pool string `json:"pool"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type VolDestroyArgs struct {
+	Pool string `json:"pool"`
+	Name string `json:"name"`
+}
+
+type VolCopyArgs struct {
+	Pool    string `json:"pool"`
+	VolOrig string `json:"vol_orig"`
+	VolNew  string `json:"vol_new"`
+	Size    int64  `json:"size,omitempty"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+type VolResizeArgs struct {
+	Pool string `json:"pool"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Export describes a volume exported to an initiator as returned by export_list.
+type Export struct {
+	InitiatorWwn string `json:"initiator_wwn"`
+	Lun          int32  `json:"lun"`
+	VolName      string `json:"vol_name"`
+	VolSize      int64  `json:"vol_size"`
+	VolUUID      string `json:"vol_uuid"`
+	Pool         string `json:"pool"`
+}
+
+type ExportCreateArgs struct {
+	Pool         string `json:"pool"`
+	Vol          string `json:"vol"`
+	InitiatorWwn string `json:"initiator_wwn"`
+	Lun          int32  `json:"lun"`
+}
+
+type ExportDestroyArgs struct {
+	Pool         string `json:"pool"`
+	Vol          string `json:"vol"`
+	InitiatorWwn string `json:"initiator_wwn"`
+}
+
+// Initiator describes an initiator as returned by initiator_list.
+type Initiator struct {
+	InitID   string `json:"init_id"`
+	InitType string `json:"init_type"`
+}
+
+type InitiatorListArgs struct {
+	StandaloneOnly bool `json:"standalone_only"`
+}
+
+type InitiatorSetAuthArgs struct {
+	InitiatorWwn string `json:"initiator_wwn"`
+	InUser       string `json:"in_user"`
+	InPassword   string `json:"in_pass"`
+	OutUser      string `json:"out_user"`
+	OutPassword  string `json:"out_pass"`
+}
+
+// VolList calls vol_list to get the volumes in a pool.
+func (c *Client) VolList(ctx context.Context, args VolListArgs) ([]Volume, error) {
+	var volumes []Volume
+	err := c.call(ctx, "vol_list", args, &volumes)
+	return volumes, err
+}
+
+// VolCreate calls vol_create to create a volume.
+func (c *Client) VolCreate(ctx context.Context, args VolCreateArgs) error {
+	return c.call(ctx, "vol_create", args, nil)
+}
+
+// VolDestroy calls vol_destroy to remove a volume.
+func (c *Client) VolDestroy(ctx context.Context, args VolDestroyArgs) error {
+	return c.call(ctx, "vol_destroy", args, nil)
+}
+
+// VolCopy calls vol_copy to create a new volume from the contents of another.
+func (c *Client) VolCopy(ctx context.Context, args VolCopyArgs) error {
+	return c.call(ctx, "vol_copy", args, nil)
+}
+
+// VolResize calls vol_resize to grow a volume.
+func (c *Client) VolResize(ctx context.Context, args VolResizeArgs) error {
+	return c.call(ctx, "vol_resize", args, nil)
+}
+
+// ExportList calls export_list to get all volume exports.
+func (c *Client) ExportList(ctx context.Context) ([]Export, error) {
+	var exports []Export
+	err := c.call(ctx, "export_list", nil, &exports)
+	return exports, err
+}
+
+// ExportCreate calls export_create to export a volume to an initiator.
+func (c *Client) ExportCreate(ctx context.Context, args ExportCreateArgs) error {
+	return c.call(ctx, "export_create", args, nil)
+}
+
+// ExportDestroy calls export_destroy to remove the export of a volume.
+func (c *Client) ExportDestroy(ctx context.Context, args ExportDestroyArgs) error {
+	return c.call(ctx, "export_destroy", args, nil)
+}
+
+// InitiatorList calls initiator_list to get the known initiators.
+func (c *Client) InitiatorList(ctx context.Context, args InitiatorListArgs) ([]Initiator, error) {
+	var initiators []Initiator
+	err := c.call(ctx, "initiator_list", args, &initiators)
+	return initiators, err
+}
+
+// InitiatorSetAuth calls initiator_set_auth to set up chap session
+// authentication for an initiator.
+func (c *Client) InitiatorSetAuth(ctx context.Context, args InitiatorSetAuthArgs) error {
+	return c.call(ctx, "initiator_set_auth", args, nil)
+}
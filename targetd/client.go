@@ -0,0 +1,293 @@
+package targetd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultConnectTimeout is used for establishing a connection to targetd
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultListTimeout is used for calls that only read state from targetd
+	DefaultListTimeout = 30 * time.Second
+	// DefaultMutateTimeout is used for calls that change state on targetd
+	DefaultMutateTimeout = 2 * time.Minute
+	// DefaultMaxConnections bounds the number of connections opened to targetd
+	DefaultMaxConnections = 4
+	// DefaultIdleConnTimeout is how long an idle connection is kept for reuse
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultKeepAlive is the TCP keep-alive period of connections to targetd
+	DefaultKeepAlive = 30 * time.Second
+)
+
+// Client talks to a targetd daemon using its JSON-RPC 2.0 API.
+type Client struct {
+	url  string
+	log  *zap.Logger
+	http *http.Client
+
+	connectTimeout  time.Duration
+	listTimeout     time.Duration
+	mutateTimeout   time.Duration
+	maxConnections  int
+	idleConnTimeout time.Duration
+	tlsConfig       *TLSConfig
+	credentials     CredentialsProvider
+	retry           RetryPolicy
+	breaker         *breaker
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// ConnectTimeout sets the maximum time spent establishing a connection.
+func ConnectTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.connectTimeout = timeout
+	}
+}
+
+// ListTimeout sets the maximum duration of calls that only read state,
+// like pool_list or export_list. Zero disables the timeout.
+func ListTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.listTimeout = timeout
+	}
+}
+
+// MutateTimeout sets the maximum duration of calls that change state,
+// like vol_create or export_destroy. Zero disables the timeout.
+func MutateTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.mutateTimeout = timeout
+	}
+}
+
+// MaxConnections bounds the number of connections, idle or in use, that are
+// kept open to targetd.
+func MaxConnections(max int) Option {
+	return func(c *Client) {
+		c.maxConnections = max
+	}
+}
+
+// IdleConnTimeout sets how long an idle connection is kept for reuse.
+func IdleConnTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.idleConnTimeout = timeout
+	}
+}
+
+// NewClient creates a new targetd client for the targetrpc endpoint at url.
+// Credentials must be supplied with the Auth option rather than in the url.
+// The client keeps its connections alive and reuses them for every call, so
+// a single client should be shared by everything talking to the same targetd.
+func NewClient(targetdURL string, logger *zap.Logger, options ...Option) (*Client, error) {
+	c := &Client{
+		url:             targetdURL,
+		log:             logger.With(zap.String("system", "targetd")),
+		connectTimeout:  DefaultConnectTimeout,
+		listTimeout:     DefaultListTimeout,
+		mutateTimeout:   DefaultMutateTimeout,
+		maxConnections:  DefaultMaxConnections,
+		idleConnTimeout: DefaultIdleConnTimeout,
+		retry: RetryPolicy{
+			Attempts:       DefaultRetryAttempts,
+			InitialBackoff: DefaultRetryInitialBackoff,
+			MaxBackoff:     DefaultRetryMaxBackoff,
+		},
+		breaker: &breaker{policy: BreakerPolicy{
+			Threshold:    DefaultBreakerThreshold,
+			OpenDuration: DefaultBreakerOpenDuration,
+		}},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.connectTimeout,
+			KeepAlive: DefaultKeepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout: c.connectTimeout,
+		// targetd serves HTTP/1.1 only, reuse keep-alive connections
+		ForceAttemptHTTP2:   false,
+		MaxIdleConns:        c.maxConnections,
+		MaxIdleConnsPerHost: c.maxConnections,
+		MaxConnsPerHost:     c.maxConnections,
+		IdleConnTimeout:     c.idleConnTimeout,
+	}
+	u, err := url.Parse(targetdURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		return nil, errors.New("targetd url must not contain credentials")
+	}
+	if c.tlsConfig != nil {
+		transport.TLSClientConfig, err = c.tlsConfig.build(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.http = &http.Client{Transport: transport}
+	return c, nil
+}
+
+// CloseIdleConnections closes the connections to targetd that are not in use.
+func (c *Client) CloseIdleConnections() {
+	c.http.CloseIdleConnections()
+}
+
+// timeout returns the timeout for method based on whether it only reads state.
+func (c *Client) timeout(method string) time.Duration {
+	if strings.HasSuffix(method, "_list") {
+		return c.listTimeout
+	}
+	return c.mutateTimeout
+}
+
+// call invokes method on targetd with the given arguments and decodes the
+// result into result, which may be nil when the method returns nothing.
+// Transient failures are retried according to the retry policy, and the
+// call is abandoned when ctx is done.
+func (c *Client) call(ctx context.Context, method string, args interface{}, result interface{}) error {
+	log := c.log.With(zap.String("method", method))
+	attempts := c.retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if !c.breaker.allow() {
+			log.Debug("targetd call rejected by circuit breaker")
+			return ErrCircuitOpen
+		}
+		err = c.callOnce(ctx, log, method, args, result)
+		if c.breaker.record(err) {
+			log.Warn("targetd circuit breaker opened", zap.Error(err))
+		}
+		if err == nil || !IsTransient(err) || attempt >= attempts {
+			return err
+		}
+		backoff := c.retry.backoff(attempt)
+		log.Debug("retrying targetd call", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// callOnce makes a single attempt at calling method, which is abandoned when
+// ctx is done or the method timeout expires.
+func (c *Client) callOnce(ctx context.Context, log *zap.Logger, method string, args interface{}, result interface{}) error {
+	attemptCtx := ctx
+	timeout := c.timeout(method)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	failure := &transportFailure{}
+	client, err := c.getConnection(attemptCtx, method, failure)
+	if err != nil {
+		log.Warn("failed to get connection", zap.Error(err))
+		return err
+	}
+	defer client.Close()
+
+	log.Debug("calling targetd")
+	call := client.Go(method, args, result, nil)
+	select {
+	case <-call.Done:
+		err = newError(method, call.Error)
+		if transportErr := failure.get(); call.Error != nil && transportErr != nil {
+			err = transportErr
+			if attemptCtx.Err() != nil {
+				err = abandoned(ctx, method, timeout)
+			}
+		}
+	case <-attemptCtx.Done():
+		err = abandoned(ctx, method, timeout)
+	}
+	if err != nil {
+		log.Debug("targetd call failed", zap.Error(err))
+		return err
+	}
+	log.Debug("targetd call completed")
+	return nil
+}
+
+// abandoned returns the error of a call whose attempt context is done, which
+// is the error of ctx unless only the attempt timed out.
+func abandoned(ctx context.Context, method string, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// only this attempt timed out, which is worth retrying
+	return fmt.Errorf("targetd %s timed out after %s", method, timeout)
+}
+
+// transportFailure keeps why the http request of a call failed, jsonrpc2
+// only reports it as the message of an InternalError.
+type transportFailure struct {
+	mutex sync.Mutex
+	err   error
+}
+
+func (f *transportFailure) set(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+func (f *transportFailure) get() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// getConnection creates a jsonrpc2 client whose requests are bound to ctx.
+// The jsonrpc2 client is only a codec around the shared http client, so
+// creating one per call does not open new connections. Failures of the http
+// request are kept in failure.
+func (c *Client) getConnection(ctx context.Context, method string, failure *transportFailure) (*jsonrpc2.Client, error) {
+	doer := jsonrpc2.DoerFunc(func(req *http.Request) (*http.Response, error) {
+		if c.credentials != nil {
+			credentials, err := c.credentials.Credentials()
+			if err != nil {
+				err = fmt.Errorf("%w: %v", ErrCredentials, err)
+				failure.set(err)
+				return nil, err
+			}
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+		resp, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			failure.set(fmt.Errorf("targetd %s failed: %w", method, err))
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			failure.set(&StatusError{Method: method, StatusCode: resp.StatusCode, Status: resp.Status})
+		}
+		return resp, nil
+	})
+	client := jsonrpc2.NewCustomHTTPClient(c.url, doer)
+	if client == nil {
+		return nil, errors.New("error creating the connection to targetd")
+	}
+	return client, nil
+}
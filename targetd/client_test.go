@@ -0,0 +1,418 @@
+package targetd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stubRequest is a call received by a stub server.
+type stubRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     json.RawMessage `json:"id"`
+	Header http.Header     `json:"-"`
+}
+
+// stub is a targetd answering every call with result, or with err when it
+// is set. A status other than 200 is answered without a JSON-RPC response,
+// after waiting for delay.
+type stub struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []stubRequest
+	result   interface{}
+	err      *ErrorInfo
+	status   int
+	delay    time.Duration
+}
+
+func newStub(t testing.TB) *stub {
+	s := newUnstartedStub(t)
+	s.Start()
+	return s
+}
+
+// newUnstartedStub returns a stub that is started by the caller.
+func newUnstartedStub(t testing.TB) *stub {
+	s := &stub{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req stubRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req.Header = r.Header
+	s.mutex.Lock()
+	s.requests = append(s.requests, req)
+	result, info, status, delay := s.result, s.err, s.status, s.delay
+	s.mutex.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 && status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	if info != nil {
+		response["error"] = info
+	} else {
+		response["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// calls returns the number of calls received.
+func (s *stub) calls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests)
+}
+
+func (s *stub) last(t *testing.T) stubRequest {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("no request received")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func newStubClient(t *testing.T, s *stub, options ...Option) *Client {
+	t.Helper()
+	options = append([]Option{Retry(RetryPolicy{Attempts: 1})}, options...)
+	c, err := NewClient(s.URL, zap.NewNop(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.CloseIdleConnections)
+	return c
+}
+
+// assertJSON fails when raw does not encode the same value as expected.
+func assertJSON(t *testing.T, raw json.RawMessage, expected string) {
+	t.Helper()
+	var got, want interface{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("invalid json %s: %v", raw, err)
+	}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatalf("invalid expected json %s: %v", expected, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", raw, expected)
+	}
+}
+
+func TestRequestEncoding(t *testing.T) {
+	lun := int32(3)
+	tests := []struct {
+		method string
+		call   func(ctx context.Context, c *Client) error
+		params string
+	}{
+		{"pool_list", func(ctx context.Context, c *Client) error {
+			_, err := c.PoolList(ctx)
+			return err
+		}, `null`},
+		{"vol_list", func(ctx context.Context, c *Client) error {
+			_, err := c.VolList(ctx, VolListArgs{Pool: "vg"})
+			return err
+		}, `{"pool":"vg"}`},
+		{"vol_create", func(ctx context.Context, c *Client) error {
+			return c.VolCreate(ctx, VolCreateArgs{Pool: "vg", Name: "vol", Size: 1024})
+		}, `{"pool":"vg","name":"vol","size":1024}`},
+		{"vol_destroy", func(ctx context.Context, c *Client) error {
+			return c.VolDestroy(ctx, VolDestroyArgs{Pool: "vg", Name: "vol"})
+		}, `{"pool":"vg","name":"vol"}`},
+		{"vol_copy", func(ctx context.Context, c *Client) error {
+			return c.VolCopy(ctx, VolCopyArgs{Pool: "vg", VolOrig: "a", VolNew: "b"})
+		}, `{"pool":"vg","vol_orig":"a","vol_new":"b"}`},
+		{"vol_copy", func(ctx context.Context, c *Client) error {
+			return c.VolCopy(ctx, VolCopyArgs{Pool: "vg", VolOrig: "a", VolNew: "b", Size: 2048, Timeout: 60})
+		}, `{"pool":"vg","vol_orig":"a","vol_new":"b","size":2048,"timeout":60}`},
+		{"vol_resize", func(ctx context.Context, c *Client) error {
+			return c.VolResize(ctx, VolResizeArgs{Pool: "vg", Name: "vol", Size: 4096})
+		}, `{"pool":"vg","name":"vol","size":4096}`},
+		{"export_list", func(ctx context.Context, c *Client) error {
+			_, err := c.ExportList(ctx)
+			return err
+		}, `null`},
+		{"export_create", func(ctx context.Context, c *Client) error {
+			return c.ExportCreate(ctx, ExportCreateArgs{Pool: "vg", Vol: "vol", InitiatorWwn: "iqn.a", Lun: 1})
+		}, `{"pool":"vg","vol":"vol","initiator_wwn":"iqn.a","lun":1}`},
+		{"export_destroy", func(ctx context.Context, c *Client) error {
+			return c.ExportDestroy(ctx, ExportDestroyArgs{Pool: "vg", Vol: "vol", InitiatorWwn: "iqn.a"})
+		}, `{"pool":"vg","vol":"vol","initiator_wwn":"iqn.a"}`},
+		{"initiator_list", func(ctx context.Context, c *Client) error {
+			_, err := c.InitiatorList(ctx, InitiatorListArgs{StandaloneOnly: true})
+			return err
+		}, `{"standalone_only":true}`},
+		{"initiator_set_auth", func(ctx context.Context, c *Client) error {
+			return c.InitiatorSetAuth(ctx, InitiatorSetAuthArgs{InitiatorWwn: "iqn.a", InUser: "u", InPassword: "p"})
+		}, `{"initiator_wwn":"iqn.a","in_user":"u","in_pass":"p","out_user":"","out_pass":""}`},
+		{"access_group_list", func(ctx context.Context, c *Client) error {
+			_, err := c.AccessGroupList(ctx)
+			return err
+		}, `null`},
+		{"access_group_create", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupCreate(ctx, AccessGroupCreateArgs{AgName: "ag", InitID: "iqn.a", InitType: "iscsi"})
+		}, `{"ag_name":"ag","init_id":"iqn.a","init_type":"iscsi"}`},
+		{"access_group_destroy", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupDestroy(ctx, AccessGroupDestroyArgs{AgName: "ag"})
+		}, `{"ag_name":"ag"}`},
+		{"access_group_init_add", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupInitAdd(ctx, AccessGroupInitArgs{AgName: "ag", InitID: "iqn.b", InitType: "iscsi"})
+		}, `{"ag_name":"ag","init_id":"iqn.b","init_type":"iscsi"}`},
+		{"access_group_init_del", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupInitDel(ctx, AccessGroupInitArgs{AgName: "ag", InitID: "iqn.b", InitType: "iscsi"})
+		}, `{"ag_name":"ag","init_id":"iqn.b","init_type":"iscsi"}`},
+		{"access_group_map_list", func(ctx context.Context, c *Client) error {
+			_, err := c.AccessGroupMapList(ctx)
+			return err
+		}, `null`},
+		{"access_group_map_create", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupMapCreate(ctx, AccessGroupMapCreateArgs{PoolName: "vg", VolName: "vol", AgName: "ag"})
+		}, `{"pool_name":"vg","vol_name":"vol","ag_name":"ag"}`},
+		{"access_group_map_create", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupMapCreate(ctx, AccessGroupMapCreateArgs{PoolName: "vg", VolName: "vol", AgName: "ag", HLunID: &lun})
+		}, `{"pool_name":"vg","vol_name":"vol","ag_name":"ag","h_lun_id":3}`},
+		{"access_group_map_destroy", func(ctx context.Context, c *Client) error {
+			return c.AccessGroupMapDestroy(ctx, AccessGroupMapDestroyArgs{PoolName: "vg", VolName: "vol", AgName: "ag"})
+		}, `{"pool_name":"vg","vol_name":"vol","ag_name":"ag"}`},
+		{"fs_list", func(ctx context.Context, c *Client) error {
+			_, err := c.FsList(ctx)
+			return err
+		}, `null`},
+		{"fs_create", func(ctx context.Context, c *Client) error {
+			return c.FsCreate(ctx, FsCreateArgs{PoolName: "fs", Name: "vol", SizeBytes: 0})
+		}, `{"pool_name":"fs","name":"vol","size_bytes":0}`},
+		{"fs_destroy", func(ctx context.Context, c *Client) error {
+			return c.FsDestroy(ctx, FsDestroyArgs{UUID: "u"})
+		}, `{"uuid":"u"}`},
+		{"fs_clone", func(ctx context.Context, c *Client) error {
+			return c.FsClone(ctx, FsCloneArgs{FsUUID: "u", DestFsName: "b"})
+		}, `{"fs_uuid":"u","dest_fs_name":"b"}`},
+		{"fs_clone", func(ctx context.Context, c *Client) error {
+			return c.FsClone(ctx, FsCloneArgs{FsUUID: "u", DestFsName: "b", SnapshotID: "s"})
+		}, `{"fs_uuid":"u","dest_fs_name":"b","snapshot_id":"s"}`},
+		{"fs_snapshot", func(ctx context.Context, c *Client) error {
+			return c.FsSnapshot(ctx, FsSnapshotArgs{FsUUID: "u", DestSsName: "s"})
+		}, `{"fs_uuid":"u","dest_ss_name":"s"}`},
+		{"fs_snapshot_list", func(ctx context.Context, c *Client) error {
+			_, err := c.FsSnapshotList(ctx, FsSnapshotListArgs{FsUUID: "u"})
+			return err
+		}, `{"fs_uuid":"u"}`},
+		{"fs_snapshot_delete", func(ctx context.Context, c *Client) error {
+			return c.FsSnapshotDelete(ctx, FsSnapshotDeleteArgs{FsUUID: "u", SsUUID: "s"})
+		}, `{"fs_uuid":"u","ss_uuid":"s"}`},
+		{"nfs_export_auth_list", func(ctx context.Context, c *Client) error {
+			_, err := c.NfsExportAuthList(ctx)
+			return err
+		}, `null`},
+		{"nfs_export_list", func(ctx context.Context, c *Client) error {
+			_, err := c.NfsExportList(ctx)
+			return err
+		}, `null`},
+		{"nfs_export_add", func(ctx context.Context, c *Client) error {
+			return c.NfsExportAdd(ctx, NfsExportAddArgs{Host: "*", Path: "/fs/vol", Options: []string{"rw"}})
+		}, `{"host":"*","path":"/fs/vol","options":["rw"]}`},
+		{"nfs_export_remove", func(ctx context.Context, c *Client) error {
+			return c.NfsExportRemove(ctx, NfsExportRemoveArgs{Host: "*", Path: "/fs/vol"})
+		}, `{"host":"*","path":"/fs/vol"}`},
+	}
+	s := newStub(t)
+	c := newStubClient(t, s)
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			if err := test.call(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			req := s.last(t)
+			if req.Method != test.method {
+				t.Errorf("method %s, want %s", req.Method, test.method)
+			}
+			if len(req.Params) == 0 {
+				req.Params = json.RawMessage(`null`)
+			}
+			assertJSON(t, req.Params, test.params)
+		})
+	}
+}
+
+func TestResponseDecoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		call   func(ctx context.Context, c *Client) (interface{}, error)
+		want   interface{}
+	}{
+		{"pool_list", `[{"name":"vg","size":100,"free_size":40,"type":"block","uuid":"u"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.PoolList(ctx) },
+			[]Pool{{Name: "vg", Size: 100, FreeSize: 40, Type: "block", UUID: "u"}}},
+		{"vol_list", `[{"name":"vol","size":10,"uuid":"u"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.VolList(ctx, VolListArgs{Pool: "vg"})
+			},
+			[]Volume{{Name: "vol", Size: 10, UUID: "u"}}},
+		{"export_list", `[{"initiator_wwn":"iqn.a","lun":2,"vol_name":"vol","vol_size":10,"vol_uuid":"u","pool":"vg"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.ExportList(ctx) },
+			[]Export{{InitiatorWwn: "iqn.a", Lun: 2, VolName: "vol", VolSize: 10, VolUUID: "u", Pool: "vg"}}},
+		{"initiator_list", `[{"init_id":"iqn.a","init_type":"iscsi"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.InitiatorList(ctx, InitiatorListArgs{})
+			},
+			[]Initiator{{InitID: "iqn.a", InitType: "iscsi"}}},
+		{"access_group_list", `[{"name":"ag","init_ids":["iqn.a","iqn.b"],"init_type":"iscsi"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.AccessGroupList(ctx) },
+			[]AccessGroup{{Name: "ag", InitIDs: []string{"iqn.a", "iqn.b"}, InitType: "iscsi"}}},
+		{"access_group_map_list", `[{"ag_name":"ag","h_lun_id":4,"pool_name":"vg","vol_name":"vol"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.AccessGroupMapList(ctx) },
+			[]AccessGroupMap{{AgName: "ag", HLunID: 4, PoolName: "vg", VolName: "vol"}}},
+		{"fs_list", `[{"name":"vol","uuid":"u","total_space":100,"free_space":60,"pool":"fs","full_path":"/fs/vol"}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.FsList(ctx) },
+			[]Filesystem{{Name: "vol", UUID: "u", TotalSpace: 100, FreeSpace: 60, Pool: "fs", FullPath: "/fs/vol"}}},
+		{"fs_snapshot_list", `[{"name":"s","uuid":"u","timestamp":1600000000}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.FsSnapshotList(ctx, FsSnapshotListArgs{FsUUID: "f"})
+			},
+			[]Snapshot{{Name: "s", UUID: "u", Timestamp: 1600000000}}},
+		{"nfs_export_auth_list", `["sys","krb5"]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.NfsExportAuthList(ctx) },
+			[]string{"sys", "krb5"}},
+		{"nfs_export_list", `[{"host":"*","path":"/fs/vol","options":["rw","no_root_squash"]}]`,
+			func(ctx context.Context, c *Client) (interface{}, error) { return c.NfsExportList(ctx) },
+			[]NfsExport{{Host: "*", Path: "/fs/vol", Options: []string{"rw", "no_root_squash"}}}},
+	}
+	s := newStub(t)
+	c := newStubClient(t, s)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.mutex.Lock()
+			s.result = json.RawMessage(test.result)
+			s.mutex.Unlock()
+			got, err := test.call(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	tests := []struct {
+		code     ErrorCode
+		notFound bool
+		conflict bool
+	}{
+		{NotFoundVolume, true, false},
+		{NotFoundVolumeGroup, true, false},
+		{NotFoundAccessGroup, true, false},
+		{NotFoundFs, true, false},
+		{NotFoundSs, true, false},
+		{NotFoundVolumeExport, true, false},
+		{NotFoundNfsExport, true, false},
+		{NameConflict, false, true},
+		{ExistsInitiator, false, true},
+		{ExistsCloneName, false, true},
+		{ExistsFsName, false, true},
+		{InvalidArgument, false, false},
+		{UnexpectedExitCode, false, false},
+		{NoFreeHostLunId, false, false},
+		{ErrorCode(-999), false, false},
+	}
+	s := newStub(t)
+	c := newStubClient(t, s)
+	for _, test := range tests {
+		t.Run(test.code.Error(), func(t *testing.T) {
+			s.mutex.Lock()
+			s.err = &ErrorInfo{Code: test.code, Message: "failed"}
+			s.mutex.Unlock()
+			err := c.VolDestroy(context.Background(), VolDestroyArgs{Pool: "vg", Name: "vol"})
+			var targetdErr *Error
+			if !errors.As(err, &targetdErr) {
+				t.Fatalf("got %T %v, want *Error", err, err)
+			}
+			if targetdErr.Method != "vol_destroy" || targetdErr.Info.Message != "failed" {
+				t.Errorf("got %+v", targetdErr)
+			}
+			if code, ok := Code(err); !ok || code != test.code {
+				t.Errorf("Code() = %d, %v, want %d", code, ok, test.code)
+			}
+			if !errors.Is(err, test.code) {
+				t.Errorf("errors.Is(err, %d) is false", test.code)
+			}
+			if IsNotFound(err) != test.notFound {
+				t.Errorf("IsNotFound() = %v, want %v", IsNotFound(err), test.notFound)
+			}
+			if IsConflict(err) != test.conflict {
+				t.Errorf("IsConflict() = %v, want %v", IsConflict(err), test.conflict)
+			}
+		})
+	}
+}
+
+func TestErrorMappingWithoutTargetdError(t *testing.T) {
+	for _, err := range []error{nil, errors.New("connection refused"), context.Canceled} {
+		if _, ok := Code(err); ok {
+			t.Errorf("Code(%v) reports a code", err)
+		}
+		if IsNotFound(err) || IsConflict(err) {
+			t.Errorf("%v is reported as not found or conflict", err)
+		}
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	var connections int64
+	s := newUnstartedStub(t)
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	s.Start()
+	c := newStubClient(t, s)
+	for i := 0; i < 10; i++ {
+		if _, err := c.PoolList(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&connections); n != 1 {
+		t.Errorf("expected the calls to share 1 connection, opened %d", n)
+	}
+}
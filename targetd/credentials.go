@@ -0,0 +1,153 @@
+package targetd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// UsernameKey is the file or Secret key holding the targetd username
+	UsernameKey = "username"
+	// PasswordKey is the file or Secret key holding the targetd password
+	PasswordKey = "password"
+)
+
+// Credentials are sent to targetd using HTTP basic authentication.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// String never includes the password so credentials can not leak into logs.
+func (c Credentials) String() string {
+	return fmt.Sprintf("{Username:%s Password:<redacted>}", c.Username)
+}
+
+// CredentialsProvider returns the credentials to use for the next call.
+// It is consulted on every call so changed credentials apply immediately.
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// Auth configures the client to authenticate using provider.
+func Auth(provider CredentialsProvider) Option {
+	return func(c *Client) {
+		c.credentials = provider
+	}
+}
+
+// StaticCredentials always returns the same credentials.
+type StaticCredentials Credentials
+
+func (s StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
+
+// FileCredentials reads the credentials from the username and password files
+// in a directory, like a mounted Secret, and rereads them when they change.
+type FileCredentials struct {
+	dir      string
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+	current  Credentials
+}
+
+// NewFileCredentials creates a provider reading the credentials from dir.
+func NewFileCredentials(dir string) (*FileCredentials, error) {
+	f := &FileCredentials{dir: dir}
+	if _, err := f.Credentials(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileCredentials) Credentials() (Credentials, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.modTimes == nil {
+		f.modTimes = make(map[string]time.Time)
+	}
+	usernameFile := filepath.Join(f.dir, UsernameKey)
+	passwordFile := filepath.Join(f.dir, PasswordKey)
+	changed, err := fileChanged(f.modTimes, usernameFile, passwordFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if !changed {
+		return f.current, nil
+	}
+	username, err := ioutil.ReadFile(usernameFile)
+	if err != nil {
+		f.modTimes = nil
+		return Credentials{}, err
+	}
+	password, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		f.modTimes = nil
+		return Credentials{}, err
+	}
+	f.current = Credentials{
+		Username: strings.TrimSpace(string(username)),
+		Password: strings.TrimSpace(string(password)),
+	}
+	return f.current, nil
+}
+
+// SecretCredentials reads the credentials from the username and password keys
+// of a Kubernetes Secret, which is watched for changes.
+type SecretCredentials struct {
+	namespace string
+	name      string
+	lister    corelisters.SecretNamespaceLister
+}
+
+// NewSecretCredentials creates a provider for the Secret namespace/name and
+// starts watching it until ctx is done.
+func NewSecretCredentials(ctx context.Context, client kubernetes.Interface, namespace, name string) (*SecretCredentials, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = "metadata.name=" + name
+		}))
+	secrets := factory.Core().V1().Secrets()
+	informer := secrets.Informer()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("failed to sync secret %s/%s", namespace, name)
+	}
+	s := &SecretCredentials{
+		namespace: namespace,
+		name:      name,
+		lister:    secrets.Lister().Secrets(namespace),
+	}
+	if _, err := s.Credentials(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SecretCredentials) Credentials() (Credentials, error) {
+	secret, err := s.lister.Get(s.name)
+	if err != nil {
+		return Credentials{}, err
+	}
+	password, ok := secret.Data[PasswordKey]
+	if !ok {
+		return Credentials{}, fmt.Errorf("secret %s/%s has no %s key", s.namespace, s.name, PasswordKey)
+	}
+	return Credentials{
+		Username: strings.TrimSpace(string(secret.Data[UsernameKey])),
+		Password: strings.TrimSpace(string(password)),
+	}, nil
+}
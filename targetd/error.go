@@ -1,5 +1,13 @@
 package targetd
 
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+
+	"github.com/powerman/rpc-codec/jsonrpc2"
+)
+
 type ErrorCode int
 
 const (
@@ -9,6 +17,7 @@ const (
 	NoSupport          ErrorCode = -153
 	UnexpectedExitCode ErrorCode = -303
 	InvalidArgument    ErrorCode = -32602
+	InternalError      ErrorCode = -32603 // also used for transport failures
 
 	// Specific to block
 	ExistsInitiator     ErrorCode = -52
@@ -29,6 +38,36 @@ const (
 	NfsNoSupport         ErrorCode = -401
 )
 
+var errorCodeNames = map[ErrorCode]string{
+	Invalid:              "invalid",
+	NameConflict:         "name conflict",
+	NoSupport:            "no support",
+	UnexpectedExitCode:   "unexpected exit code",
+	InvalidArgument:      "invalid argument",
+	InternalError:        "internal error",
+	ExistsInitiator:      "initiator exists",
+	NotFoundVolume:       "volume not found",
+	NotFoundVolumeGroup:  "volume group not found",
+	NotFoundAccessGroup:  "access group not found",
+	NoFreeHostLunId:      "no free host lun id",
+	ExistsCloneName:      "clone name exists",
+	ExistsFsName:         "filesystem name exists",
+	NotFoundFs:           "filesystem not found",
+	InvalidPool:          "invalid pool",
+	NotFoundSs:           "snapshot not found",
+	NotFoundVolumeExport: "volume export not found",
+	NotFoundNfsExport:    "nfs export not found",
+	NfsNoSupport:         "nfs not supported",
+}
+
+// Error makes every ErrorCode usable as a sentinel with errors.Is.
+func (c ErrorCode) Error() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("targetd error %d", int(c))
+}
+
 type ErrorInfo struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
@@ -37,3 +76,94 @@ type ErrorInfo struct {
 func (i ErrorInfo) Error() string {
 	return i.Message
 }
+
+// Is reports whether target is the ErrorCode of this error.
+func (i ErrorInfo) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == i.Code
+}
+
+// Error is returned by every Client call that targetd answered with an error.
+type Error struct {
+	Method string
+	Info   ErrorInfo
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("targetd %s failed: %s (%d)", e.Method, e.Info.Message, e.Info.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Info
+}
+
+// StatusError is returned when targetd answers a call with an HTTP error
+// status instead of a JSON-RPC response, like 401 for bad credentials.
+type StatusError struct {
+	Method     string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("targetd %s failed: HTTP %s", e.Method, e.Status)
+}
+
+// ErrCredentials is wrapped by the error of a call whose credentials could
+// not be loaded.
+var ErrCredentials = errors.New("failed to get targetd credentials")
+
+// newError converts an error returned by a jsonrpc2 call into an *Error when
+// it carries a targetd error object, otherwise it is returned as is.
+func newError(method string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); !ok {
+		return err
+	}
+	rpcErr := jsonrpc2.ServerError(err)
+	return &Error{
+		Method: method,
+		Info: ErrorInfo{
+			Code:    ErrorCode(rpcErr.Code),
+			Message: rpcErr.Message,
+		},
+	}
+}
+
+// Code returns the targetd error code carried by err, if any.
+func Code(err error) (ErrorCode, bool) {
+	var info ErrorInfo
+	if errors.As(err, &info) {
+		return info.Code, true
+	}
+	return 0, false
+}
+
+// IsNotFound reports whether err is a targetd error about a missing object.
+func IsNotFound(err error) bool {
+	code, ok := Code(err)
+	if !ok {
+		return false
+	}
+	switch code {
+	case NotFoundVolume, NotFoundVolumeGroup, NotFoundAccessGroup, NotFoundFs, NotFoundSs, NotFoundVolumeExport, NotFoundNfsExport:
+		return true
+	}
+	return false
+}
+
+// IsConflict reports whether err is a targetd error about an object that
+// already exists.
+func IsConflict(err error) bool {
+	code, ok := Code(err)
+	if !ok {
+		return false
+	}
+	switch code {
+	case NameConflict, ExistsInitiator, ExistsCloneName, ExistsFsName:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,405 @@
+package fake
+
+import (
+	"encoding/json"
+	"sort"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+)
+
+// maxLun is the highest lun that can be exported to an initiator.
+const maxLun = 255
+
+func (s *Server) blockPool(name string) (*pool, error) {
+	p, ok := s.pools[name]
+	if !ok || p.fs {
+		return nil, errorf(targetd.NotFoundVolumeGroup, "Volume Group %s not found", name)
+	}
+	return p, nil
+}
+
+func (s *Server) volume(poolName, name string) (targetd.Volume, error) {
+	if _, err := s.blockPool(poolName); err != nil {
+		return targetd.Volume{}, err
+	}
+	volume, ok := s.volumes[poolName][name]
+	if !ok {
+		return targetd.Volume{}, errorf(targetd.NotFoundVolume, "Volume %s not found in pool %s", name, poolName)
+	}
+	return volume, nil
+}
+
+func (s *Server) addVolume(p *pool, name string, size int64) error {
+	if _, ok := s.volumes[p.name][name]; ok {
+		return errorf(targetd.NameConflict, "Volume with that name exists")
+	}
+	if size > p.size-s.used(p) {
+		return errorf(targetd.UnexpectedExitCode, "Unexpected exit code 5: insufficient free space in %s", p.name)
+	}
+	s.volumes[p.name][name] = targetd.Volume{Name: name, Size: size, UUID: s.newUUID()}
+	return nil
+}
+
+func (s *Server) isMapped(poolName, name string) bool {
+	for _, export := range s.exports {
+		if export.Pool == poolName && export.VolName == name {
+			return true
+		}
+	}
+	for _, m := range s.accessGroupMaps {
+		if m.PoolName == poolName && m.VolName == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) volList(params json.RawMessage) (interface{}, error) {
+	var args targetd.VolListArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.blockPool(args.Pool); err != nil {
+		return nil, err
+	}
+	volumes := []targetd.Volume{}
+	for _, volume := range s.volumes[args.Pool] {
+		volumes = append(volumes, volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+func (s *Server) volCreate(params json.RawMessage) (interface{}, error) {
+	var args targetd.VolCreateArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	p, err := s.blockPool(args.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.addVolume(p, args.Name, args.Size)
+}
+
+func (s *Server) volDestroy(params json.RawMessage) (interface{}, error) {
+	var args targetd.VolDestroyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.volume(args.Pool, args.Name); err != nil {
+		return nil, err
+	}
+	if s.isMapped(args.Pool, args.Name) {
+		return nil, errorf(targetd.VolumeMasked, "Volume is exported")
+	}
+	delete(s.volumes[args.Pool], args.Name)
+	return nil, nil
+}
+
+func (s *Server) volCopy(params json.RawMessage) (interface{}, error) {
+	var args targetd.VolCopyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	orig, err := s.volume(args.Pool, args.VolOrig)
+	if err != nil {
+		return nil, err
+	}
+	size := args.Size
+	if size == 0 {
+		size = orig.Size
+	}
+	if size < orig.Size {
+		return nil, errorf(targetd.InvalidArgument, "Size %d is smaller than the original volume", size)
+	}
+	p, _ := s.blockPool(args.Pool)
+	return nil, s.addVolume(p, args.VolNew, size)
+}
+
+func (s *Server) volResize(params json.RawMessage) (interface{}, error) {
+	var args targetd.VolResizeArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	volume, err := s.volume(args.Pool, args.Name)
+	if err != nil {
+		return nil, err
+	}
+	if args.Size < volume.Size {
+		return nil, errorf(targetd.InvalidArgument, "Volume can not be shrunk")
+	}
+	p, _ := s.blockPool(args.Pool)
+	if args.Size-volume.Size > p.size-s.used(p) {
+		return nil, errorf(targetd.UnexpectedExitCode, "Unexpected exit code 5: insufficient free space in %s", p.name)
+	}
+	volume.Size = args.Size
+	s.volumes[args.Pool][args.Name] = volume
+	return nil, nil
+}
+
+func (s *Server) exportList(json.RawMessage) (interface{}, error) {
+	exports := []targetd.Export{}
+	for _, export := range s.exports {
+		volume := s.volumes[export.Pool][export.VolName]
+		export.VolSize = volume.Size
+		export.VolUUID = volume.UUID
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+func (s *Server) exportCreate(params json.RawMessage) (interface{}, error) {
+	var args targetd.ExportCreateArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.volume(args.Pool, args.Vol); err != nil {
+		return nil, err
+	}
+	if args.Lun < 0 || args.Lun > maxLun {
+		return nil, errorf(targetd.InvalidArgument, "Lun %d out of range", args.Lun)
+	}
+	for _, export := range s.exports {
+		if export.InitiatorWwn != args.InitiatorWwn {
+			continue
+		}
+		if export.Pool == args.Pool && export.VolName == args.Vol {
+			if export.Lun == args.Lun {
+				return nil, nil
+			}
+			return nil, errorf(targetd.NameConflict, "Volume already exported to %s", args.InitiatorWwn)
+		}
+		if export.Lun == args.Lun {
+			return nil, errorf(targetd.NameConflict, "Lun %d already in use for %s", args.Lun, args.InitiatorWwn)
+		}
+	}
+	s.exports = append(s.exports, targetd.Export{
+		InitiatorWwn: args.InitiatorWwn,
+		Lun:          args.Lun,
+		VolName:      args.Vol,
+		Pool:         args.Pool,
+	})
+	return nil, nil
+}
+
+func (s *Server) exportDestroy(params json.RawMessage) (interface{}, error) {
+	var args targetd.ExportDestroyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	for i, export := range s.exports {
+		if export.Pool == args.Pool && export.VolName == args.Vol && export.InitiatorWwn == args.InitiatorWwn {
+			s.exports = append(s.exports[:i], s.exports[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, errorf(targetd.NotFoundVolumeExport, "Volume %s not exported to %s", args.Vol, args.InitiatorWwn)
+}
+
+func (s *Server) initiatorList(params json.RawMessage) (interface{}, error) {
+	var args targetd.InitiatorListArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, group := range s.accessGroups {
+		for _, id := range group.InitIDs {
+			seen[id] = !args.StandaloneOnly
+		}
+	}
+	for _, export := range s.exports {
+		if _, ok := seen[export.InitiatorWwn]; !ok {
+			seen[export.InitiatorWwn] = true
+		}
+	}
+	for id := range s.auth {
+		if _, ok := seen[id]; !ok {
+			seen[id] = true
+		}
+	}
+	initiators := []targetd.Initiator{}
+	for id, listed := range seen {
+		if listed {
+			initiators = append(initiators, targetd.Initiator{InitID: id, InitType: "iscsi"})
+		}
+	}
+	sort.Slice(initiators, func(i, j int) bool { return initiators[i].InitID < initiators[j].InitID })
+	return initiators, nil
+}
+
+func (s *Server) initiatorSetAuth(params json.RawMessage) (interface{}, error) {
+	var args targetd.InitiatorSetAuthArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	s.auth[args.InitiatorWwn] = args
+	return nil, nil
+}
+
+func (s *Server) accessGroupList(json.RawMessage) (interface{}, error) {
+	groups := []targetd.AccessGroup{}
+	for _, group := range s.accessGroups {
+		groups = append(groups, *group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+// groupOf returns the access group initiator is part of.
+func (s *Server) groupOf(initiator string) string {
+	for name, group := range s.accessGroups {
+		for _, id := range group.InitIDs {
+			if id == initiator {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Server) accessGroup(name string) (*targetd.AccessGroup, error) {
+	group, ok := s.accessGroups[name]
+	if !ok {
+		return nil, errorf(targetd.NotFoundAccessGroup, "Access group %s not found", name)
+	}
+	return group, nil
+}
+
+func (s *Server) accessGroupCreate(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupCreateArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, ok := s.accessGroups[args.AgName]; ok {
+		return nil, errorf(targetd.NameConflict, "Access group %s exists", args.AgName)
+	}
+	if s.groupOf(args.InitID) != "" {
+		return nil, errorf(targetd.ExistsInitiator, "Initiator %s already in an access group", args.InitID)
+	}
+	s.accessGroups[args.AgName] = &targetd.AccessGroup{
+		Name:     args.AgName,
+		InitIDs:  []string{args.InitID},
+		InitType: args.InitType,
+	}
+	return nil, nil
+}
+
+func (s *Server) accessGroupDestroy(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupDestroyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.accessGroup(args.AgName); err != nil {
+		return nil, err
+	}
+	maps := s.accessGroupMaps[:0]
+	for _, m := range s.accessGroupMaps {
+		if m.AgName != args.AgName {
+			maps = append(maps, m)
+		}
+	}
+	s.accessGroupMaps = maps
+	delete(s.accessGroups, args.AgName)
+	return nil, nil
+}
+
+func (s *Server) accessGroupInitAdd(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupInitArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	group, err := s.accessGroup(args.AgName)
+	if err != nil {
+		return nil, err
+	}
+	switch s.groupOf(args.InitID) {
+	case "":
+	case args.AgName:
+		return nil, nil
+	default:
+		return nil, errorf(targetd.ExistsInitiator, "Initiator %s already in an access group", args.InitID)
+	}
+	group.InitIDs = append(group.InitIDs, args.InitID)
+	return nil, nil
+}
+
+func (s *Server) accessGroupInitDel(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupInitArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	group, err := s.accessGroup(args.AgName)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range group.InitIDs {
+		if id == args.InitID {
+			group.InitIDs = append(group.InitIDs[:i], group.InitIDs[i+1:]...)
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) accessGroupMapList(json.RawMessage) (interface{}, error) {
+	return append([]targetd.AccessGroupMap{}, s.accessGroupMaps...), nil
+}
+
+func (s *Server) accessGroupMapCreate(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupMapCreateArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.volume(args.PoolName, args.VolName); err != nil {
+		return nil, err
+	}
+	if _, err := s.accessGroup(args.AgName); err != nil {
+		return nil, err
+	}
+	used := make(map[int32]bool)
+	for _, m := range s.accessGroupMaps {
+		if m.AgName != args.AgName {
+			continue
+		}
+		if m.PoolName == args.PoolName && m.VolName == args.VolName {
+			return nil, nil
+		}
+		used[m.HLunID] = true
+	}
+	var lun int32
+	if args.HLunID != nil {
+		lun = *args.HLunID
+		if used[lun] {
+			return nil, errorf(targetd.NoFreeHostLunId, "Host lun %d already in use", lun)
+		}
+	} else {
+		for used[lun] {
+			lun++
+		}
+		if lun > maxLun {
+			return nil, errorf(targetd.NoFreeHostLunId, "No free host lun id")
+		}
+	}
+	s.accessGroupMaps = append(s.accessGroupMaps, targetd.AccessGroupMap{
+		AgName:   args.AgName,
+		HLunID:   lun,
+		PoolName: args.PoolName,
+		VolName:  args.VolName,
+	})
+	return nil, nil
+}
+
+func (s *Server) accessGroupMapDestroy(params json.RawMessage) (interface{}, error) {
+	var args targetd.AccessGroupMapDestroyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	for i, m := range s.accessGroupMaps {
+		if m.AgName == args.AgName && m.PoolName == args.PoolName && m.VolName == args.VolName {
+			s.accessGroupMaps = append(s.accessGroupMaps[:i], s.accessGroupMaps[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, errorf(targetd.NotFoundVolumeExport, "Volume %s not mapped to %s", args.VolName, args.AgName)
+}
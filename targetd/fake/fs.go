@@ -0,0 +1,209 @@
+package fake
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+)
+
+// MountRoot is where the fake pretends filesystem pools are mounted.
+const MountRoot = "/var/lib/targetd/fs"
+
+func (s *Server) fsPool(name string) (*pool, error) {
+	p, ok := s.pools[name]
+	if !ok || !p.fs {
+		return nil, errorf(targetd.InvalidPool, "Invalid pool %s", name)
+	}
+	return p, nil
+}
+
+func (s *Server) filesystem(uuid string) (targetd.Filesystem, error) {
+	fs, ok := s.filesystems[uuid]
+	if !ok {
+		return targetd.Filesystem{}, errorf(targetd.NotFoundFs, "Filesystem %s not found", uuid)
+	}
+	return fs, nil
+}
+
+// addFilesystem adds a filesystem sharing the space of its pool, like
+// targetd which creates btrfs subvolumes without a quota.
+func (s *Server) addFilesystem(p *pool, name string, conflict targetd.ErrorCode) error {
+	for _, fs := range s.filesystems {
+		if fs.Pool == p.name && fs.Name == name {
+			return errorf(conflict, "Filesystem with that name exists")
+		}
+	}
+	uuid := s.newUUID()
+	s.filesystems[uuid] = targetd.Filesystem{
+		Name:     name,
+		UUID:     uuid,
+		Pool:     p.name,
+		FullPath: path.Join(MountRoot, p.name, name),
+	}
+	return nil
+}
+
+// withSpace sets the space of fs like targetd, which reports the statvfs of
+// the subvolume and so the space of the whole pool.
+func (s *Server) withSpace(fs targetd.Filesystem) targetd.Filesystem {
+	p := s.pools[fs.Pool]
+	fs.TotalSpace = p.size
+	fs.FreeSpace = p.size - s.used(p)
+	return fs
+}
+
+func (s *Server) fsList(json.RawMessage) (interface{}, error) {
+	filesystems := []targetd.Filesystem{}
+	for _, fs := range s.filesystems {
+		filesystems = append(filesystems, s.withSpace(fs))
+	}
+	sort.Slice(filesystems, func(i, j int) bool { return filesystems[i].FullPath < filesystems[j].FullPath })
+	return filesystems, nil
+}
+
+func (s *Server) fsCreate(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsCreateArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	p, err := s.fsPool(args.PoolName)
+	if err != nil {
+		return nil, err
+	}
+	// size_bytes is ignored by targetd
+	return nil, s.addFilesystem(p, args.Name, targetd.ExistsFsName)
+}
+
+func (s *Server) fsDestroy(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsDestroyArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.filesystem(args.UUID); err != nil {
+		return nil, err
+	}
+	delete(s.filesystems, args.UUID)
+	delete(s.snapshots, args.UUID)
+	return nil, nil
+}
+
+func (s *Server) fsClone(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsCloneArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	fs, err := s.filesystem(args.FsUUID)
+	if err != nil {
+		return nil, err
+	}
+	if args.SnapshotID != "" {
+		found := false
+		for _, snapshot := range s.snapshots[args.FsUUID] {
+			if snapshot.UUID == args.SnapshotID {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errorf(targetd.NotFoundSs, "Snapshot %s not found", args.SnapshotID)
+		}
+	}
+	p, err := s.fsPool(fs.Pool)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.addFilesystem(p, args.DestFsName, targetd.ExistsCloneName)
+}
+
+func (s *Server) fsSnapshot(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsSnapshotArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.filesystem(args.FsUUID); err != nil {
+		return nil, err
+	}
+	for _, snapshot := range s.snapshots[args.FsUUID] {
+		if snapshot.Name == args.DestSsName {
+			return nil, errorf(targetd.NameConflict, "Snapshot with that name exists")
+		}
+	}
+	s.snapshots[args.FsUUID] = append(s.snapshots[args.FsUUID], targetd.Snapshot{
+		Name:      args.DestSsName,
+		UUID:      s.newUUID(),
+		Timestamp: time.Now().Unix(),
+	})
+	return nil, nil
+}
+
+func (s *Server) fsSnapshotList(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsSnapshotListArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.filesystem(args.FsUUID); err != nil {
+		return nil, err
+	}
+	return append([]targetd.Snapshot{}, s.snapshots[args.FsUUID]...), nil
+}
+
+func (s *Server) fsSnapshotDelete(params json.RawMessage) (interface{}, error) {
+	var args targetd.FsSnapshotDeleteArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	if _, err := s.filesystem(args.FsUUID); err != nil {
+		return nil, err
+	}
+	snapshots := s.snapshots[args.FsUUID]
+	for i, snapshot := range snapshots {
+		if snapshot.UUID == args.SsUUID {
+			s.snapshots[args.FsUUID] = append(snapshots[:i], snapshots[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, errorf(targetd.NotFoundSs, "Snapshot %s not found", args.SsUUID)
+}
+
+func (s *Server) nfsExportAuthList(json.RawMessage) (interface{}, error) {
+	return []string{"sys"}, nil
+}
+
+func (s *Server) nfsExportList(json.RawMessage) (interface{}, error) {
+	return append([]targetd.NfsExport{}, s.nfsExports...), nil
+}
+
+func (s *Server) nfsExportAdd(params json.RawMessage) (interface{}, error) {
+	var args targetd.NfsExportAddArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	for i, export := range s.nfsExports {
+		if export.Host == args.Host && export.Path == args.Path {
+			s.nfsExports[i].Options = args.Options
+			return nil, nil
+		}
+	}
+	s.nfsExports = append(s.nfsExports, targetd.NfsExport{
+		Host:    args.Host,
+		Path:    args.Path,
+		Options: args.Options,
+	})
+	return nil, nil
+}
+
+func (s *Server) nfsExportRemove(params json.RawMessage) (interface{}, error) {
+	var args targetd.NfsExportRemoveArgs
+	if err := decode(params, &args); err != nil {
+		return nil, err
+	}
+	for i, export := range s.nfsExports {
+		if export.Host == args.Host && export.Path == args.Path {
+			s.nfsExports = append(s.nfsExports[:i], s.nfsExports[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, errorf(targetd.NotFoundNfsExport, "NFS export %s for %s not found", args.Path, args.Host)
+}
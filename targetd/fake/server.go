@@ -0,0 +1,367 @@
+// Package fake provides an in-memory targetd server for tests.
+//
+// The server speaks the targetd JSON-RPC 2.0 API over an httptest.Server,
+// keeps pools, block volumes, exports, access groups, filesystems, snapshots,
+// nfs exports and initiator authentication in memory, and answers with the
+// same targetd.ErrorCode values as a real targetd would.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+)
+
+// Fault describes a failure injected into calls of a method.
+type Fault struct {
+	// Code and Message are returned as targetd error when Code is not zero.
+	Code    targetd.ErrorCode
+	Message string
+	// HTTPStatus is returned instead of a JSON-RPC response when not zero.
+	HTTPStatus int
+	// Delay is waited before the call is answered.
+	Delay time.Duration
+	// Times is the number of calls affected, 0 means all following calls.
+	Times int
+}
+
+type pool struct {
+	name string
+	size int64
+	fs   bool
+	uuid string
+}
+
+// Server is an in-memory targetd.
+type Server struct {
+	*httptest.Server
+
+	mutex           sync.Mutex
+	pools           map[string]*pool
+	volumes         map[string]map[string]targetd.Volume
+	exports         []targetd.Export
+	auth            map[string]targetd.InitiatorSetAuthArgs
+	accessGroups    map[string]*targetd.AccessGroup
+	accessGroupMaps []targetd.AccessGroupMap
+	filesystems     map[string]targetd.Filesystem
+	snapshots       map[string][]targetd.Snapshot
+	nfsExports      []targetd.NfsExport
+	faults          map[string][]*Fault
+	calls           map[string]int
+	sequence        int
+}
+
+type handler func(s *Server, params json.RawMessage) (interface{}, error)
+
+var handlers = map[string]handler{
+	"pool_list":                (*Server).poolList,
+	"vol_list":                 (*Server).volList,
+	"vol_create":               (*Server).volCreate,
+	"vol_destroy":              (*Server).volDestroy,
+	"vol_copy":                 (*Server).volCopy,
+	"vol_resize":               (*Server).volResize,
+	"export_list":              (*Server).exportList,
+	"export_create":            (*Server).exportCreate,
+	"export_destroy":           (*Server).exportDestroy,
+	"initiator_list":           (*Server).initiatorList,
+	"initiator_set_auth":       (*Server).initiatorSetAuth,
+	"access_group_list":        (*Server).accessGroupList,
+	"access_group_create":      (*Server).accessGroupCreate,
+	"access_group_destroy":     (*Server).accessGroupDestroy,
+	"access_group_init_add":    (*Server).accessGroupInitAdd,
+	"access_group_init_del":    (*Server).accessGroupInitDel,
+	"access_group_map_list":    (*Server).accessGroupMapList,
+	"access_group_map_create":  (*Server).accessGroupMapCreate,
+	"access_group_map_destroy": (*Server).accessGroupMapDestroy,
+	"fs_list":                  (*Server).fsList,
+	"fs_create":                (*Server).fsCreate,
+	"fs_destroy":               (*Server).fsDestroy,
+	"fs_clone":                 (*Server).fsClone,
+	"fs_snapshot":              (*Server).fsSnapshot,
+	"fs_snapshot_list":         (*Server).fsSnapshotList,
+	"fs_snapshot_delete":       (*Server).fsSnapshotDelete,
+	"nfs_export_auth_list":     (*Server).nfsExportAuthList,
+	"nfs_export_list":          (*Server).nfsExportList,
+	"nfs_export_add":           (*Server).nfsExportAdd,
+	"nfs_export_remove":        (*Server).nfsExportRemove,
+}
+
+// NewServer starts a new empty targetd server, which must be closed by the
+// caller. Its URL can be passed to targetd.NewClient.
+func NewServer() *Server {
+	s := &Server{
+		pools:        make(map[string]*pool),
+		volumes:      make(map[string]map[string]targetd.Volume),
+		auth:         make(map[string]targetd.InitiatorSetAuthArgs),
+		accessGroups: make(map[string]*targetd.AccessGroup),
+		filesystems:  make(map[string]targetd.Filesystem),
+		snapshots:    make(map[string][]targetd.Snapshot),
+		faults:       make(map[string][]*Fault),
+		calls:        make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddBlockPool adds a volume group for block volumes.
+func (s *Server) AddBlockPool(name string, size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pools[name] = &pool{name: name, size: size, uuid: s.newUUID()}
+	s.volumes[name] = make(map[string]targetd.Volume)
+}
+
+// AddFsPool adds a pool for filesystems.
+func (s *Server) AddFsPool(name string, size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pools[name] = &pool{name: name, size: size, fs: true, uuid: s.newUUID()}
+}
+
+// Inject makes calls of method fail as described by fault. Faults of a
+// method are applied in the order they were injected.
+func (s *Server) Inject(method string, fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[method] = append(s.faults[method], &fault)
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = make(map[string][]*Fault)
+}
+
+// Calls returns how often method was called, including failed calls.
+func (s *Server) Calls(method string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[method]
+}
+
+// Volume returns the block volume name in pool.
+func (s *Server) Volume(pool, name string) (targetd.Volume, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	volume, ok := s.volumes[pool][name]
+	return volume, ok
+}
+
+// Exports returns all block volume exports.
+func (s *Server) Exports() []targetd.Export {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]targetd.Export(nil), s.exports...)
+}
+
+// InitiatorAuth returns the authentication set for an initiator.
+func (s *Server) InitiatorAuth(initiator string) (targetd.InitiatorSetAuthArgs, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	auth, ok := s.auth[initiator]
+	return auth, ok
+}
+
+// AccessGroup returns the access group name.
+func (s *Server) AccessGroup(name string) (targetd.AccessGroup, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	group, ok := s.accessGroups[name]
+	if !ok {
+		return targetd.AccessGroup{}, false
+	}
+	return *group, true
+}
+
+// AccessGroupMaps returns all volumes mapped to access groups.
+func (s *Server) AccessGroupMaps() []targetd.AccessGroupMap {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]targetd.AccessGroupMap(nil), s.accessGroupMaps...)
+}
+
+// Filesystem returns the filesystem name in pool.
+func (s *Server) Filesystem(pool, name string) (targetd.Filesystem, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, fs := range s.filesystems {
+		if fs.Pool == pool && fs.Name == name {
+			return s.withSpace(fs), true
+		}
+	}
+	return targetd.Filesystem{}, false
+}
+
+// Snapshots returns the snapshots of the filesystem with uuid.
+func (s *Server) Snapshots(uuid string) []targetd.Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]targetd.Snapshot(nil), s.snapshots[uuid]...)
+}
+
+// NfsExports returns all nfs exports.
+func (s *Server) NfsExports() []targetd.NfsExport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]targetd.NfsExport(nil), s.nfsExports...)
+}
+
+type request struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+}
+
+type response struct {
+	Version string             `json:"jsonrpc"`
+	ID      *json.RawMessage   `json:"id"`
+	Result  interface{}        `json:"result,omitempty"`
+	Error   *targetd.ErrorInfo `json:"error,omitempty"`
+}
+
+// resultResponse always includes the result, even when it is null.
+type resultResponse struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	fault := s.takeFault(req.Method)
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.HTTPStatus != 0 {
+			w.WriteHeader(fault.HTTPStatus)
+			return
+		}
+	}
+
+	var result interface{}
+	if fault != nil && fault.Code != 0 {
+		err = targetd.ErrorInfo{Code: fault.Code, Message: fault.Message}
+	} else {
+		result, err = s.dispatch(req.Method, req.Params)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		info, ok := err.(targetd.ErrorInfo)
+		if !ok {
+			info = targetd.ErrorInfo{Code: targetd.InternalError, Message: err.Error()}
+		}
+		_ = json.NewEncoder(w).Encode(response{Version: "2.0", ID: req.ID, Error: &info})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resultResponse{Version: "2.0", ID: req.ID, Result: result})
+}
+
+// takeFault returns the fault to apply to the next call of method and
+// counts the call.
+func (s *Server) takeFault(method string) *Fault {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls[method]++
+	faults := s.faults[method]
+	if len(faults) == 0 {
+		return nil
+	}
+	fault := faults[0]
+	if fault.Times > 0 {
+		fault.Times--
+		if fault.Times == 0 {
+			s.faults[method] = faults[1:]
+		}
+	}
+	return fault
+}
+
+func (s *Server) dispatch(method string, params json.RawMessage) (interface{}, error) {
+	h, ok := handlers[method]
+	if !ok {
+		return nil, targetd.ErrorInfo{Code: -32601, Message: fmt.Sprintf("method %s not found", method)}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return h(s, params)
+}
+
+// decode unmarshals the params of a call into args.
+func decode(params json.RawMessage, args interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, args); err != nil {
+		return errorf(targetd.InvalidArgument, "invalid params: %v", err)
+	}
+	return nil
+}
+
+func errorf(code targetd.ErrorCode, format string, args ...interface{}) error {
+	return targetd.ErrorInfo{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) newUUID() string {
+	s.sequence++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", s.sequence)
+}
+
+func (s *Server) poolList(json.RawMessage) (interface{}, error) {
+	pools := []targetd.Pool{}
+	for _, p := range s.pools {
+		used := s.used(p)
+		poolType := "block"
+		if p.fs {
+			poolType = "fs"
+		}
+		pools = append(pools, targetd.Pool{
+			Name:     p.name,
+			Size:     p.size,
+			FreeSize: p.size - used,
+			Type:     poolType,
+			UUID:     p.uuid,
+		})
+	}
+	return pools, nil
+}
+
+// used returns the space allocated in p. Filesystems only use the space of
+// the data written to them, which the fake never does.
+func (s *Server) used(p *pool) int64 {
+	var used int64
+	if p.fs {
+		return 0
+	}
+	for _, volume := range s.volumes[p.name] {
+		used += volume.Size
+	}
+	return used
+}
@@ -0,0 +1,120 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.sonck.nl/targetd-provisioner/targetd"
+	"go.uber.org/zap"
+)
+
+func newTestClient(t *testing.T) (*Server, *targetd.Client) {
+	s := NewServer()
+	t.Cleanup(s.Close)
+	client, err := targetd.NewClient(s.URL, zap.NewNop(), targetd.Retry(targetd.RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	return s, client
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	s, client := newTestClient(t)
+	ctx := context.Background()
+	s.AddBlockPool("vg", 1<<30)
+
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg", Name: "a", Size: 1 << 29}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg", Name: "a", Size: 1 << 20}); !errors.Is(err, targetd.NameConflict) {
+		t.Errorf("expected %v creating a again, got %v", targetd.NameConflict, err)
+	}
+	if err := client.VolCreate(ctx, targetd.VolCreateArgs{Pool: "vg", Name: "b", Size: 1 << 30}); err == nil {
+		t.Error("expected a volume larger than the free space to be refused")
+	}
+	if err := client.ExportCreate(ctx, targetd.ExportCreateArgs{Pool: "vg", Vol: "a", InitiatorWwn: "iqn.a", Lun: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VolDestroy(ctx, targetd.VolDestroyArgs{Pool: "vg", Name: "a"}); !errors.Is(err, targetd.VolumeMasked) {
+		t.Errorf("expected %v destroying an exported volume, got %v", targetd.VolumeMasked, err)
+	}
+	if err := client.ExportDestroy(ctx, targetd.ExportDestroyArgs{Pool: "vg", Vol: "a", InitiatorWwn: "iqn.a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VolDestroy(ctx, targetd.VolDestroyArgs{Pool: "vg", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Volume("vg", "a"); ok {
+		t.Error("expected volume a to be removed")
+	}
+	if err := client.VolDestroy(ctx, targetd.VolDestroyArgs{Pool: "vg", Name: "a"}); !errors.Is(err, targetd.NotFoundVolume) {
+		t.Errorf("expected %v destroying a again, got %v", targetd.NotFoundVolume, err)
+	}
+}
+
+func TestFilesystemsSharePool(t *testing.T) {
+	s, client := newTestClient(t)
+	ctx := context.Background()
+	s.AddFsPool("fs", 1<<30)
+
+	// like targetd, size_bytes is ignored
+	for _, name := range []string{"a", "b"} {
+		if err := client.FsCreate(ctx, targetd.FsCreateArgs{PoolName: "fs", Name: name, SizeBytes: 1 << 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filesystems, err := client.FsList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystems) != 2 {
+		t.Fatalf("expected filesystems a and b, got %+v", filesystems)
+	}
+	for _, fs := range filesystems {
+		if fs.TotalSpace != 1<<30 || fs.FreeSpace != 1<<30 {
+			t.Errorf("expected %s to report the space of the pool, got %+v", fs.Name, fs)
+		}
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	s, client := newTestClient(t)
+	ctx := context.Background()
+	s.Inject("pool_list", Fault{Code: targetd.InvalidPool, Message: "Invalid pool", Times: 1})
+	s.Inject("pool_list", Fault{HTTPStatus: 503, Times: 1})
+
+	if _, err := client.PoolList(ctx); !errors.Is(err, targetd.InvalidPool) {
+		t.Errorf("expected the first call to fail with %v, got %v", targetd.InvalidPool, err)
+	}
+	if _, err := client.PoolList(ctx); err == nil {
+		t.Error("expected the second call to fail with the http status")
+	}
+	if _, err := client.PoolList(ctx); err != nil {
+		t.Errorf("expected the faults to be used up, got %v", err)
+	}
+	if calls := s.Calls("pool_list"); calls != 3 {
+		t.Errorf("expected 3 pool_list calls, got %d", calls)
+	}
+}
+
+func TestInjectedDelay(t *testing.T) {
+	s, client := newTestClient(t)
+	s.Inject("pool_list", Fault{Delay: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.PoolList(ctx); err == nil {
+		t.Error("expected the delayed call to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the call to give up with its context, took %v", elapsed)
+	}
+	s.ClearFaults()
+	if _, err := client.PoolList(context.Background()); err != nil {
+		t.Errorf("expected the cleared faults not to apply, got %v", err)
+	}
+}
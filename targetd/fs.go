@@ -0,0 +1,90 @@
+package targetd
+
+import "context"
+
+// Filesystem describes a filesystem as returned by fs_list.
+type Filesystem struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	TotalSpace int64  `json:"total_space"`
+	FreeSpace  int64  `json:"free_space"`
+	Pool       string `json:"pool"`
+	FullPath   string `json:"full_path"`
+}
+
+// Snapshot describes a filesystem snapshot as returned by fs_snapshot_list.
+type Snapshot struct {
+	Name      string `json:"name"`
+	UUID      string `json:"uuid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type FsCreateArgs struct {
+	PoolName  string `json:"pool_name"`
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+type FsDestroyArgs struct {
+	UUID string `json:"uuid"`
+}
+
+type FsCloneArgs struct {
+	FsUUID     string `json:"fs_uuid"`
+	DestFsName string `json:"dest_fs_name"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+}
+
+type FsSnapshotArgs struct {
+	FsUUID     string `json:"fs_uuid"`
+	DestSsName string `json:"dest_ss_name"`
+}
+
+type FsSnapshotListArgs struct {
+	FsUUID string `json:"fs_uuid"`
+}
+
+type FsSnapshotDeleteArgs struct {
+	FsUUID string `json:"fs_uuid"`
+	SsUUID string `json:"ss_uuid"`
+}
+
+// FsList calls fs_list to get all filesystems.
+func (c *Client) FsList(ctx context.Context) ([]Filesystem, error) {
+	var filesystems []Filesystem
+	err := c.call(ctx, "fs_list", nil, &filesystems)
+	return filesystems, err
+}
+
+// FsCreate calls fs_create to create a filesystem.
+func (c *Client) FsCreate(ctx context.Context, args FsCreateArgs) error {
+	return c.call(ctx, "fs_create", args, nil)
+}
+
+// FsDestroy calls fs_destroy to remove a filesystem.
+func (c *Client) FsDestroy(ctx context.Context, args FsDestroyArgs) error {
+	return c.call(ctx, "fs_destroy", args, nil)
+}
+
+// FsClone calls fs_clone to create a filesystem from another filesystem or
+// one of its snapshots.
+func (c *Client) FsClone(ctx context.Context, args FsCloneArgs) error {
+	return c.call(ctx, "fs_clone", args, nil)
+}
+
+// FsSnapshot calls fs_snapshot to create a snapshot of a filesystem.
+func (c *Client) FsSnapshot(ctx context.Context, args FsSnapshotArgs) error {
+	return c.call(ctx, "fs_snapshot", args, nil)
+}
+
+// FsSnapshotList calls fs_snapshot_list to get the snapshots of a filesystem.
+func (c *Client) FsSnapshotList(ctx context.Context, args FsSnapshotListArgs) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := c.call(ctx, "fs_snapshot_list", args, &snapshots)
+	return snapshots, err
+}
+
+// FsSnapshotDelete calls fs_snapshot_delete to remove a snapshot.
+func (c *Client) FsSnapshotDelete(ctx context.Context, args FsSnapshotDeleteArgs) error {
+	return c.call(ctx, "fs_snapshot_delete", args, nil)
+}
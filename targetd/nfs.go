@@ -0,0 +1,46 @@
+package targetd
+
+import "context"
+
+// NfsExport describes an nfs export as returned by nfs_export_list.
+type NfsExport struct {
+	Host    string   `json:"host"`
+	Path    string   `json:"path"`
+	Options []string `json:"options"`
+}
+
+type NfsExportAddArgs struct {
+	Host    string   `json:"host"`
+	Path    string   `json:"path"`
+	Options []string `json:"options"`
+}
+
+type NfsExportRemoveArgs struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+}
+
+// NfsExportAuthList calls nfs_export_auth_list to get the supported nfs
+// authentication types.
+func (c *Client) NfsExportAuthList(ctx context.Context) ([]string, error) {
+	var auth []string
+	err := c.call(ctx, "nfs_export_auth_list", nil, &auth)
+	return auth, err
+}
+
+// NfsExportList calls nfs_export_list to get all nfs exports.
+func (c *Client) NfsExportList(ctx context.Context) ([]NfsExport, error) {
+	var exports []NfsExport
+	err := c.call(ctx, "nfs_export_list", nil, &exports)
+	return exports, err
+}
+
+// NfsExportAdd calls nfs_export_add to export a path to a host.
+func (c *Client) NfsExportAdd(ctx context.Context, args NfsExportAddArgs) error {
+	return c.call(ctx, "nfs_export_add", args, nil)
+}
+
+// NfsExportRemove calls nfs_export_remove to remove the export of a path.
+func (c *Client) NfsExportRemove(ctx context.Context, args NfsExportRemoveArgs) error {
+	return c.call(ctx, "nfs_export_remove", args, nil)
+}
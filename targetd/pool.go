@@ -0,0 +1,19 @@
+package targetd
+
+import "context"
+
+// Pool describes a block or filesystem pool as returned by pool_list.
+type Pool struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	FreeSize int64  `json:"free_size"`
+	Type     string `json:"type"`
+	UUID     string `json:"uuid"`
+}
+
+// PoolList calls pool_list to get all pools known to targetd.
+func (c *Client) PoolList(ctx context.Context) ([]Pool, error) {
+	var pools []Pool
+	err := c.call(ctx, "pool_list", nil, &pools)
+	return pools, err
+}
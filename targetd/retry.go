@@ -0,0 +1,168 @@
+package targetd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts made for a call
+	DefaultRetryAttempts = 3
+	// DefaultRetryInitialBackoff is the wait before the first retry
+	DefaultRetryInitialBackoff = 500 * time.Millisecond
+	// DefaultRetryMaxBackoff caps the wait between retries
+	DefaultRetryMaxBackoff = 10 * time.Second
+	// DefaultBreakerThreshold is the number of consecutive transient failures
+	// after which the circuit breaker opens
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerOpenDuration is how long an open circuit breaker rejects
+	// calls before letting a probe through
+	DefaultBreakerOpenDuration = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without contacting targetd while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("targetd circuit breaker is open")
+
+// RetryPolicy controls how transient failures are retried.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 disables retries.
+	Attempts int
+	// InitialBackoff is doubled after every attempt up to MaxBackoff, each
+	// wait is randomized between half and the full backoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Retry configures how the client retries transient failures.
+func Retry(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// BreakerPolicy controls when the circuit breaker opens.
+type BreakerPolicy struct {
+	// Threshold is the number of consecutive transient failures that opens
+	// the breaker, 0 disables it.
+	Threshold int
+	// OpenDuration is how long calls are rejected once the breaker is open.
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker configures when the client stops calling targetd.
+func CircuitBreaker(policy BreakerPolicy) Option {
+	return func(c *Client) {
+		c.breaker = &breaker{policy: policy}
+	}
+}
+
+// IsTransient reports whether err is likely to go away when the call is
+// retried, like a connection failure, a 5xx status or an unexpected exit code
+// of a tool run by targetd. Errors about the request itself, like a 4xx
+// status for bad credentials, InvalidArgument or NotFoundVolumeGroup, are
+// permanent.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrCredentials) {
+		return false
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= http.StatusInternalServerError || status.StatusCode == http.StatusTooManyRequests
+	}
+	if code, ok := Code(err); ok {
+		return code == InternalError || code == UnexpectedExitCode
+	}
+	// anything not answered by targetd is a transport failure
+	return true
+}
+
+// backoff returns the randomized wait before retry number attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker that opens after consecutive transient
+// failures and lets a single probe through once the open duration passed.
+type breaker struct {
+	policy   BreakerPolicy
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a call may be made.
+func (b *breaker) allow() bool {
+	if b == nil || b.policy.Threshold <= 0 {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// a probe is already in flight
+		return false
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a call and reports whether
+// it opened because of it.
+func (b *breaker) record(err error) bool {
+	if b == nil || b.policy.Threshold <= 0 {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCredentials) {
+		// the call was abandoned or never sent, which says nothing about
+		// targetd
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+		return false
+	}
+	if !IsTransient(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.policy.Threshold {
+		opened := b.state != breakerOpen
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return opened
+	}
+	return false
+}
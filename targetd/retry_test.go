@@ -0,0 +1,225 @@
+package targetd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"canceled request", &url.Error{Op: "Post", URL: "http://targetd", Err: context.Canceled}, false},
+		{"deadline", fmt.Errorf("targetd vol_list failed: %w", context.DeadlineExceeded), false},
+		{"circuit open", ErrCircuitOpen, false},
+		{"credentials", fmt.Errorf("%w: no such file", ErrCredentials), false},
+		{"unauthorized", &StatusError{Method: "vol_list", StatusCode: http.StatusUnauthorized}, false},
+		{"forbidden", &StatusError{Method: "vol_list", StatusCode: http.StatusForbidden}, false},
+		{"not found status", &StatusError{Method: "vol_list", StatusCode: http.StatusNotFound}, false},
+		{"too many requests", &StatusError{Method: "vol_list", StatusCode: http.StatusTooManyRequests}, true},
+		{"internal server error", &StatusError{Method: "vol_list", StatusCode: http.StatusInternalServerError}, true},
+		{"service unavailable", &StatusError{Method: "vol_list", StatusCode: http.StatusServiceUnavailable}, true},
+		{"internal error", &Error{Method: "vol_list", Info: ErrorInfo{Code: InternalError}}, true},
+		{"unexpected exit code", &Error{Method: "vol_create", Info: ErrorInfo{Code: UnexpectedExitCode}}, true},
+		{"invalid argument", &Error{Method: "vol_create", Info: ErrorInfo{Code: InvalidArgument}}, false},
+		{"volume group not found", &Error{Method: "vol_create", Info: ErrorInfo{Code: NotFoundVolumeGroup}}, false},
+		{"connection refused", errors.New("dial tcp: connection refused"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsTransient(test.err); got != test.transient {
+				t.Errorf("IsTransient(%v) = %v, want %v", test.err, got, test.transient)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			if backoff := policy.backoff(attempt); backoff < max/2 || backoff > max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", attempt, backoff, max/2, max)
+			}
+		}
+	}
+}
+
+// retryingClient returns a client retrying three times without waiting,
+// whose breaker opens after three failures.
+func retryingClient(t *testing.T, s *stub, options ...Option) *Client {
+	return newStubClient(t, s, append([]Option{
+		Retry(RetryPolicy{Attempts: 3}),
+		CircuitBreaker(BreakerPolicy{Threshold: 3, OpenDuration: time.Hour}),
+	}, options...)...)
+}
+
+func TestRetryHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status  int
+		calls   int
+		breaker bool
+	}{
+		{http.StatusUnauthorized, 1, false},
+		{http.StatusForbidden, 1, false},
+		{http.StatusServiceUnavailable, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			s := newStub(t)
+			s.status = test.status
+			c := retryingClient(t, s)
+			_, err := c.PoolList(context.Background())
+			var status *StatusError
+			if !errors.As(err, &status) || status.StatusCode != test.status || status.Method != "pool_list" {
+				t.Fatalf("got %v, want status %d", err, test.status)
+			}
+			if s.calls() != test.calls {
+				t.Errorf("got %d calls, want %d", s.calls(), test.calls)
+			}
+			_, err = c.PoolList(context.Background())
+			if errors.Is(err, ErrCircuitOpen) != test.breaker {
+				t.Errorf("got %v after failing, circuit open %v", err, test.breaker)
+			}
+		})
+	}
+}
+
+type failingCredentials struct{}
+
+func (failingCredentials) Credentials() (Credentials, error) {
+	return Credentials{}, errors.New("password file missing")
+}
+
+func TestRetryCredentialsFailure(t *testing.T) {
+	s := newStub(t)
+	c := retryingClient(t, s, Auth(failingCredentials{}))
+	for i := 0; i < 3; i++ {
+		_, err := c.PoolList(context.Background())
+		if !errors.Is(err, ErrCredentials) {
+			t.Fatalf("got %v, want ErrCredentials", err)
+		}
+	}
+	if s.calls() != 0 {
+		t.Errorf("got %d calls, want none", s.calls())
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := newStub(t)
+	s.delay = time.Minute
+	c := retryingClient(t, s)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := c.PoolList(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want context.DeadlineExceeded", err)
+		}
+	}
+	if s.calls() != 3 {
+		t.Errorf("got %d calls, want one per canceled call", s.calls())
+	}
+
+	s.mutex.Lock()
+	s.delay = 0
+	s.mutex.Unlock()
+	if _, err := c.PoolList(context.Background()); err != nil {
+		t.Errorf("canceled calls opened the circuit breaker: %v", err)
+	}
+}
+
+func TestRetryTransientTargetdError(t *testing.T) {
+	s := newStub(t)
+	s.err = &ErrorInfo{Code: UnexpectedExitCode, Message: "lvcreate failed"}
+	c := newStubClient(t, s, Retry(RetryPolicy{Attempts: 3}))
+	err := c.VolCreate(context.Background(), VolCreateArgs{Pool: "vg", Name: "vol", Size: 1})
+	if !errors.Is(err, UnexpectedExitCode) {
+		t.Fatalf("got %v, want UnexpectedExitCode", err)
+	}
+	if s.calls() != 3 {
+		t.Errorf("got %d calls, want 3", s.calls())
+	}
+
+	s.mutex.Lock()
+	s.err = &ErrorInfo{Code: InvalidArgument, Message: "invalid size"}
+	s.mutex.Unlock()
+	err = c.VolCreate(context.Background(), VolCreateArgs{Pool: "vg", Name: "vol", Size: 1})
+	if !errors.Is(err, InvalidArgument) {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	if s.calls() != 4 {
+		t.Errorf("permanent error was retried, got %d calls, want 4", s.calls())
+	}
+}
+
+func TestRetryTimedOutAttempt(t *testing.T) {
+	s := newStub(t)
+	s.delay = time.Minute
+	c := newStubClient(t, s, Retry(RetryPolicy{Attempts: 3}), ListTimeout(20*time.Millisecond))
+	if _, err := c.PoolList(context.Background()); err == nil {
+		t.Fatal("expected the call to time out")
+	}
+	if s.calls() != 3 {
+		t.Errorf("got %d calls, want every timed out attempt to be retried", s.calls())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := newStub(t)
+	s.status = http.StatusServiceUnavailable
+	c := newStubClient(t, s, CircuitBreaker(BreakerPolicy{Threshold: 3, OpenDuration: 50 * time.Millisecond}))
+	for i := 0; i < 3; i++ {
+		if _, err := c.PoolList(context.Background()); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: got %v, want the failure of targetd", i, err)
+		}
+	}
+	if _, err := c.PoolList(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	if s.calls() != 3 {
+		t.Errorf("got %d calls, want none while the breaker is open", s.calls())
+	}
+
+	// a successful probe closes the breaker again
+	s.mutex.Lock()
+	s.status = 0
+	s.mutex.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := c.PoolList(context.Background()); err != nil {
+			t.Errorf("got %v after the breaker closed", err)
+		}
+	}
+}
+
+func TestCircuitBreakerReopensAfterFailedProbe(t *testing.T) {
+	s := newStub(t)
+	s.status = http.StatusServiceUnavailable
+	c := newStubClient(t, s, CircuitBreaker(BreakerPolicy{Threshold: 1, OpenDuration: 50 * time.Millisecond}))
+	if _, err := c.PoolList(context.Background()); errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want the failure of targetd", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.PoolList(context.Background()); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want the probe to reach targetd", err)
+	}
+	if _, err := c.PoolList(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v, want the breaker to open again", err)
+	}
+}
@@ -0,0 +1,82 @@
+package targetd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTimeoutPerMethodClass(t *testing.T) {
+	c, err := NewClient("http://localhost:18700/targetrpc", zap.NewNop(), ListTimeout(time.Second), MutateTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for method, expected := range map[string]time.Duration{
+		"pool_list":      time.Second,
+		"export_list":    time.Second,
+		"vol_create":     time.Minute,
+		"export_destroy": time.Minute,
+	} {
+		if timeout := c.timeout(method); timeout != expected {
+			t.Errorf("timeout(%s) = %v, want %v", method, timeout, expected)
+		}
+	}
+}
+
+func TestCallTimesOut(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx context.Context, c *Client) error
+	}{
+		{"list", func(ctx context.Context, c *Client) error {
+			_, err := c.PoolList(ctx)
+			return err
+		}},
+		{"mutate", func(ctx context.Context, c *Client) error {
+			return c.VolDestroy(ctx, VolDestroyArgs{Pool: "vg", Name: "vol"})
+		}},
+	}
+	s := newStub(t)
+	s.mutex.Lock()
+	s.delay = time.Second
+	s.mutex.Unlock()
+	c := newStubClient(t, s, ListTimeout(20*time.Millisecond), MutateTimeout(20*time.Millisecond))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			if err := test.call(context.Background(), c); err == nil {
+				t.Error("expected the call to time out")
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("call returned after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestCallHonoursContext(t *testing.T) {
+	s := newStub(t)
+	s.mutex.Lock()
+	s.delay = time.Second
+	s.mutex.Unlock()
+	c := newStubClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c.PoolList(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestZeroTimeoutDisablesTimeout(t *testing.T) {
+	s := newStub(t)
+	s.mutex.Lock()
+	s.delay = 50 * time.Millisecond
+	s.mutex.Unlock()
+	c := newStubClient(t, s, ListTimeout(0))
+	if _, err := c.PoolList(context.Background()); err != nil {
+		t.Errorf("expected the call to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package targetd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig describes how the connection to targetd is secured when the
+// https scheme is used. Certificate and CA files are reloaded from disk
+// whenever they change, so they can be rotated without a restart.
+type TLSConfig struct {
+	// CAFile is a PEM bundle used to verify targetd, the system roots are
+	// used when empty.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate presented to targetd.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name sent with SNI and verified against the
+	// certificate of targetd.
+	ServerName string
+	// MinVersion is the minimum accepted TLS version, see ParseTLSVersion.
+	MinVersion uint16
+	// InsecureSkipVerify disables all verification of targetd.
+	InsecureSkipVerify bool
+	// PinnedSHA256 lists the hex encoded SHA-256 fingerprints of which the
+	// targetd certificate must match one.
+	PinnedSHA256 []string
+}
+
+// TLS configures the client to secure its connection using config.
+func TLS(config TLSConfig) Option {
+	return func(c *Client) {
+		c.tlsConfig = &config
+	}
+}
+
+// ParseTLSVersion converts a version like "1.2" into its tls constant.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", version)
+}
+
+// build creates the tls.Config for a connection to host.
+func (config *TLSConfig) build(host string) (*tls.Config, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("both a client certificate and key are required")
+	}
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	pins := make(map[string]bool, len(config.PinnedSHA256))
+	for _, pin := range config.PinnedSHA256 {
+		pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+		if _, err := hex.DecodeString(pin); err != nil || len(pin) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid certificate pin %q", pin)
+		}
+		pins[pin] = true
+	}
+
+	ca := &caReloader{file: config.CAFile}
+	if _, err := ca.get(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: config.MinVersion,
+		// verification is done by verifyPeerCertificate so the CA bundle
+		// can be reloaded between handshakes
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeerCertificate(rawCerts, serverName, ca, pins, config.InsecureSkipVerify)
+		},
+	}
+	if config.CertFile != "" {
+		cert := &certReloader{certFile: config.CertFile, keyFile: config.KeyFile}
+		if _, err := cert.get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+	return tlsConfig, nil
+}
+
+func verifyPeerCertificate(rawCerts [][]byte, serverName string, ca *caReloader, pins map[string]bool, insecure bool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("targetd did not present a certificate")
+	}
+	if len(pins) > 0 {
+		sum := sha256.Sum256(rawCerts[0])
+		if !pins[hex.EncodeToString(sum[:])] {
+			return errors.New("targetd certificate does not match any pinned fingerprint")
+		}
+	}
+	if insecure {
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse targetd certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	roots, err := ca.get()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	})
+	return err
+}
+
+// fileChanged reports whether any of files has a different modification
+// time than recorded in modTimes, and records the current ones.
+func fileChanged(modTimes map[string]time.Time, files ...string) (bool, error) {
+	changed := false
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Equal(modTimes[file]) {
+			modTimes[file] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// caReloader keeps a CA pool loaded from file up to date.
+type caReloader struct {
+	file     string
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+	pool     *x509.CertPool
+}
+
+// get returns the current CA pool, nil means the system roots.
+func (r *caReloader) get() (*x509.CertPool, error) {
+	if r.file == "" {
+		return nil, nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.modTimes == nil {
+		r.modTimes = make(map[string]time.Time)
+	}
+	changed, err := fileChanged(r.modTimes, r.file)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return r.pool, nil
+	}
+	pool, err := loadCertPool(r.file)
+	if err != nil {
+		// retry on the next handshake, keep using the previous bundle
+		// while the file is being rotated
+		r.modTimes = nil
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	r.pool = pool
+	return r.pool, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// certReloader keeps a client certificate loaded from file up to date.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+	cert     *tls.Certificate
+}
+
+func (r *certReloader) get() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.modTimes == nil {
+		r.modTimes = make(map[string]time.Time)
+	}
+	changed, err := fileChanged(r.modTimes, r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// retry on the next handshake, keep using the previous certificate
+		// while the certificate and key are being rotated
+		r.modTimes = nil
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert = &cert
+	return r.cert, nil
+}
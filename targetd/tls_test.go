@@ -0,0 +1,264 @@
+package targetd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certificate is a key pair signed by a test CA.
+type certificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newCertificate creates a certificate from template, signed by parent or
+// self-signed when parent is nil.
+func newCertificate(t *testing.T, template *x509.Certificate, parent *certificate) *certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certificate{
+		cert: cert,
+		key:  key,
+		tls:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+func newCA(t *testing.T) *certificate {
+	return newCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "targetd test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+// write writes the certificate and its key as PEM files to dir and returns
+// their paths.
+func (c *certificate) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsTest is a stub serving https with a certificate for targetd.example
+// and 127.0.0.1 signed by ca.
+type tlsTest struct {
+	stub   *stub
+	ca     *certificate
+	server *certificate
+	dir    string
+	caFile string
+}
+
+func newTLSTest(t *testing.T, configure func(*tls.Config)) *tlsTest {
+	ca := newCA(t)
+	server := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "targetd.example"},
+		DNSNames:    []string{"targetd.example"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	s := newUnstartedStub(t)
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{server.tls}}
+	if configure != nil {
+		configure(s.TLS)
+	}
+	s.StartTLS()
+	dir := t.TempDir()
+	caFile, _ := ca.write(t, dir, "ca")
+	return &tlsTest{stub: s, ca: ca, server: server, dir: dir, caFile: caFile}
+}
+
+// call makes a call to the stub with a client using config.
+func (test *tlsTest) call(t *testing.T, config TLSConfig) error {
+	t.Helper()
+	c, err := NewClient(test.stub.URL, zap.NewNop(), TLS(config), Retry(RetryPolicy{Attempts: 1}))
+	if err != nil {
+		return err
+	}
+	defer c.CloseIdleConnections()
+	_, err = c.PoolList(context.Background())
+	return err
+}
+
+func TestTLSVerifiesCertificate(t *testing.T) {
+	test := newTLSTest(t, nil)
+	if err := test.call(t, TLSConfig{CAFile: test.caFile}); err != nil {
+		t.Errorf("expected the certificate to verify with the ca file, got %v", err)
+	}
+	other, _ := newCA(t).write(t, test.dir, "other")
+	if err := test.call(t, TLSConfig{CAFile: other}); err == nil {
+		t.Error("expected a certificate of another ca to be rejected")
+	}
+	if err := test.call(t, TLSConfig{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("expected verification to be skipped, got %v", err)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	test := newTLSTest(t, nil)
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, ServerName: "targetd.example"}); err != nil {
+		t.Errorf("expected the certificate to match targetd.example, got %v", err)
+	}
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, ServerName: "other.example"}); err == nil {
+		t.Error("expected the certificate not to match other.example")
+	}
+}
+
+func TestTLSPinning(t *testing.T) {
+	test := newTLSTest(t, nil)
+	sum := sha256.Sum256(test.server.cert.Raw)
+	pin := hex.EncodeToString(sum[:])
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, PinnedSHA256: []string{pin}}); err != nil {
+		t.Errorf("expected the pinned certificate to be accepted, got %v", err)
+	}
+	other := sha256.Sum256([]byte("other"))
+	if err := test.call(t, TLSConfig{InsecureSkipVerify: true, PinnedSHA256: []string{hex.EncodeToString(other[:])}}); err == nil {
+		t.Error("expected a certificate not matching the pin to be rejected")
+	}
+	if err := test.call(t, TLSConfig{PinnedSHA256: []string{"not hex"}}); err == nil {
+		t.Error("expected an invalid pin to be rejected")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	clientCA := newCA(t)
+	test := newTLSTest(t, func(config *tls.Config) {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	})
+	client := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "provisioner"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, clientCA)
+	certFile, keyFile := client.write(t, test.dir, "client")
+
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Errorf("expected the client certificate to be accepted, got %v", err)
+	}
+	if err := test.call(t, TLSConfig{CAFile: test.caFile}); err == nil {
+		t.Error("expected the call without client certificate to fail")
+	}
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, CertFile: certFile}); err == nil {
+		t.Error("expected a client certificate without key to be rejected")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	test := newTLSTest(t, func(config *tls.Config) {
+		config.MaxVersion = tls.VersionTLS12
+	})
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, MinVersion: tls.VersionTLS12}); err != nil {
+		t.Errorf("expected TLS 1.2 to be accepted, got %v", err)
+	}
+	if err := test.call(t, TLSConfig{CAFile: test.caFile, MinVersion: tls.VersionTLS13}); err == nil {
+		t.Error("expected a server limited to TLS 1.2 to be rejected")
+	}
+}
+
+func TestTLSReloadsCAFile(t *testing.T) {
+	test := newTLSTest(t, nil)
+	caFile := filepath.Join(test.dir, "bundle.crt")
+	other, _ := newCA(t).write(t, test.dir, "other")
+	copyFile(t, other, caFile)
+
+	c, err := NewClient(test.stub.URL, zap.NewNop(), TLS(TLSConfig{CAFile: caFile}), Retry(RetryPolicy{Attempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseIdleConnections()
+	if _, err := c.PoolList(context.Background()); err == nil {
+		t.Fatal("expected the certificate to be rejected by the other ca")
+	}
+	copyFile(t, test.caFile, caFile)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PoolList(context.Background()); err != nil {
+		t.Errorf("expected the rotated ca file to be used, got %v", err)
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for version, expected := range map[string]uint16{
+		"":    0,
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		if got, err := ParseTLSVersion(version); err != nil || got != expected {
+			t.Errorf("ParseTLSVersion(%q) = %d, %v, want %d", version, got, err, expected)
+		}
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("expected 1.4 to be rejected")
+	}
+}
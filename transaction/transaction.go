@@ -0,0 +1,70 @@
+// Package transaction undoes the completed steps of a provisioning operation
+// when a later step fails.
+package transaction
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// RollbackTimeout bounds the time all compensations of a transaction may
+// take, they run even when the provisioning context was cancelled.
+const RollbackTimeout = 2 * time.Minute
+
+type compensation struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// Transaction records a compensating action for every completed step.
+type Transaction struct {
+	log           *zap.Logger
+	recorder      record.EventRecorder
+	object        runtime.Object
+	compensations []compensation
+}
+
+// New creates a transaction whose compensations are logged to log and
+// reported as events on object.
+func New(log *zap.Logger, recorder record.EventRecorder, object runtime.Object) *Transaction {
+	return &Transaction{
+		log:      log,
+		recorder: recorder,
+		object:   object,
+	}
+}
+
+// Completed records the compensating action of a step that completed,
+// description says what undo does.
+func (t *Transaction) Completed(description string, undo func(ctx context.Context) error) {
+	t.compensations = append(t.compensations, compensation{
+		description: description,
+		undo:        undo,
+	})
+}
+
+// Rollback runs the compensations of all completed steps in reverse order
+// because of cause. A failing compensation does not stop the others, the
+// state it leaves behind is reported so it can be cleaned up.
+func (t *Transaction) Rollback(cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RollbackTimeout)
+	defer cancel()
+	for i := len(t.compensations) - 1; i >= 0; i-- {
+		c := t.compensations[i]
+		log := t.log.With(zap.String("compensation", c.description), zap.NamedError("cause", cause))
+		err := c.undo(ctx)
+		if err != nil {
+			log.Warn("failed to roll back", zap.Error(err))
+			t.recorder.Eventf(t.object, v1.EventTypeWarning, "RollbackFailed", "failed to %s after provisioning failed: %v: %v", c.description, cause, err)
+			continue
+		}
+		log.Info("rolled back")
+		t.recorder.Eventf(t.object, v1.EventTypeNormal, "RolledBack", "rolled back: %s after provisioning failed: %v", c.description, cause)
+	}
+	t.compensations = nil
+}
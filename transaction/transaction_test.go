@@ -0,0 +1,68 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRollbackRunsCompensationsInReverse(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	tx := New(zap.NewNop(), recorder, &v1.PersistentVolumeClaim{})
+	var undone []string
+	for _, step := range []string{"create", "export", "authenticate"} {
+		step := step
+		tx.Completed("undo "+step, func(context.Context) error {
+			undone = append(undone, step)
+			if step == "export" {
+				return errors.New("export is gone")
+			}
+			return nil
+		})
+	}
+
+	tx.Rollback(errors.New("provisioning failed"))
+	if expected := []string{"authenticate", "export", "create"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("expected compensations %v, got %v", expected, undone)
+	}
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected an event for every compensation, got %v", events)
+	}
+	if !strings.HasPrefix(events[1], v1.EventTypeWarning+" RollbackFailed") {
+		t.Errorf("expected the failed compensation to be reported, got %q", events[1])
+	}
+	for _, i := range []int{0, 2} {
+		if !strings.HasPrefix(events[i], v1.EventTypeNormal+" RolledBack") {
+			t.Errorf("expected a RolledBack event, got %q", events[i])
+		}
+	}
+
+	// the compensations run only once
+	tx.Rollback(errors.New("provisioning failed"))
+	if len(undone) != 3 {
+		t.Errorf("expected a second rollback to do nothing, got %v", undone)
+	}
+}
+
+func TestRollbackIgnoresCancelledContext(t *testing.T) {
+	tx := New(zap.NewNop(), record.NewFakeRecorder(10), &v1.PersistentVolumeClaim{})
+	var err error
+	tx.Completed("undo", func(ctx context.Context) error {
+		err = ctx.Err()
+		return nil
+	})
+	tx.Rollback(context.Canceled)
+	if err != nil {
+		t.Errorf("expected the compensation to get a live context, got %v", err)
+	}
+}